@@ -1,21 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
-	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"strconv"
-	"strings"
 	"sync"
-	"sync/atomic"
 	"syscall"
 
 	"github.com/elisescu/tty-share/server"
+	"github.com/elisescu/tty-share/share"
 	"github.com/gorilla/websocket"
 	"github.com/hashicorp/yamux"
 	"github.com/moby/term"
@@ -25,39 +22,71 @@ import (
 type ttyShareClient struct {
 	url             string
 	ttyWsConn       *websocket.Conn
-	tunnelWsConn    *websocket.Conn
-	tunnelAddresses *string
+	tunnelAddresses []string
+	reverseTunnel   *string
+	dynamicTunnel   string
 	detachKeys      string
-	wcChan          chan os.Signal
-	ioFlagAtomic    uint32 // used with atomic
-	winSizes        struct {
-		thisW   uint16
-		thisH   uint16
-		remoteW uint16
-		remoteH uint16
+	panKey          string
+	// The name this participant introduces itself with
+	name string
+	// Apply the clipboard set by the remote applications to the local terminal
+	clipboard bool
+	// Answer the clipboard queries of the remote applications, with the local clipboard
+	clipboardPush bool
+	// The token the server gave to this participant, used to open the tunnels
+	participantToken string
+	tunnelsOnce      sync.Once
+	wcChan           chan os.Signal
+	winSizes         struct {
+		thisW uint16
+		thisH uint16
 	}
-	winSizesMutex    sync.Mutex
-	tunnelMuxSession *yamux.Session
+	winSizesMutex sync.Mutex
+	viewport      *viewport
+	// The mux sessions and the local listeners of all the tunnels, closed when the client stops
+	tunnelClosers      []io.Closer
+	tunnelClosersMutex sync.Mutex
+	// Negotiate the compression of the tunnels. The TTY connection is always compressed, if the
+	// server supports it
+	tunnelCompression bool
 }
 
-func newTtyShareClient(url string, detachKeys string, tunnelConfig *string) *ttyShareClient {
+func newTtyShareClient(url string, detachKeys string, panKey string, name string, clipboard, clipboardPush bool, tunnelConfig []string, reverseTunnelConfig *string, dynamicTunnelConfig string, tunnelCompression bool) *ttyShareClient {
 	return &ttyShareClient{
-		url:             url,
-		ttyWsConn:       nil,
-		detachKeys:      detachKeys,
-		wcChan:          make(chan os.Signal, 1),
-		ioFlagAtomic:    1,
-		tunnelAddresses: tunnelConfig,
+		url:               url,
+		ttyWsConn:         nil,
+		detachKeys:        detachKeys,
+		panKey:            panKey,
+		name:              name,
+		clipboard:         clipboard,
+		clipboardPush:     clipboardPush,
+		wcChan:            make(chan os.Signal, 1),
+		tunnelAddresses:   tunnelConfig,
+		reverseTunnel:     reverseTunnelConfig,
+		dynamicTunnel:     dynamicTunnelConfig,
+		tunnelCompression: tunnelCompression,
 	}
 }
 
+// Dials a WS connection of the session, negotiating the compression, if compress is set
+func dialWS(url string, compress bool) (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = compress
+	wsConn, _, err := dialer.Dial(url, nil)
+	return wsConn, err
+}
+
 func clearScreen() {
 	fmt.Fprintf(os.Stdout, "\033[H\033[2J")
 }
 
 type keyListener struct {
 	wrappedReader io.Reader
-	ioFlagAtomicP *uint32
+	viewport      *viewport
+	// If set, the clipboard sequences the local terminal writes to the input, answering the
+	// clipboard queries, are passed to it, instead of being sent as input
+	onClipboard     func(clip server.OSC52)
+	clipboardParser server.OSC52Parser
 }
 
 func (kl *keyListener) Read(data []byte) (n int, err error) {
@@ -66,32 +95,20 @@ func (kl *keyListener) Read(data []byte) (n int, err error) {
 		log.Debug("Escape code detected.")
 	}
 
-	// If we are not supposed to do any IO, then return 0 bytes read. This happens the local
-	// window is smaller than the remote one
-	if atomic.LoadUint32(kl.ioFlagAtomicP) == 0 {
-		return 0, err
+	if kl.onClipboard != nil {
+		input, clips := kl.clipboardParser.Parse(data[:n])
+		n = copy(data, input)
+		for _, clip := range clips {
+			kl.onClipboard(clip)
+		}
 	}
 
+	// The keys used to pan the viewport, when the local window is smaller than the remote one,
+	// are not sent to the remote side
+	n = copy(data, kl.viewport.FilterInput(data[:n]))
 	return
 }
 
-func (c *ttyShareClient) updateAndDecideStdoutMuted() {
-	log.Infof("This window: %dx%d. Remote window: %dx%d", c.winSizes.thisW, c.winSizes.thisH, c.winSizes.remoteW, c.winSizes.remoteH)
-
-	if c.winSizes.thisH < c.winSizes.remoteH || c.winSizes.thisW < c.winSizes.remoteW {
-		atomic.StoreUint32(&c.ioFlagAtomic, 0)
-		clearScreen()
-		messageFormat := "\n\rYour window is smaller than the remote window. Please resize or press <C-o C-c> to detach.\n\r\tRemote window: %dx%d \n\r\tYour window:   %dx%d \n\r"
-		fmt.Printf(messageFormat, c.winSizes.remoteW, c.winSizes.remoteH, c.winSizes.thisW, c.winSizes.thisH)
-	} else {
-		if atomic.LoadUint32(&c.ioFlagAtomic) == 0 { // clear the screen when changing back to "write"
-			// TODO: notify the remote side to "refresh" the content.
-			clearScreen()
-		}
-		atomic.StoreUint32(&c.ioFlagAtomic, 1)
-	}
-}
-
 func (c *ttyShareClient) updateThisWinSize() {
 	size, err := term.GetWinsize(os.Stdin.Fd())
 	if err == nil {
@@ -102,120 +119,118 @@ func (c *ttyShareClient) updateThisWinSize() {
 	}
 }
 
-func (c *ttyShareClient) Run() (err error) {
-	log.Debugf("Connecting as a client to %s ..", c.url)
-
-	resp, err := http.Get(c.url)
-
-	if err != nil {
-		return
+// Checks the session supports the tunnels asked for, before joining it
+func (c *ttyShareClient) requireFeatures(info *share.SessionInfo) error {
+	required := []share.Feature{}
+	for _, spec := range c.tunnelAddresses {
+		f, err := parseLocalForward(spec)
+		if err != nil {
+			return err
+		}
+		required = append(required, share.FeatureTunnels)
+		if f.remoteNetwork != "tcp" || f.listenNetwork == "udp" {
+			required = append(required, share.FeatureTunnelNetworks)
+		}
+	}
+	if c.dynamicTunnel != "" {
+		required = append(required, share.FeatureDynamicTunnels)
+	}
+	if *c.reverseTunnel != "" {
+		required = append(required, share.FeatureReverseTunnels)
 	}
 
-	// Get the path of the websockts route from the header
-	ttyWsPath := resp.Header.Get("TTYSHARE-TTY-WSPATH")
-	ttyWSProtocol := resp.Header.Get("TTYSHARE-VERSION")
+	for _, feature := range required {
+		if err := info.Require(feature); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	ttyTunnelPath := resp.Header.Get("TTYSHARE-TUNNEL-WSPATH")
+func (c *ttyShareClient) Run() (err error) {
+	log.Debugf("Connecting as a client to %s ..", c.url)
 
-	// Build the WS URL from the host part of the given http URL and the wsPath
-	httpURL, err := url.Parse(c.url)
+	info, err := share.Lookup(context.Background(), c.url)
 	if err != nil {
 		return
 	}
-	wsScheme := "ws"
-	if httpURL.Scheme == "https" {
-		wsScheme = "wss"
+	if err = c.requireFeatures(info); err != nil {
+		return
 	}
-	ttyWsURL := wsScheme + "://" + httpURL.Host + ttyWsPath
-	ttyTunnelURL := wsScheme + "://" + httpURL.Host + ttyTunnelPath
+	ttyWSProtocol := info.Protocol
+	ttyWsURL := info.TTYURL
+	ttyTunnelURL := info.TunnelURL
 
 	log.Debugf("Built the WS URL from the headers: %s", ttyWsURL)
 
-	c.ttyWsConn, _, err = websocket.DefaultDialer.Dial(ttyWsURL, nil)
+	c.ttyWsConn, err = dialWS(ttyWsURL, true)
 	if err != nil {
 		return
 	}
+	// The input is typed a few bytes at a time, which don't compress
+	c.ttyWsConn.EnableWriteCompression(false)
 	defer c.ttyWsConn.Close()
 
-	tunnelFunc := func() {
-		if *c.tunnelAddresses == "" {
-			// Don't build a tunnel
+	reverseTunnelFunc := func() {
+		if *c.reverseTunnel == "" {
 			return
 		}
 
-		if ver, err := strconv.Atoi(ttyWSProtocol); err != nil || ver < 2 {
-			log.Fatalf("Cannot create a tunnel. Server too old (protocol %d, required min. 2)", ver)
+		tunnelRemoteAddress, tunnelLocalAddress, err := parseReverseForward(*c.reverseTunnel)
+		if err != nil {
+			log.Errorf("%s", err.Error())
+			return
 		}
 
-		c.tunnelWsConn, _, err = websocket.DefaultDialer.Dial(ttyTunnelURL, nil)
+		wsConn, err := dialWS(ttyTunnelURL, c.tunnelCompression)
 		if err != nil {
-			log.Errorf("Cannot create a tunnel connection with the server. Server needs to allow that")
+			log.Errorf("Cannot create a reverse tunnel connection with the server. Server needs to allow that")
 			return
 		}
-		defer c.tunnelWsConn.Close()
+		defer wsConn.Close()
 
-		a := strings.Split(*c.tunnelAddresses, ":")
-		tunnelRemoteAddress := fmt.Sprintf("%s:%s", a[1], a[2])
-		tunnelLocalAddress := fmt.Sprintf(":%s", a[0])
-
-		initMsg := server.TunInitMsg{
+		data, err := json.Marshal(server.TunInitMsg{
 			Address: tunnelRemoteAddress,
-		}
-
-		data, err := json.Marshal(initMsg)
+			Reverse: true,
+			Token:   c.participantToken,
+		})
 		if err != nil {
 			log.Errorf("Could not marshal the tunnel init message: %s", err.Error())
 			return
 		}
 
-		err = c.tunnelWsConn.WriteMessage(websocket.TextMessage, data)
-
+		err = wsConn.WriteMessage(websocket.TextMessage, data)
 		if err != nil {
-			log.Errorf("Could not initiate the tunnel: %s", err.Error())
+			log.Errorf("Could not initiate the reverse tunnel: %s", err.Error())
 			return
 		}
 
-		wsWRC := server.WSConnReadWriteCloser{
-			WsConn: c.tunnelWsConn,
-		}
-
-		localListener, err := net.Listen("tcp", tunnelLocalAddress)
-		if err != nil {
-			log.Errorf("Could not listen locally for the tunnel: %s", err.Error())
-
-		}
-
-		c.tunnelMuxSession, err = yamux.Server(&wsWRC, nil)
+		// The server opens the streams, for each connection it accepts on its side
+		reverseMuxSession, err := yamux.Server(&server.WSConnReadWriteCloser{
+			WsConn:               wsConn,
+			CompressionThreshold: server.DefaultCompressionThreshold,
+		}, nil)
 		if err != nil {
 			log.Errorf("Could not create mux server: %s", err.Error())
+			return
 		}
+		c.addTunnelCloser(reverseMuxSession)
 
 		for {
-			localTunconn, err := localListener.Accept()
-
+			muxStream, err := reverseMuxSession.Accept()
 			if err != nil {
-				log.Warn("Cannot accept local tunnel connections: ", err.Error())
+				log.Warn("Reverse tunnel closed: ", err.Error())
 				return
 			}
 
-			muxClient, err := c.tunnelMuxSession.Open()
+			localConn, err := net.Dial("tcp", tunnelLocalAddress)
 			if err != nil {
-				log.Warn("Cannot create a muxer to the remote, over ws: ", err.Error())
-				return
+				log.Warnf("Cannot connect the reverse tunnel to %s: %s", tunnelLocalAddress, err.Error())
+				muxStream.Close()
+				continue
 			}
 
-			go func() {
-				io.Copy(muxClient, localTunconn)
-				defer localTunconn.Close()
-				defer muxClient.Close()
-			}()
-
-			go func() {
-				io.Copy(localTunconn, muxClient)
-				defer localTunconn.Close()
-				defer muxClient.Close()
-			}()
-
+			go pipeConns(muxStream, localConn)
 		}
 	}
 
@@ -225,12 +240,38 @@ func (c *ttyShareClient) Run() (err error) {
 		return
 	}
 
+	panKeyBytes, err := term.ToBytes(c.panKey)
+	if err != nil || len(panKeyBytes) != 1 {
+		log.Errorf("Invalid pan key: %s", c.panKey)
+		return fmt.Errorf("invalid pan key: %s", c.panKey)
+	}
+	c.viewport = newViewport(os.Stdout, panKeyBytes[0], c.panKey)
+
 	state, err := term.MakeRaw(os.Stdin.Fd())
 	defer term.RestoreTerminal(os.Stdin.Fd(), state)
 	clearScreen()
 
 	protoWS := server.NewTTYProtocolWSLocked(c.ttyWsConn)
 
+	// Let the server know the size of our window, as it might be used to decide the size of the
+	// shared terminal
+	c.updateThisWinSize()
+	c.viewport.SetLocalSize(int(c.winSizes.thisW), int(c.winSizes.thisH))
+	protoWS.SetWinSize(int(c.winSizes.thisW), int(c.winSizes.thisH))
+	protoWS.SendHello(server.MsgTTYHello{Name: c.name, Clipboard: c.clipboard, ClipboardPush: c.clipboardPush})
+
+	// The tunnels are opened on behalf of this participant, so they need the token the server
+	// sends in reply to the Hello message. The older servers don't send it
+	startTunnels := func() {
+		c.tunnelsOnce.Do(func() {
+			go c.runForwardTunnels(ttyTunnelURL, ttyWSProtocol)
+			go reverseTunnelFunc()
+		})
+	}
+	if ttyWSProtocol < 6 {
+		startTunnels()
+	}
+
 	monitorWinChanges := func() {
 		// start monitoring the size of the terminal
 		signal.Notify(c.wcChan, syscall.SIGWINCH)
@@ -239,7 +280,7 @@ func (c *ttyShareClient) Run() (err error) {
 			select {
 			case <-c.wcChan:
 				c.updateThisWinSize()
-				c.updateAndDecideStdoutMuted()
+				c.viewport.SetLocalSize(int(c.winSizes.thisW), int(c.winSizes.thisH))
 				protoWS.SetWinSize(int(c.winSizes.thisW), int(c.winSizes.thisH))
 			}
 		}
@@ -249,23 +290,31 @@ func (c *ttyShareClient) Run() (err error) {
 
 		var err error
 		for {
-			err = protoWS.ReadAndHandle(
-				// onWrite
-				func(data []byte) {
-					if atomic.LoadUint32(&c.ioFlagAtomic) != 0 {
-						os.Stdout.Write(data)
-					}
+			err = protoWS.ReadAndHandle(server.TTYProtocolHandlers{
+				OnWrite: func(data []byte) {
+					c.viewport.Write(data)
+				},
+				OnWinSize: func(cols, rows int) {
+					log.Infof("This window: %dx%d. Remote window: %dx%d", c.winSizes.thisW, c.winSizes.thisH, cols, rows)
+					c.viewport.SetRemoteSize(cols, rows)
 				},
-				// onWindowSize
-				func(cols, rows int) {
-					c.winSizesMutex.Lock()
-					c.winSizes.remoteW = uint16(cols)
-					c.winSizes.remoteH = uint16(rows)
-					c.winSizesMutex.Unlock()
-					c.updateThisWinSize()
-					c.updateAndDecideStdoutMuted()
+				OnWelcome: func(id, token string) {
+					log.Debugf("Joined the session as the participant %s", id)
+					c.participantToken = token
+					startTunnels()
+				},
+				OnNotice: func(text string) {
+					log.Infof("Notice from the server: %s", text)
+					c.showNotice(text)
+				},
+				OnClipboard: func(clip server.OSC52) {
+					// A query goes to the local terminal too, which answers on the input (see
+					// keyListener)
+					if (clip.Query && c.clipboardPush) || (!clip.Query && c.clipboard) {
+						c.viewport.WriteRaw(clip.Sequence())
+					}
 				},
-			)
+			})
 
 			if err != nil {
 				log.Errorf("Error parsing remote message: %s", err.Error())
@@ -280,7 +329,12 @@ func (c *ttyShareClient) Run() (err error) {
 	writeLoop := func() {
 		kl := &keyListener{
 			wrappedReader: term.NewEscapeProxy(os.Stdin, detachBytes),
-			ioFlagAtomicP: &c.ioFlagAtomic,
+			viewport:      c.viewport,
+		}
+		if c.clipboardPush {
+			kl.onClipboard = func(clip server.OSC52) {
+				protoWS.SendClipboard(clip)
+			}
 		}
 		_, err := io.Copy(protoWS, kl)
 
@@ -293,19 +347,35 @@ func (c *ttyShareClient) Run() (err error) {
 
 	go monitorWinChanges()
 	go writeLoop()
-	go tunnelFunc()
 	readLoop()
+	c.Stop()
 
 	clearScreen()
 	return
 }
 
+// Shows the notice on the last line of the local terminal, until the remote output draws over it
+func (c *ttyShareClient) showNotice(text string) {
+	c.winSizesMutex.Lock()
+	rows := c.winSizes.thisH
+	c.winSizesMutex.Unlock()
+
+	c.viewport.WriteRaw([]byte(fmt.Sprintf("\0337\033[%d;1H\033[0;7m tty-share: %s \033[0m\033[K\0338", rows, text)))
+}
+
+func (c *ttyShareClient) addTunnelCloser(closer io.Closer) {
+	c.tunnelClosersMutex.Lock()
+	defer c.tunnelClosersMutex.Unlock()
+	c.tunnelClosers = append(c.tunnelClosers, closer)
+}
+
 func (c *ttyShareClient) Stop() {
-	// if we had a tunnel, close it
-	if c.tunnelMuxSession != nil {
-		c.tunnelMuxSession.Close()
-		c.tunnelWsConn.Close()
+	// if we had tunnels, close them
+	c.tunnelClosersMutex.Lock()
+	for _, closer := range c.tunnelClosers {
+		closer.Close()
 	}
+	c.tunnelClosersMutex.Unlock()
 	c.ttyWsConn.Close()
 	signal.Stop(c.wcChan)
 }
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/elisescu/tty-share/server"
+	log "github.com/sirupsen/logrus"
+)
+
+// The environment variable telling the shared application, and tty-share ctl, where the control
+// socket of the session is
+const controlSocketEnv = "TTY_SHARE_CONTROL_SOCKET"
+
+// The directory of the control sockets, when not given with --control-socket. Only the user can
+// access it (see checkControlSocketDir)
+func controlSocketDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("tty-share-%d", os.Getuid()))
+}
+
+// Creates the directory of the control sockets, if it doesn't exist, and returns the path of the
+// socket of this tty-share in it
+func defaultControlSocketPath() (string, error) {
+	dir := controlSocketDir()
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	if err := checkControlSocketDir(dir); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf("%d.sock", os.Getpid())), nil
+}
+
+// Makes sure the directory belongs to the user, and that nobody else can access it. Anyone can
+// create it first, in the shared temporary directory, to take over the control sockets
+func checkControlSocketDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is not a directory of the user", dir)
+	}
+	if info.Mode().Perm() != 0700 {
+		return fmt.Errorf("%s can be accessed by other users (%s)", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// Listens on the control socket, which only the user can connect to. The socket file is removed
+// when the listener is closed
+func listenControlSocket(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	// Replace the socket left behind by a tty-share which didn't exit cleanly, but nothing else
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists, and it's not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is used by another tty-share", path)
+		}
+		os.Remove(path)
+	}
+
+	// The socket file is created accessible only by the user, so nobody else can connect to it
+	// before it's restricted. The umask is the same for the whole process, but nothing else creates
+	// files at this point
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	return listener, err
+}
+
+// ControlService is the API of the control socket: JSON-RPC 1.0, as in net/rpc/jsonrpc. Its
+// methods are called as Control.<Method>, e.g.:
+//
+//	{"method": "Control.Kick", "params": [{"ID": "p1"}], "id": 1}
+type ControlService struct {
+	server *server.TTYServer
+	pty    io.Writer
+	urls   []string
+	// When the session started
+	startedAt time.Time
+	// Ends the session
+	stop func()
+}
+
+type ControlEmpty struct{}
+
+type ControlInfo struct {
+	// The local URL, then the public one, if any
+	URLs         []string
+	StartedAt    time.Time
+	ReadOnly     bool
+	Paused       bool
+	Participants []server.ParticipantInfo
+	// The traffic of the session so far, and how much it was compressed
+	Metrics server.Metrics
+}
+
+type ControlIDArgs struct {
+	ID string
+}
+
+type ControlRoleArgs struct {
+	ID   string
+	Role server.ParticipantRole
+}
+
+// A size of 0x0 goes back to the window size policy
+type ControlSizeArgs struct {
+	Cols int
+	Rows int
+}
+
+type ControlInputArgs struct {
+	Data string
+}
+
+type ControlFlagArgs struct {
+	On bool
+}
+
+// Info returns the URLs of the session, its state, and its participants
+func (c *ControlService) Info(args *ControlEmpty, reply *ControlInfo) error {
+	*reply = ControlInfo{
+		URLs:         c.urls,
+		StartedAt:    c.startedAt,
+		ReadOnly:     c.server.ReadOnly(),
+		Paused:       c.server.Paused(),
+		Participants: c.server.Participants(),
+		Metrics:      c.server.Metrics(),
+	}
+	return nil
+}
+
+func (c *ControlService) SetRole(args *ControlRoleArgs, reply *ControlEmpty) error {
+	return c.server.SetRole(args.ID, args.Role)
+}
+
+func (c *ControlService) Kick(args *ControlIDArgs, reply *ControlEmpty) error {
+	return c.server.Kick(args.ID)
+}
+
+func (c *ControlService) Resize(args *ControlSizeArgs, reply *ControlEmpty) error {
+	if args.Cols < 0 || args.Rows < 0 || (args.Cols == 0) != (args.Rows == 0) {
+		return fmt.Errorf("invalid window size %dx%d", args.Cols, args.Rows)
+	}
+	c.server.SetWinSize(args.Cols, args.Rows)
+	return nil
+}
+
+// Input types the data in the shared terminal, as the sharer
+func (c *ControlService) Input(args *ControlInputArgs, reply *ControlEmpty) error {
+	c.server.SharerInput()
+	_, err := c.pty.Write([]byte(args.Data))
+	return err
+}
+
+func (c *ControlService) SetPaused(args *ControlFlagArgs, reply *ControlEmpty) error {
+	c.server.SetPaused(args.On)
+	return nil
+}
+
+func (c *ControlService) SetReadOnly(args *ControlFlagArgs, reply *ControlEmpty) error {
+	c.server.SetReadOnly(args.On)
+	return nil
+}
+
+func (c *ControlService) Stop(args *ControlEmpty, reply *ControlEmpty) error {
+	c.stop()
+	return nil
+}
+
+// Serves the control socket, until the listener is closed
+func serveControlSocket(listener net.Listener, service *ControlService) {
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName("Control", service); err != nil {
+		log.Errorf("Cannot serve the control socket: %s", err.Error())
+		return
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Debugf("Stopped serving the control socket: %s", err.Error())
+			return
+		}
+		go rpcServer.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
+// How long tty-share ctl waits for the answer
+const controlCallTimeout = 10 * time.Second
+
+// Calls the method of the control socket at the path, waiting for the answer at most the timeout
+func callControl(path, method string, params, reply interface{}, timeout time.Duration) error {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %s", path, err.Error())
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	client := jsonrpc.NewClient(conn)
+	defer client.Close()
+	return client.Call("Control."+method, params, reply)
+}
+
+// Finds the control socket to connect to: the one of the session tty-share ctl runs in, or the
+// only one of the user
+func findControlSocket() (string, error) {
+	if path := os.Getenv(controlSocketEnv); path != "" {
+		return path, nil
+	}
+
+	dir := controlSocketDir()
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		return "", errors.New("no tty-share is running")
+	}
+	// The sockets of another user could be impersonating the ones of the user
+	if err := checkControlSocketDir(dir); err != nil {
+		return "", err
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.sock"))
+	switch len(paths) {
+	case 0:
+		return "", errors.New("no tty-share is running")
+	case 1:
+		return paths[0], nil
+	}
+	return "", fmt.Errorf("more than one tty-share is running, choose one with --socket: %s", strings.Join(paths, ", "))
+}
+
+func printParticipants(participants []server.ParticipantInfo) {
+	for _, p := range participants {
+		name := p.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\tjoined %s ago\n", p.ID, name, p.Role, p.RemoteAddr,
+			time.Since(p.JoinedAt).Round(time.Second))
+	}
+}
+
+// Prints how much was sent, and how much it was compressed, if anything was sent
+func printTraffic(name string, traffic server.TrafficMetrics) {
+	if traffic.WireBytes == 0 {
+		return
+	}
+	fmt.Printf("%s: %s sent, %s on the wire (compressed %.1fx)\n", name, formatBytes(traffic.MessageBytes),
+		formatBytes(traffic.WireBytes), traffic.CompressionRatio())
+}
+
+// Runs the ctl command, returning the exit code
+func runCtlCommand(args []string) int {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := flags.String("socket", "", "The control socket of the session. By default, the one in $"+controlSocketEnv+", or the only one of the user")
+	jsonOutput := flags.Bool("json", false, "Print the answers as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `
+Usage:
+  tty-share ctl [--socket <path>] [--json] <command>
+
+Commands:
+  info                          the URLs of the session, its state, its traffic, and its participants
+  participants                  the participants: their ID, name, role, and address
+  role <id> <viewer|writer>     change what a participant can do
+  kick <id>                     remove a participant from the session
+  resize <cols>x<rows>|auto     fix the size of the shared terminal, or go back to --winsize-policy
+  send <text>                   type the text in the shared terminal. Escapes like \n or \x03 are interpreted
+  pause, resume                 pause the sharing, or resume it
+  readonly <on|off>             stop the participants from typing, or let the writers type again
+  stop                          end the session
+
+Flags:
+`)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	args = flags.Args()
+	if len(args) < 1 {
+		flags.Usage()
+		return 2
+	}
+	usageError := func() int {
+		fmt.Fprintf(os.Stderr, "Invalid arguments for %s\n", args[0])
+		flags.Usage()
+		return 2
+	}
+
+	var method string
+	var params interface{} = &ControlEmpty{}
+	switch command := args[0]; {
+	case (command == "info" || command == "participants") && len(args) == 1:
+		method = "Info"
+	case command == "role" && len(args) == 3:
+		role, err := server.ParseParticipantRole(args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 2
+		}
+		method, params = "SetRole", &ControlRoleArgs{ID: args[1], Role: role}
+	case command == "kick" && len(args) == 2:
+		method, params = "Kick", &ControlIDArgs{ID: args[1]}
+	case command == "resize" && len(args) == 2:
+		size := &ControlSizeArgs{}
+		if args[1] != "auto" {
+			cols, rows, err := server.ParseWinSize(args[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				return 2
+			}
+			size.Cols, size.Rows = cols, rows
+		}
+		method, params = "Resize", size
+	case command == "send" && len(args) >= 2:
+		text := strings.Join(args[1:], " ")
+		data, err := strconv.Unquote(`"` + strings.ReplaceAll(text, `"`, `\"`) + `"`)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid escape in %q\n", text)
+			return 2
+		}
+		method, params = "Input", &ControlInputArgs{Data: data}
+	case (command == "pause" || command == "resume") && len(args) == 1:
+		method, params = "SetPaused", &ControlFlagArgs{On: command == "pause"}
+	case command == "readonly" && len(args) == 2 && (args[1] == "on" || args[1] == "off"):
+		method, params = "SetReadOnly", &ControlFlagArgs{On: args[1] == "on"}
+	case command == "stop" && len(args) == 1:
+		method = "Stop"
+	default:
+		return usageError()
+	}
+
+	path := *socket
+	if path == "" {
+		var err error
+		if path, err = findControlSocket(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+	}
+	var info ControlInfo
+	var reply interface{} = &ControlEmpty{}
+	if method == "Info" {
+		reply = &info
+	}
+	err := callControl(path, method, params, reply, controlCallTimeout)
+	// The session might end before the answer to stop gets out
+	if err != nil && !(method == "Stop" && (err == rpc.ErrShutdown || err == io.ErrUnexpectedEOF)) {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	if method != "Info" {
+		return 0
+	}
+
+	if *jsonOutput {
+		var out interface{} = info
+		if args[0] == "participants" {
+			out = info.Participants
+		}
+		data, _ := json.MarshalIndent(out, "", "  ")
+		fmt.Printf("%s\n", data)
+		return 0
+	}
+	if args[0] == "info" {
+		for _, url := range info.URLs {
+			fmt.Printf("url: %s\n", url)
+		}
+		fmt.Printf("read only: %s\npaused: %s\n", onOff(info.ReadOnly), onOff(info.Paused))
+		printTraffic("output", info.Metrics.TTY)
+		printTraffic("tunnels", info.Metrics.Tunnels)
+		fmt.Printf("participants: %d\n", len(info.Participants))
+	}
+	printParticipants(info.Participants)
+	return 0
+}
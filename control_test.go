@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenControlSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// Never replace a file which is not a socket
+	file := filepath.Join(dir, "file.sock")
+	os.WriteFile(file, []byte("data"), 0600)
+	if _, err := listenControlSocket(file); err == nil {
+		t.Errorf("expected an error for a regular file")
+	}
+
+	path := filepath.Join(dir, "ctl", "test.sock")
+	listener, err := listenControlSocket(path)
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err.Error())
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the socket to be accessible only by the user: %v", info)
+	}
+
+	// The socket of a running tty-share is not taken over
+	if _, err := listenControlSocket(path); err == nil {
+		t.Errorf("expected an error for a socket in use")
+	}
+
+	// But the one left behind is
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = listenControlSocket(path)
+	if err != nil {
+		t.Fatalf("cannot listen on a stale socket: %s", err.Error())
+	}
+	listener.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed on close")
+	}
+}
+
+func TestCheckControlSocketDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ctl")
+	os.Mkdir(dir, 0700)
+	if err := checkControlSocketDir(dir); err != nil {
+		t.Errorf("expected the private directory to be accepted: %s", err.Error())
+	}
+
+	os.Chmod(dir, 0777)
+	if err := checkControlSocketDir(dir); err == nil {
+		t.Errorf("expected an error for a directory other users can access")
+	}
+
+	link := filepath.Join(filepath.Dir(dir), "link")
+	os.Chmod(dir, 0700)
+	os.Symlink(dir, link)
+	if err := checkControlSocketDir(link); err == nil {
+		t.Errorf("expected an error for a link")
+	}
+}
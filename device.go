@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The line settings of a serial port: the data bits, the parity and the stop bits, e.g.: 8N1
+type serialMode struct {
+	dataBits int
+	// N (none), E (even) or O (odd)
+	parity   byte
+	stopBits int
+}
+
+func parseSerialMode(mode string) (serialMode, error) {
+	invalid := fmt.Errorf("invalid serial mode %q, expected the data bits (5-8), the parity (N, E or O) and the stop bits (1 or 2), e.g.: 8N1", mode)
+	if len(mode) != 3 {
+		return serialMode{}, invalid
+	}
+	m := serialMode{
+		dataBits: int(mode[0] - '0'),
+		parity:   mode[1],
+		stopBits: int(mode[2] - '0'),
+	}
+	if m.parity >= 'a' && m.parity <= 'z' {
+		m.parity -= 'a' - 'A'
+	}
+	if m.dataBits < 5 || m.dataBits > 8 || (m.parity != 'N' && m.parity != 'E' && m.parity != 'O') ||
+		(m.stopBits != 1 && m.stopBits != 2) {
+		return serialMode{}, invalid
+	}
+	return m, nil
+}
+
+// A terminal device shared instead of a command: a serial port (e.g.: /dev/ttyUSB0), or an
+// existing pty (e.g.: the serial console of a virtual machine)
+type device struct {
+	file    *os.File
+	rawConn syscall.RawConn
+	// Restores the settings the device had before it was opened
+	restore func() error
+	// Closed when the device is closed
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Opens the device, in raw mode, so what's typed goes to it as it is. The baud rate and the mode
+// are set only if given (not 0, and not nil)
+func openDevice(path string, baud int, mode *serialMode) (*device, error) {
+	// Without O_NONBLOCK, opening a serial port might wait for its carrier
+	file, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Not with file.Fd(), which would make the reads blocking, so Close couldn't stop them
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	var restore func() error
+	controlErr := rawConn.Control(func(fd uintptr) {
+		restore, err = configureDevice(int(fd), baud, mode)
+	})
+	if controlErr != nil {
+		err = controlErr
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot configure %s: %s", path, err.Error())
+	}
+	return &device{file: file, rawConn: rawConn, restore: restore, done: make(chan struct{})}, nil
+}
+
+func (dev *device) Read(data []byte) (int, error) {
+	return dev.file.Read(data)
+}
+
+func (dev *device) Write(data []byte) (int, error) {
+	return dev.file.Write(data)
+}
+
+// Only the ptys have a size. The serial ports keep it, but nothing on the other side gets it
+func (dev *device) SetWinSize(rows, cols int) {
+	dev.rawConn.Control(func(fd uintptr) {
+		unix.IoctlSetWinsize(int(fd), unix.TIOCSWINSZ, &unix.Winsize{Row: uint16(rows), Col: uint16(cols)})
+	})
+}
+
+// Restores the settings of the device, and closes it
+func (dev *device) Close() (err error) {
+	dev.closeOnce.Do(func() {
+		dev.restore()
+		err = dev.file.Close()
+		close(dev.done)
+	})
+	return
+}
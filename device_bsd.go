@@ -0,0 +1,29 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioctlGetTermios = unix.TIOCGETA
+	ioctlSetTermios = unix.TIOCSETA
+)
+
+// The BSDs keep the speed as a number, in its own fields of the termios
+func setBaudRate(state *unix.Termios, baud int) error {
+	if baud <= 0 {
+		return fmt.Errorf("unsupported baud rate: %d", baud)
+	}
+	setSpeed(&state.Ispeed, baud)
+	setSpeed(&state.Ospeed, baud)
+	return nil
+}
+
+// The type of the speed fields differs between the systems
+func setSpeed[T ~int32 | ~uint32 | ~uint64](speed *T, baud int) {
+	*speed = T(baud)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+)
+
+var baudRates = map[int]uint32{
+	300:     unix.B300,
+	600:     unix.B600,
+	1200:    unix.B1200,
+	2400:    unix.B2400,
+	4800:    unix.B4800,
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	500000:  unix.B500000,
+	576000:  unix.B576000,
+	921600:  unix.B921600,
+	1000000: unix.B1000000,
+	1152000: unix.B1152000,
+	1500000: unix.B1500000,
+	2000000: unix.B2000000,
+	2500000: unix.B2500000,
+	3000000: unix.B3000000,
+	3500000: unix.B3500000,
+	4000000: unix.B4000000,
+}
+
+// Linux keeps the speed in the CBAUD bits of the control flags, for the TCSETS ioctl
+func setBaudRate(state *unix.Termios, baud int) error {
+	rate, ok := baudRates[baud]
+	if !ok {
+		return fmt.Errorf("unsupported baud rate: %d", baud)
+	}
+	state.Cflag &^= unix.CBAUD
+	state.Cflag |= rate
+	state.Ispeed = rate
+	state.Ospeed = rate
+	return nil
+}
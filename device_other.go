@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import "errors"
+
+func configureDevice(fd int, baud int, mode *serialMode) (func() error, error) {
+	return nil, errors.New("sharing a device is not supported on this system")
+}
@@ -0,0 +1,59 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// Puts the device in raw mode, sets its baud rate and its mode, if given, and returns the function
+// restoring its previous settings
+func configureDevice(fd int, baud int, mode *serialMode) (func() error, error) {
+	initState, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+	state := *initState
+
+	// As cfmakeraw(3), without changing the character size and the parity, unless asked to
+	state.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	state.Oflag &^= unix.OPOST
+	state.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	// Ignore the modem control lines, and enable the receiver
+	state.Cflag |= unix.CLOCAL | unix.CREAD
+	state.Cc[unix.VMIN] = 1
+	state.Cc[unix.VTIME] = 0
+
+	if baud != 0 {
+		if err := setBaudRate(&state, baud); err != nil {
+			return nil, err
+		}
+	}
+	if mode != nil {
+		state.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB
+		switch mode.dataBits {
+		case 5:
+			state.Cflag |= unix.CS5
+		case 6:
+			state.Cflag |= unix.CS6
+		case 7:
+			state.Cflag |= unix.CS7
+		default:
+			state.Cflag |= unix.CS8
+		}
+		switch mode.parity {
+		case 'E':
+			state.Cflag |= unix.PARENB
+		case 'O':
+			state.Cflag |= unix.PARENB | unix.PARODD
+		}
+		if mode.stopBits == 2 {
+			state.Cflag |= unix.CSTOPB
+		}
+	}
+
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &state); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return unix.IoctlSetTermios(fd, ioctlSetTermios, initState)
+	}, nil
+}
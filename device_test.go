@@ -0,0 +1,96 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	ptyDevice "github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseSerialMode(t *testing.T) {
+	mode, err := parseSerialMode("7e2")
+	if err != nil || mode != (serialMode{dataBits: 7, parity: 'E', stopBits: 2}) {
+		t.Errorf("unexpected mode: %v %v", mode, err)
+	}
+	for _, invalid := range []string{"", "8N", "9N1", "8X1", "8N3", "8N1 "} {
+		if _, err := parseSerialMode(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+// Reads what the reader gets, in the next second
+func readFor(t *testing.T, r io.Reader, size int) string {
+	data := make(chan string)
+	go func() {
+		buf := make([]byte, size)
+		n, _ := io.ReadFull(r, buf)
+		data <- string(buf[:n])
+	}()
+	select {
+	case d := <-data:
+		return d
+	case <-time.After(time.Second):
+		t.Fatalf("timed out reading")
+		return ""
+	}
+}
+
+func TestDevice(t *testing.T) {
+	master, slave, err := ptyDevice.Open()
+	if err != nil {
+		t.Skipf("cannot open a pty pair: %s", err.Error())
+	}
+	defer master.Close()
+	defer slave.Close()
+
+	dev, err := openDevice(slave.Name(), 9600, &serialMode{dataBits: 7, parity: 'E', stopBits: 1})
+	if err != nil {
+		t.Fatalf("cannot open the device: %s", err.Error())
+	}
+
+	state, err := unix.IoctlGetTermios(int(slave.Fd()), ioctlGetTermios)
+	if err != nil {
+		t.Fatalf("cannot get the termios: %s", err.Error())
+	}
+	// A pty keeps its hardware settings (the speed, the parity, etc), so only the raw mode is seen
+	if state.Lflag&(unix.ECHO|unix.ICANON) != 0 || state.Oflag&unix.OPOST != 0 {
+		t.Errorf("the device is not in raw mode")
+	}
+
+	// Both ways, as they are: no echo, and no line endings translation
+	master.Write([]byte("from the board\n"))
+	if d := readFor(t, dev, 15); d != "from the board\n" {
+		t.Errorf("unexpected data from the device: %q", d)
+	}
+	dev.Write([]byte("to the board\n"))
+	if d := readFor(t, master, 13); d != "to the board\n" {
+		t.Errorf("unexpected data to the device: %q", d)
+	}
+
+	// Closing it stops the reads, and restores its settings
+	readDone := make(chan error)
+	go func() {
+		_, err := dev.Read(make([]byte, 10))
+		readDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	dev.Close()
+	select {
+	case err := <-readDone:
+		if err == nil {
+			t.Errorf("expected the read to fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the read was not stopped by Close")
+	}
+	state, err = unix.IoctlGetTermios(int(slave.Fd()), ioctlGetTermios)
+	if err != nil || state.Lflag&unix.ECHO == 0 {
+		t.Errorf("the settings of the device were not restored")
+	}
+	<-dev.done
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elisescu/tty-share/server"
+	"github.com/elisescu/tty-share/share"
+	"github.com/gorilla/websocket"
+	"github.com/moby/term"
+	log "github.com/sirupsen/logrus"
+)
+
+// Parses a size in bytes, optionally followed by one of the K, M or G units (powers of 1024)
+func parseByteSize(size string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.TrimSuffix(strings.ToUpper(size), "B")
+	if n := len(number); n > 0 {
+		switch number[n-1] {
+		case 'K':
+			multiplier = 1024
+		case 'M':
+			multiplier = 1024 * 1024
+		case 'G':
+			multiplier = 1024 * 1024 * 1024
+		}
+		if multiplier > 1 {
+			number = number[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes, optionally followed by K, M or G", size)
+	}
+	return value * multiplier, nil
+}
+
+// Checks the upload directory is a directory, and that the offered files are files, with different
+// names, as they are downloaded by name
+func checkFileSharing(uploadDir string, offeredFiles []string) error {
+	if uploadDir != "" {
+		if stat, err := os.Stat(uploadDir); err != nil || !stat.IsDir() {
+			return fmt.Errorf("the upload directory %s is not a directory", uploadDir)
+		}
+	}
+
+	names := map[string]bool{}
+	for _, path := range offeredFiles {
+		if stat, err := os.Stat(path); err != nil || !stat.Mode().IsRegular() {
+			return fmt.Errorf("the offered file %s is not a regular file", path)
+		}
+		name, err := server.SanitizeFileName(filepath.Base(path))
+		if err != nil {
+			return fmt.Errorf("cannot offer %s: %s", path, err.Error())
+		}
+		if names[name] {
+			return fmt.Errorf("more than one offered file is named %s", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+// A participant of a session, joined only to transfer files. The files are transferred on behalf
+// of the participant, so it stays in the session until the transfers are done.
+type fileTransferClient struct {
+	filesWsURL string
+	token      string
+	ttyWsConn  *websocket.Conn
+	// Show the progress of the transfers
+	progress bool
+}
+
+// Joins the session, to transfer files: to upload them, or to download them, as the feature tells
+func joinForFileTransfer(sessionURL, name string, feature share.Feature) (*fileTransferClient, error) {
+	info, err := share.Lookup(context.Background(), sessionURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := info.Require(feature); err != nil {
+		return nil, err
+	}
+
+	ttyWsConn, _, err := websocket.DefaultDialer.Dial(info.TTYURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	protoWS := server.NewTTYProtocolWSLocked(ttyWsConn)
+	if err := protoWS.SendHello(server.MsgTTYHello{Name: name}); err != nil {
+		ttyWsConn.Close()
+		return nil, err
+	}
+
+	// Keep reading the session output, even after the Welcome message, so the server doesn't wait
+	// on this participant
+	welcome := make(chan string, 1)
+	go func() {
+		for {
+			err := protoWS.ReadAndHandle(server.TTYProtocolHandlers{
+				OnWelcome: func(id, token string) {
+					log.Debugf("Joined the session as the participant %s", id)
+					welcome <- token
+				},
+			})
+			if err != nil {
+				close(welcome)
+				return
+			}
+		}
+	}()
+
+	select {
+	case token, ok := <-welcome:
+		if ok {
+			return &fileTransferClient{filesWsURL: info.FilesURL, token: token, ttyWsConn: ttyWsConn}, nil
+		}
+	case <-time.After(10 * time.Second):
+	}
+	ttyWsConn.Close()
+	return nil, errors.New("the session didn't welcome this participant")
+}
+
+func (c *fileTransferClient) Close() {
+	c.ttyWsConn.Close()
+}
+
+// Opens a file transfer connection, and sends the request on it
+func (c *fileTransferClient) request(req server.FileRequestMsg) (*websocket.Conn, error) {
+	wsConn, _, err := websocket.DefaultDialer.Dial(c.filesWsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Token = c.token
+	if err := wsConn.WriteJSON(req); err != nil {
+		wsConn.Close()
+		return nil, err
+	}
+	return wsConn, nil
+}
+
+// Reads the next FileMsg, returning the error it carries, if any
+func readFileMsg(wsConn *websocket.Conn) (server.FileMsg, error) {
+	var msg server.FileMsg
+	for {
+		msgType, data, err := wsConn.ReadMessage()
+		if err != nil {
+			return msg, err
+		}
+		if msgType != websocket.TextMessage {
+			continue
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return msg, err
+		}
+		if msg.Error != "" {
+			return msg, &server.FileError{Code: msg.Code, Message: msg.Error}
+		}
+		return msg, nil
+	}
+}
+
+// Shows how much of a file was transferred, on the same line
+type progressWriter struct {
+	name  string
+	total int64
+	done  int64
+	shown time.Time
+	show  bool
+}
+
+func (pw *progressWriter) Write(data []byte) (int, error) {
+	pw.done += int64(len(data))
+	if pw.show && (time.Since(pw.shown) > 100*time.Millisecond || pw.done == pw.total) {
+		percent := int64(100)
+		if pw.total > 0 {
+			percent = pw.done * 100 / pw.total
+		}
+		fmt.Fprintf(os.Stderr, "\r%s: %3d%% (%s of %s)", pw.name, percent, formatBytes(pw.done), formatBytes(pw.total))
+		pw.shown = time.Now()
+	}
+	return len(data), nil
+}
+
+func (pw *progressWriter) finish() {
+	if pw.show && !pw.shown.IsZero() {
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+}
+
+// Uploads the file to the upload directory of the sharer
+func (c *fileTransferClient) put(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	name := filepath.Base(path)
+	wsConn, err := c.request(server.FileRequestMsg{Op: server.FileOpPut, Name: name, Size: stat.Size()})
+	if err != nil {
+		return err
+	}
+	defer wsConn.Close()
+
+	// Wait for the server to accept the file, which might need the sharer to approve it
+	if _, err := readFileMsg(wsConn); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	progress := &progressWriter{name: name, total: stat.Size(), show: c.progress}
+	defer progress.finish()
+	buff := make([]byte, server.FileChunkSize)
+	for {
+		n, err := file.Read(buff)
+		if n > 0 {
+			hash.Write(buff[:n])
+			progress.Write(buff[:n])
+			if err := wsConn.WriteMessage(websocket.BinaryMessage, buff[:n]); err != nil {
+				// The server might have stopped the transfer, and told why
+				if _, msgErr := readFileMsg(wsConn); msgErr != nil {
+					return msgErr
+				}
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if err := wsConn.WriteJSON(server.FileMsg{SHA256: sum}); err != nil {
+		return err
+	}
+	saved, err := readFileMsg(wsConn)
+	if err != nil {
+		return err
+	}
+	if saved.SHA256 != sum {
+		return errors.New("the checksum of the uploaded file doesn't match")
+	}
+	return nil
+}
+
+// Downloads one of the files the sharer offers, into the directory
+func (c *fileTransferClient) get(name, dir string) error {
+	name, err := server.SanitizeFileName(name)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
+	if _, err := os.Lstat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	wsConn, err := c.request(server.FileRequestMsg{Op: server.FileOpGet, Name: name})
+	if err != nil {
+		return err
+	}
+	defer wsConn.Close()
+
+	header, err := readFileMsg(wsConn)
+	if err != nil {
+		return err
+	}
+
+	// Keep the file under a temporary name, until it's verified
+	tmpFile, err := os.CreateTemp(dir, ".tty-share-download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	hash := sha256.New()
+	progress := &progressWriter{name: name, total: header.Size, show: c.progress}
+	defer progress.finish()
+	w := io.MultiWriter(tmpFile, hash, progress)
+	var done server.FileMsg
+	for {
+		msgType, data, err := wsConn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if msgType == websocket.BinaryMessage {
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := json.Unmarshal(data, &done); err != nil {
+			return err
+		}
+		if done.Error != "" {
+			return &server.FileError{Code: done.Code, Message: done.Error}
+		}
+		break
+	}
+
+	if progress.done != header.Size || done.SHA256 != hex.EncodeToString(hash.Sum(nil)) {
+		return errors.New("the checksum of the downloaded file doesn't match")
+	}
+	// The temporary files are created readable only by their owner
+	tmpFile.Chmod(0644)
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Link(tmpFile.Name(), path)
+}
+
+func (c *fileTransferClient) list() ([]server.FileInfo, error) {
+	wsConn, err := c.request(server.FileRequestMsg{Op: server.FileOpList})
+	if err != nil {
+		return nil, err
+	}
+	defer wsConn.Close()
+
+	msg, err := readFileMsg(wsConn)
+	return msg.Files, err
+}
+
+// Runs the put and get commands, returning the exit code
+func runFileCommand(command string, args []string) int {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	name := flags.String("name", os.Getenv("USER"), "The name to join the session with, shown to the sharer")
+	outputDir := flags.String("output", ".", "The directory to download the files to")
+	quiet := flags.Bool("quiet", false, "Don't show the progress of the transfers")
+	verbose := flags.Bool("verbose", false, "Verbose logging")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `
+Usage:
+  tty-share put [--name <name>] [--quiet] <session URL> <file>...      # upload files to the sharer
+  tty-share get [--name <name>] [--quiet] [--output <dir>] <session URL> [<name>...]
+                                                                      # download the files the sharer offers, or list them
+
+Flags:
+`)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	log.SetLevel(log.WarnLevel)
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	args = flags.Args()
+	if len(args) < 1 || (command == "put" && len(args) < 2) {
+		flags.Usage()
+		return 2
+	}
+
+	feature := share.FeatureDownloads
+	if command == "put" {
+		feature = share.FeatureUploads
+	}
+	client, err := joinForFileTransfer(args[0], *name, feature)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot join the session: %s\n", err.Error())
+		return 1
+	}
+	defer client.Close()
+	client.progress = !*quiet && term.IsTerminal(os.Stderr.Fd())
+
+	if command == "get" && len(args) == 1 {
+		files, err := client.list()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot list the offered files: %s\n", err.Error())
+			return 1
+		}
+		for _, file := range files {
+			fmt.Printf("%s\t%s\n", file.Name, formatBytes(file.Size))
+		}
+		return 0
+	}
+
+	exitCode := 0
+	for _, arg := range args[1:] {
+		var err error
+		if command == "put" {
+			err = client.put(arg)
+		} else {
+			err = client.get(arg, *outputDir)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot %s %s: %s\n", command, arg, err.Error())
+			exitCode = 1
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Done: %s %s\n", command, arg)
+	}
+	return exitCode
+}
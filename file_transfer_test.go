@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := map[string]int64{
+		"0":     0,
+		"512":   512,
+		"10K":   10 * 1024,
+		"100M":  100 * 1024 * 1024,
+		"2g":    2 * 1024 * 1024 * 1024,
+		"100MB": 100 * 1024 * 1024,
+	}
+	for size, expected := range tests {
+		if n, err := parseByteSize(size); err != nil || n != expected {
+			t.Errorf("%s: expected %d, got %d, %v", size, expected, n, err)
+		}
+	}
+
+	for _, size := range []string{"", "M", "-1", "1T", "ten"} {
+		if _, err := parseByteSize(size); err == nil {
+			t.Errorf("%s: expected an error", size)
+		}
+	}
+}
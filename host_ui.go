@@ -0,0 +1,466 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elisescu/tty-share/server"
+)
+
+// How long the sharer has to answer an approval request, before it's refused
+const approvalTimeout = 60 * time.Second
+
+// How long a notice is shown to the sharer
+const noticeTimeout = 10 * time.Second
+
+// An overlay drawn at the bottom of the sharer's terminal
+type hostOverlay struct {
+	lines []string
+	// Called with the keys the sharer presses while the overlay is shown. Returns true to close it
+	onKey func(key byte) bool
+}
+
+// The sharer's side of the session: the overlays shown only in the sharer's terminal, over the
+// shared application. These are the approval requests, the notices, and the menu opened with the
+// host key.
+// While an overlay is shown, the keys the sharer presses go to it, instead of the application.
+type hostUI struct {
+	pty    io.Writer
+	out    io.Writer
+	server *server.TTYServer
+	// Opens the menu. Not used if the name is empty
+	hostKey     byte
+	hostKeyName string
+	// Pauses and resumes the sharing. Not used if the name is empty
+	pauseKey     byte
+	pauseKeyName string
+	// Returns the size of the sharer's terminal
+	size func() (cols, rows int, err error)
+	// Redraws the shared application, after an overlay is closed
+	refresh func()
+	// The URLs the participants join the session with
+	urls []string
+	// Ends the session
+	end func()
+
+	// Keeps the application output and the overlay from mixing
+	outMutex sync.Mutex
+	mutex    sync.Mutex
+	overlay  *hostOverlay
+	// The number of rows used by the overlay, last time it was drawn
+	overlayRows int
+	// The approval requests are shown one at a time
+	approvalMutex sync.Mutex
+}
+
+// The output of the shared application, in the sharer's terminal
+type hostOutput struct {
+	ui *hostUI
+}
+
+// Writes the output of the shared application, and draws the overlay again over it, if shown, as
+// the output might have scrolled it or drawn over it
+func (o *hostOutput) Write(data []byte) (int, error) {
+	o.ui.outMutex.Lock()
+	defer o.ui.outMutex.Unlock()
+
+	n, err := o.ui.out.Write(data)
+	o.ui.drawLocked()
+	return n, err
+}
+
+func (ui *hostUI) Output() io.Writer {
+	return &hostOutput{ui: ui}
+}
+
+// Receives the keys pressed by the sharer. They go to the shared application, unless an overlay is
+// shown, or they open one
+func (ui *hostUI) Write(data []byte) (int, error) {
+	toPty := make([]byte, 0, len(data))
+	flush := func() error {
+		if len(toPty) == 0 {
+			return nil
+		}
+		ui.server.SharerInput()
+		_, err := ui.pty.Write(toPty)
+		toPty = toPty[:0]
+		return err
+	}
+
+	for _, key := range data {
+		ui.mutex.Lock()
+		overlay := ui.overlay
+		ui.mutex.Unlock()
+
+		pause := overlay == nil && ui.pauseKeyName != "" && key == ui.pauseKey
+		menu := overlay == nil && ui.hostKeyName != "" && key == ui.hostKey
+		if overlay == nil && !menu && !pause {
+			toPty = append(toPty, key)
+			continue
+		}
+
+		if err := flush(); err != nil {
+			return 0, err
+		}
+		if pause {
+			ui.server.SetPaused(!ui.server.Paused())
+		} else if overlay == nil {
+			ui.showMenu()
+		} else if overlay.onKey(key) {
+			ui.hide(overlay)
+		}
+	}
+
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Fits the text in the given number of columns, padding it with spaces
+func fitWidth(text string, cols int) string {
+	var b strings.Builder
+	width := 0
+	for _, r := range text {
+		w := runeWidth(r)
+		if r < ' ' || width+w > cols {
+			break
+		}
+		b.WriteRune(r)
+		width += w
+	}
+	return b.String() + strings.Repeat(" ", cols-width)
+}
+
+// Draws the overlay, if any. Call with outMutex locked
+func (ui *hostUI) drawLocked() {
+	ui.mutex.Lock()
+	overlay := ui.overlay
+	ui.mutex.Unlock()
+	if overlay == nil {
+		return
+	}
+
+	cols, rows, err := ui.size()
+	if err != nil || rows < len(overlay.lines) {
+		return
+	}
+
+	var b strings.Builder
+	// Save the cursor and its attributes, and restore them after drawing
+	b.WriteString("\0337")
+	for i, line := range overlay.lines {
+		fmt.Fprintf(&b, "\033[%d;1H\033[0;7m%s\033[0m", rows-len(overlay.lines)+1+i, fitWidth(line, cols))
+	}
+	b.WriteString("\0338")
+	ui.out.Write([]byte(b.String()))
+	ui.overlayRows = len(overlay.lines)
+}
+
+// Erases the rows drawn by the overlay. Call with outMutex locked
+func (ui *hostUI) eraseLocked() {
+	_, rows, err := ui.size()
+	if err != nil || ui.overlayRows == 0 {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("\0337")
+	for i := 0; i < ui.overlayRows; i++ {
+		fmt.Fprintf(&b, "\033[%d;1H\033[2K", rows-ui.overlayRows+1+i)
+	}
+	b.WriteString("\0338")
+	ui.out.Write([]byte(b.String()))
+	ui.overlayRows = 0
+}
+
+// Shows the overlay, replacing the one shown before, if any
+func (ui *hostUI) show(overlay *hostOverlay) {
+	ui.outMutex.Lock()
+	defer ui.outMutex.Unlock()
+
+	ui.eraseLocked()
+	ui.mutex.Lock()
+	ui.overlay = overlay
+	ui.mutex.Unlock()
+	ui.drawLocked()
+}
+
+// Hides the overlay, if it's still shown, and redraws the application under it
+func (ui *hostUI) hide(overlay *hostOverlay) {
+	ui.outMutex.Lock()
+	ui.mutex.Lock()
+	shown := ui.overlay == overlay
+	if shown {
+		ui.overlay = nil
+	}
+	ui.mutex.Unlock()
+	if shown {
+		ui.eraseLocked()
+	}
+	ui.outMutex.Unlock()
+
+	if shown {
+		ui.refresh()
+	}
+}
+
+// Asks the sharer the question, and waits for one of the keys. Returns 0 if the sharer doesn't
+// answer in time
+func (ui *hostUI) ask(question string, keys string) byte {
+	ui.approvalMutex.Lock()
+	defer ui.approvalMutex.Unlock()
+
+	answer := make(chan byte, 1)
+	overlay := &hostOverlay{
+		lines: []string{" tty-share: " + question},
+		onKey: func(key byte) bool {
+			if key >= 'A' && key <= 'Z' {
+				key += 'a' - 'A'
+			}
+			if !strings.ContainsRune(keys, rune(key)) {
+				return false
+			}
+			answer <- key
+			return true
+		},
+	}
+	ui.show(overlay)
+
+	select {
+	case key := <-answer:
+		return key
+	case <-time.After(approvalTimeout):
+		ui.hide(overlay)
+		return 0
+	}
+}
+
+// Approve asks the sharer to approve the request, and waits for the answer. Used as the
+// server.Approver
+func (ui *hostUI) Approve(req server.ApprovalRequest) bool {
+	return ui.ask(fmt.Sprintf("%s. Allow? [y/n]", req), "yn") == 'y'
+}
+
+// ApproveJoin asks the sharer to admit a new participant, and in which role. Used as the
+// server.JoinApprover
+func (ui *hostUI) ApproveJoin(req server.ApprovalRequest) server.ParticipantRole {
+	switch ui.ask(fmt.Sprintf("%s. Let in as [w]riter, [v]iewer, or [n]ot?", req), "wvn") {
+	case 'w':
+		return server.RoleWriter
+	case 'v':
+		return server.RoleViewer
+	default:
+		return server.RoleRejected
+	}
+}
+
+// Notify shows the text to the sharer for a while, unless another overlay is shown. Pressing a key
+// closes it, and the key goes to the application as usual
+func (ui *hostUI) Notify(text string) {
+	ui.mutex.Lock()
+	busy := ui.overlay != nil
+	ui.mutex.Unlock()
+	if busy {
+		return
+	}
+
+	overlay := &hostOverlay{
+		lines: []string{" tty-share: " + text},
+	}
+	overlay.onKey = func(key byte) bool {
+		ui.hide(overlay)
+		ui.Write([]byte{key})
+		return true
+	}
+	ui.show(overlay)
+	time.AfterFunc(noticeTimeout, func() {
+		ui.hide(overlay)
+	})
+}
+
+// OnPause tells the sharer the sharing was paused or resumed. Used as the server's OnPause
+func (ui *hostUI) OnPause(paused bool) {
+	how := "tty-share ctl resume"
+	if ui.pauseKeyName != "" {
+		how = ui.pauseKeyName
+	} else if ui.hostKeyName != "" {
+		how = fmt.Sprintf("%s p", ui.hostKeyName)
+	}
+	if paused {
+		ui.Notify(fmt.Sprintf("sharing paused, the participants don't see your terminal. Press %s to resume", how))
+	} else {
+		ui.Notify("sharing resumed")
+	}
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%d B", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.1f kB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	}
+}
+
+// Shows the active tunnels, and lets the sharer revoke them
+func (ui *hostUI) showTunnelsMenu() {
+	tunnels := ui.server.Tunnels()
+	if len(tunnels) > 9 {
+		tunnels = tunnels[:9]
+	}
+
+	lines := []string{fmt.Sprintf(" tty-share: %d active tunnel(s)", len(tunnels))}
+	for i, t := range tunnels {
+		who := t.ParticipantID
+		if t.ParticipantName != "" {
+			who = fmt.Sprintf("%s (%s)", t.ParticipantName, t.ParticipantID)
+		}
+		kind := "tunnel"
+		if t.Reverse {
+			kind = "reverse tunnel"
+		}
+		destinations := []string{}
+		for _, s := range t.Streams {
+			destinations = append(destinations, s.Destination)
+		}
+		line := fmt.Sprintf(" %d: %s of %s, %d connection(s), %s out, %s in", i+1, kind, who,
+			len(t.Streams), formatBytes(t.BytesOut), formatBytes(t.BytesIn))
+		if len(destinations) > 0 {
+			line += ": " + strings.Join(destinations, ", ")
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, fmt.Sprintf(" 1-9: revoke a tunnel | %s: send %s | any other key: close", ui.hostKeyName, ui.hostKeyName))
+
+	ui.show(&hostOverlay{
+		lines: lines,
+		onKey: func(key byte) bool {
+			if key == ui.hostKey {
+				ui.sendHostKey()
+			} else if i := int(key - '1'); key >= '1' && i < len(tunnels) {
+				ui.server.RevokeTunnel(tunnels[i].ID)
+			}
+			return true
+		},
+	})
+}
+
+// Sends the host key to the shared application. Used when the sharer presses it twice
+func (ui *hostUI) sendHostKey() {
+	ui.server.SharerInput()
+	ui.pty.Write([]byte{ui.hostKey})
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// Shows the menu opened with the host key. Each of the entries closes it, or opens another overlay
+func (ui *hostUI) showMenu() {
+	participants := ui.server.Participants()
+	readOnly, paused := ui.server.ReadOnly(), ui.server.Paused()
+
+	lines := []string{
+		fmt.Sprintf(" tty-share: %d participant(s), %d tunnel(s), read only: %s, paused: %s",
+			len(participants), len(ui.server.Tunnels()), onOff(readOnly), onOff(paused)),
+		" v: participants | t: tunnels | r: toggle read only | p: pause/resume | u: URLs | e: end the session",
+		fmt.Sprintf(" %s: send %s | any other key: close", ui.hostKeyName, ui.hostKeyName),
+	}
+
+	ui.show(&hostOverlay{
+		lines: lines,
+		onKey: func(key byte) bool {
+			switch key {
+			case ui.hostKey:
+				ui.sendHostKey()
+			case 'v':
+				ui.showParticipantsMenu()
+			case 't':
+				ui.showTunnelsMenu()
+			case 'r':
+				ui.server.SetReadOnly(!readOnly)
+			case 'p':
+				ui.server.SetPaused(!paused)
+			case 'u':
+				ui.showURLs()
+			case 'e':
+				ui.confirmEnd()
+			}
+			return true
+		},
+	})
+}
+
+// Shows the participants, and lets the sharer remove them from the session
+func (ui *hostUI) showParticipantsMenu() {
+	participants := ui.server.Participants()
+	if len(participants) > 9 {
+		participants = participants[:9]
+	}
+
+	lines := []string{fmt.Sprintf(" tty-share: %d participant(s)", len(participants))}
+	for i, p := range participants {
+		who := p.ID
+		if p.Name != "" {
+			who = fmt.Sprintf("%s (%s)", p.Name, p.ID)
+		}
+		lines = append(lines, fmt.Sprintf(" %d: %s from %s, %s, joined %s ago", i+1, who, p.RemoteAddr, p.Role,
+			time.Since(p.JoinedAt).Round(time.Second)))
+	}
+	lines = append(lines, " 1-9: remove a participant | any other key: close")
+
+	ui.show(&hostOverlay{
+		lines: lines,
+		onKey: func(key byte) bool {
+			if i := int(key - '1'); key >= '1' && i < len(participants) {
+				ui.server.Kick(participants[i].ID)
+			}
+			return true
+		},
+	})
+}
+
+// Shows the URLs of the session, and lets the sharer copy them to the clipboard of its terminal
+func (ui *hostUI) showURLs() {
+	lines := []string{" tty-share: join the session with"}
+	for _, url := range ui.urls {
+		lines = append(lines, " "+url)
+	}
+	lines = append(lines, " c: copy to the clipboard | any other key: close")
+
+	ui.show(&hostOverlay{
+		lines: lines,
+		onKey: func(key byte) bool {
+			if key == 'c' {
+				// Most terminals set their clipboard with the OSC 52 sequence
+				clip := server.OSC52{Selection: "c", Data: []byte(strings.Join(ui.urls, "\n"))}
+				ui.outMutex.Lock()
+				ui.out.Write(clip.Sequence())
+				ui.outMutex.Unlock()
+			}
+			return true
+		},
+	})
+}
+
+// Asks the sharer to confirm, before ending the session
+func (ui *hostUI) confirmEnd() {
+	ui.show(&hostOverlay{
+		lines: []string{" tty-share: end the session, for everyone? [y/n]"},
+		onKey: func(key byte) bool {
+			if key == 'y' || key == 'Y' {
+				ui.end()
+			}
+			return true
+		},
+	})
+}
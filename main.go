@@ -2,15 +2,22 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/elisescu/tty-share/proxy"
 	"github.com/elisescu/tty-share/server"
 	ttyServer "github.com/elisescu/tty-share/server"
+	"github.com/elisescu/tty-share/share"
+	"github.com/moby/term"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -18,48 +25,93 @@ import (
 // complex linker flags that could set the version from the outside
 var version string = "2.4.1"
 
-func createServer(frontListenAddress string, frontendPath string, pty server.PTYHandler, sessionID string, allowTunneling bool, crossOrigin bool, baseUrlPath string) *server.TTYServer {
-	config := ttyServer.TTYServerConfig{
-		FrontListenAddress: frontListenAddress,
-		FrontendPath:       frontendPath,
-		PTY:                pty,
-		SessionID:          sessionID,
-		AllowTunneling:     allowTunneling,
-		CrossOrigin:        crossOrigin,
-		BaseUrlPath:        baseUrlPath,
-	}
+// How long to wait for the file transfers in progress, when the session ends
+const shutdownTimeout = 5 * time.Second
 
-	server := ttyServer.NewTTYServer(config)
-	return server
-}
+// A flag which can be given multiple times, collecting all its values
+type stringsFlag []string
 
-type nilPTY struct {
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, ",")
 }
 
-func (nw *nilPTY) Write(data []byte) (int, error) {
-	return len(data), nil
+func (sf *stringsFlag) Set(value string) error {
+	*sf = append(*sf, value)
+	return nil
 }
 
-func (nw *nilPTY) Refresh() {
+// Parses the time the session expires at: either a time of the day (HH:MM), the next one after
+// now, or a full RFC 3339 time
+func parseExpiresAt(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("15:04", value, now.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry time %q, expected HH:MM or 2006-01-02T15:04:05Z07:00", value)
+	}
+	t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
 }
 
 func main() {
+	// The file transfer commands have their own flags
+	if len(os.Args) > 1 && (os.Args[1] == "put" || os.Args[1] == "get") {
+		os.Exit(runFileCommand(os.Args[1], os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtlCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "status" || os.Args[1] == "prompt") {
+		os.Exit(runStatusCommand(os.Args[1], os.Args[2:]))
+	}
+
 	usageString := `
 Usage:
   tty-share creates a session to a terminal application with remote participants. The session can be joined either from the browser, or by tty-share command itself.
 
       tty-share [[--args <"args">] --command <executable>]                        # share the terminal and get a session URL, as a server
+                [--tmux <target> | --screen <name> | --pipe | --device <path> [--baud <rate>] [--serial-mode <mode>]] [--scrollback <size>]
                 [--logfile <file name>] [--listen <[ip]:port>]
                 [--frontend-path <path>] [--tty-proxy <host:port>]
                 [--readonly] [--public] [no-tls] [--verbose] [--version]
-      tty-share [--verbose] [--logfile <file name>] [-L <local_port>:<remote_host>:<remote_port>]
-                [--detach-keys]                     <session URL>                 # connect to an existing session, as a client
+                [-A] [--allow-reverse-tunnels] [--tunnel-allow <rule>]... [--tunnel-deny <rule>]...
+                [--tunnel-users <names>] [--tunnel-approve] [--host-key <key>] [--pause-key <key>] [--control-socket <path>]
+                [--upload-dir <dir>] [--offer <file>]... [--max-file-size <size>]
+                [--file-users <names>] [--upload-approve] [--audit-log <file>] [--allow-clipboard-push]
+                [--idle-timeout <duration>] [--max-duration <duration>] [--expires-at <time>]
+                [--viewer-idle-timeout <duration>] [--approve-joins] [--max-participants <n>]
+                [--compression-level <level>] [--compression-threshold <size>] [--no-tunnel-compression]
+      tty-share [--verbose] [--logfile <file name>] [-L [<bind_address>:]<port>:<host>:<hostport>[/udp]]...
+                [-R [<bind_address>:]<remote_port>:<local_host>:<local_port>] [-D [<bind_address>:]<port>]
+                [--name <name>] [--clipboard] [--clipboard-push] [--detach-keys] [--pan-key] [--no-tunnel-compression]
+                <session URL>                                                 # connect to an existing session, as a client
+      tty-share ctl [--socket <path>] [--json] <command>                          # query and control a running session, see tty-share ctl --help
+      tty-share status [--json]                                                   # inside a shared terminal: the participants, the URLs and the uptime
+      tty-share prompt [<format>]                                                 # inside a shared terminal: a short status for PS1, or a tmux status bar
+      tty-share put [--name <name>] <session URL> <file>...                       # upload files to the sharer
+      tty-share get [--name <name>] [--output <dir>] <session URL> [<name>...]   # download the files the sharer offers, or list them
 
 Examples:
   Start bash and create a public sharing session, so it's accessible outside the local network, and make the session read only:
 
       tty-share --public --readonly --command bash
 
+  Share the output of a build, as it goes, read only:
+
+      make 2>&1 | tty-share --pipe --public
+
+  Share the serial console of a board, at 115200 baud:
+
+      tty-share --device /dev/ttyUSB0 --baud 115200 --serial-mode 8N1
+
+  Share the pane 1 of the window 0 of an already running tmux session called "work":
+
+      tty-share --tmux work:0.1
+
   Join a remote session by providing the URL created another tty-share command:
 
       tty-share http://localhost:8000/s/local/
@@ -73,6 +125,8 @@ Flags:
 		*commandName = "bash"
 	}
 	commandArgs := flag.String("args", "", "[s] The command arguments")
+	tmuxTarget := flag.String("tmux", "", "[s] Share an existing tmux session, window or pane, instead of starting a command. With tmux 3.2 or newer, the sharer's own tmux client is not resized by the remote participants. Can't be used with --command")
+	screenName := flag.String("screen", "", "[s] Share an existing screen session, instead of starting a command. Can't be used with --command")
 	logFileName := flag.String("logfile", "-", "The name of the file to log")
 	listenAddress := flag.String("listen", "localhost:8000", "[s] tty-server address")
 	versionFlag := flag.Bool("version", false, "Print the tty-share version")
@@ -85,11 +139,53 @@ Flags:
 	headless := flag.Bool("headless", false, "[s] Don't expect an interactive terminal at stdin")
 	headlessCols := flag.Int("headless-cols", 80, "[s] Number of cols for the allocated pty when running headless")
 	headlessRows := flag.Int("headless-rows", 25, "[s] Number of rows for the allocated pty when running headless")
+	pipe := flag.Bool("pipe", false, "[s] Share what is read from stdin, e.g.: the output of another command, instead of starting a command. The session is read only, has the --winsize size (or --headless-cols x --headless-rows), and ends when stdin ends")
+	devicePath := flag.String("device", "", "[s] Share a serial port (e.g.: /dev/ttyUSB0), or another terminal device (e.g.: an existing pty), instead of starting a command")
+	baudRate := flag.Int("baud", 0, "[s] With --device, the baud rate to set on the serial port (e.g.: 115200). Left as it is, if 0")
+	serialModeName := flag.String("serial-mode", "", "[s] With --device, the data bits, the parity (N, E or O) and the stop bits to set on the serial port, e.g.: 8N1. Left as they are, if empty")
+	scrollback := flag.String("scrollback", "1M", "[s] With --pipe or --device, how much of the output to keep, and show to the participants who join later, in bytes, or with a K, M or G suffix")
 	detachKeys := flag.String("detach-keys", "ctrl-o,ctrl-c", "[c] Sequence of keys to press for closing the connection. Supported: https://godoc.org/github.com/moby/term#pkg-variables.")
+	panKey := flag.String("pan-key", "ctrl-]", "[c] When the local window is smaller than the remote one, press this key followed by arrows or h/j/k/l (H/J/K/L for half a screen) to pan the view, or f to follow the cursor. Press it twice to send it to the remote side")
 	allowTunneling := flag.Bool("A", false, "[s] Allow clients to create a TCP tunnel")
-	tunnelConfig := flag.String("L", "", "[c] TCP tunneling addresses: local_port:remote_host:remote_port. The client will listen on local_port for TCP connections, and will forward those to the from the server side to remote_host:remote_port")
+	var tunnelConfig stringsFlag
+	flag.Var(&tunnelConfig, "L", "[c] Tunneling addresses: [bind_address:]port:host:hostport. The client will listen on port (on the loopback interface, unless bind_address is given, or * for all interfaces) for TCP connections, and will forward those from the server side to host:hostport. Either side can be a Unix socket path instead, and a /udp suffix forwards UDP datagrams instead. IPv6 addresses go between brackets. Can be given multiple times")
+	allowReverseTunneling := flag.Bool("allow-reverse-tunnels", false, "[s] Allow clients to create reverse TCP tunnels (-R), listening on the loopback interface of this machine")
+	reverseTunnelConfig := flag.String("R", "", "[c] Reverse TCP tunneling addresses: [bind_address:]remote_port:local_host:local_port, with the IPv6 addresses between brackets. The server will listen on remote_port, on its loopback interface (the only bind address it takes), and the connections it gets will be forwarded from this side to local_host:local_port")
+	dynamicTunnelConfig := flag.String("D", "", "[c] Dynamic TCP tunneling: [bind_address:]port. The client will run a SOCKS5 server on port, and the server side will connect to the destinations the SOCKS clients ask for")
+	var tunnelAllow, tunnelDeny stringsFlag
+	flag.Var(&tunnelAllow, "tunnel-allow", "[s] Allow the tunnels (-L, -D) to connect only to the destinations matching this rule. A rule is a host pattern (*.example.com), an IP, or a CIDR, optionally followed by :port or :from-to (e.g.: 10.0.0.0/8:8000-8999, [fd00::/8]:22), or a Unix socket path pattern (/var/run/*.sock). The reverse tunnels (-R) listen only on the ports allowed for localhost (e.g.: localhost:8000-8999). Can be given multiple times")
+	flag.Var(&tunnelDeny, "tunnel-deny", "[s] Don't allow the tunnels (-L, -D) to connect to the destinations matching this rule, nor the reverse tunnels (-R) to listen on the ports matching it for localhost. Takes precedence over --tunnel-allow. Can be given multiple times")
+	tunnelUsers := flag.String("tunnel-users", "", "[s] Comma separated names of the participants allowed to open tunnels (see --name). Needs --approve-joins: only the participants the sharer let in with one of these names can open tunnels")
+	tunnelApprove := flag.Bool("tunnel-approve", false, "[s] Ask the sharer to approve each new tunnel destination of each participant")
+	pauseKey := flag.String("pause-key", "", "[s] A key the sharer presses to pause the sharing, and to resume it (e.g.: ctrl-p). While paused, the participants see a placeholder instead of the output, and can't type. Can also be done from the --host-key menu")
+	controlSocket := flag.String("control-socket", "", "[s] The path of the control socket, used by tty-share ctl. By default, one in a directory of the user, in "+os.TempDir()+". Use none to not create one")
+	hostKey := flag.String("host-key", "", "[s] A key the sharer presses to open the menu (e.g.: ctrl-]): the participants, the tunnels, read only, pause, the URLs, and ending the session. Press it twice to send it to the shared application")
+	uploadDir := flag.String("upload-dir", "", "[s] Let the participants upload files to this directory (tty-share put, or drag and drop in the browser). Existing files are never replaced")
+	var offeredFiles stringsFlag
+	flag.Var(&offeredFiles, "offer", "[s] Let the participants download this file (tty-share get). Can be given multiple times")
+	maxFileSize := flag.String("max-file-size", "100M", "[s] The size limit of the uploaded files, in bytes, or with a K, M or G suffix. 0 for no limit")
+	fileUsers := flag.String("file-users", "", "[s] Comma separated names of the participants allowed to transfer files (see --name). Needs --approve-joins, like --tunnel-users")
+	uploadApprove := flag.Bool("upload-approve", false, "[s] Ask the sharer to approve each upload")
+	auditLogName := flag.String("audit-log", "", "[s] Append a JSON line to this file for each file transfer")
+	clipboard := flag.Bool("clipboard", false, "[c] Let the remote applications set the clipboard of the local terminal (OSC 52)")
+	clipboardPush := flag.Bool("clipboard-push", false, "[c] Let the remote applications read the clipboard of the local terminal, if the server allows it (OSC 52)")
+	allowClipboardPush := flag.Bool("allow-clipboard-push", false, "[s] Let the participants answer the clipboard queries of the shared applications with their own clipboard (OSC 52)")
+	idleTimeout := flag.Duration("idle-timeout", 0, "[s] End the session after it was idle this long (e.g.: 30m): no input, no output, and no participants")
+	maxDuration := flag.Duration("max-duration", 0, "[s] End the session after this long (e.g.: 2h)")
+	expiresAt := flag.String("expires-at", "", "[s] End the session at this time: HH:MM (the next one), or 2006-01-02T15:04:05Z07:00")
+	viewerIdleTimeout := flag.Duration("viewer-idle-timeout", 0, "[s] Disconnect the participants who don't type, or resize their window, this long (e.g.: 15m)")
+	approveJoins := flag.Bool("approve-joins", false, "[s] Keep the new participants waiting, until the sharer lets them in, as writers, or as viewers who can't type")
+	maxParticipants := flag.Int("max-participants", 0, "[s] The most participants in the session at the same time. No limit if 0")
+	participantName := flag.String("name", os.Getenv("USER"), "[c] The name to join the session with, shown to the sharer")
 	crossOrgin := flag.Bool("cross-origin", false, "[s] Allow cross origin requests to the server")
 	baseUrlPath := flag.String("base-url-path", "", "[s] The base URL path on the serve")
+	winSizePolicyName := flag.String("winsize-policy", "sharer", "[s] How the size of the shared terminal is decided: sharer (the sharer's terminal size), smallest or largest (of all the terminals), fixed (see --winsize), or follow-driver (the terminal of whoever typed last)")
+	outputBatchDelay := flag.Duration("output-batch-delay", 5*time.Millisecond, "[s] How long to hold the output, to send it to the participants with the output which follows, in fewer messages. The echo of what's typed is not held. 0 to not hold it")
+	outputBatchSize := flag.String("output-batch-size", "32K", "[s] The most output to hold (see --output-batch-delay), in bytes, or with a K, M or G suffix")
+	compressionLevel := flag.Int("compression-level", 1, "[s] The compression level of what's sent to the participants, if they support it: from 1 (fastest) to 9 (smallest), -1 for the default one, or 0 to not compress it")
+	compressionThreshold := flag.String("compression-threshold", fmt.Sprint(server.DefaultCompressionThreshold), "[s] The messages smaller than this are not compressed, in bytes, or with a K, M or G suffix")
+	noTunnelCompression := flag.Bool("no-tunnel-compression", false, "Don't compress the tunnels, e.g.: when they carry encrypted traffic, which doesn't compress. For all of them as a server, or for the ones opened as a client")
+	fixedWinSize := flag.String("winsize", "", "[s] The <cols>x<rows> size of the shared terminal, used with --winsize-policy fixed")
 
 	verbose := flag.Bool("verbose", false, "Verbose logging")
 	flag.Usage = func() {
@@ -126,22 +222,154 @@ Flags:
 	if len(args) == 1 {
 		connectURL := args[0]
 
-		client := newTtyShareClient(connectURL, *detachKeys, tunnelConfig)
+		client := newTtyShareClient(connectURL, *detachKeys, *panKey, *participantName, *clipboard, *clipboardPush, tunnelConfig, reverseTunnelConfig, *dynamicTunnelConfig, !*noTunnelCompression)
 
 		err := client.Run()
-		if err != nil {
-			fmt.Printf("Cannot connect to the remote session. Make sure the URL points to a valid tty-share session.\n")
+		var unsupported *share.UnsupportedError
+		if errors.As(err, &unsupported) {
+			fmt.Printf("Cannot join the session: %s\n", err.Error())
+		} else if err != nil {
+			fmt.Printf("Cannot connect to the remote session (%s). Make sure the URL points to a valid tty-share session.\n", err.Error())
 		}
 		fmt.Printf("\ntty-share disconnected\n\n")
 		return
 	}
 
-	// tty-share works as a server, from here on
+	// tty-share works as a server, from here on. Sharing a pipe, stdin is not a terminal, but the
+	// output to share
+	if *pipe {
+		*headless = true
+		if *tmuxTarget != "" || *screenName != "" || *devicePath != "" {
+			fmt.Printf("--pipe can't be used with --tmux, --screen or --device\n")
+			os.Exit(1)
+		}
+	}
+	if *devicePath != "" && (*tmuxTarget != "" || *screenName != "") {
+		fmt.Printf("--device can't be used with --tmux or --screen\n")
+		os.Exit(1)
+	}
+	var deviceMode *serialMode
+	if *serialModeName != "" {
+		mode, err := parseSerialMode(*serialModeName)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}
+		deviceMode = &mode
+	}
 	if !isStdinTerminal() && !*headless {
 		fmt.Printf("Input not a tty\n")
 		os.Exit(1)
 	}
 
+	winSizePolicy, err := server.ParseWinSizePolicy(*winSizePolicyName)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	tunnelPolicy, err := server.NewTunnelPolicy(tunnelAllow, tunnelDeny)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	var hostKeyByte byte
+	if *hostKey != "" {
+		hostKeyBytes, err := term.ToBytes(*hostKey)
+		if err != nil || len(hostKeyBytes) != 1 {
+			fmt.Printf("Invalid host key: %s\n", *hostKey)
+			os.Exit(1)
+		}
+		hostKeyByte = hostKeyBytes[0]
+	}
+	var pauseKeyByte byte
+	if *pauseKey != "" {
+		pauseKeyBytes, err := term.ToBytes(*pauseKey)
+		if err != nil || len(pauseKeyBytes) != 1 || (*hostKey != "" && pauseKeyBytes[0] == hostKeyByte) {
+			fmt.Printf("Invalid pause key: %s\n", *pauseKey)
+			os.Exit(1)
+		}
+		pauseKeyByte = pauseKeyBytes[0]
+	}
+	if *tunnelApprove && *headless {
+		fmt.Printf("The tunnels can't be approved when running headless\n")
+		os.Exit(1)
+	}
+	var tunnelUsersList []string
+	if *tunnelUsers != "" {
+		tunnelUsersList = strings.Split(*tunnelUsers, ",")
+	}
+	if *approveJoins && *headless {
+		fmt.Printf("The participants can't be approved when running headless\n")
+		os.Exit(1)
+	}
+	if *uploadApprove && *headless {
+		fmt.Printf("The uploads can't be approved when running headless\n")
+		os.Exit(1)
+	}
+	var fileUsersList []string
+	if *fileUsers != "" {
+		fileUsersList = strings.Split(*fileUsers, ",")
+	}
+	// Anyone can choose any name, so the names are trusted only once the sharer let them in
+	if (tunnelUsersList != nil || fileUsersList != nil) && !*approveJoins {
+		fmt.Printf("--tunnel-users and --file-users need --approve-joins\n")
+		os.Exit(1)
+	}
+	var expiresAtTime time.Time
+	if *expiresAt != "" {
+		expiresAtTime, err = parseExpiresAt(*expiresAt, time.Now())
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	maxFileSizeBytes, err := parseByteSize(*maxFileSize)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	if err := checkFileSharing(*uploadDir, offeredFiles); err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	var auditLog io.Writer
+	if *auditLogName != "" {
+		auditFile, err := os.OpenFile(*auditLogName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			fmt.Printf("Can't open %s for writing the audit log\n", *auditLogName)
+			os.Exit(1)
+		}
+		defer auditFile.Close()
+		auditLog = auditFile
+	}
+	scrollbackBytes, err := parseByteSize(*scrollback)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	outputBatchBytes, err := parseByteSize(*outputBatchSize)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	if *compressionLevel < -2 || *compressionLevel > 9 {
+		fmt.Printf("Invalid compression level %d, expected -2 to 9\n", *compressionLevel)
+		os.Exit(1)
+	}
+	compressionThresholdBytes, err := parseByteSize(*compressionThreshold)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	fixedCols, fixedRows := 0, 0
+	if winSizePolicy == server.WinSizePolicyFixed || (*pipe && *fixedWinSize != "") {
+		fixedCols, fixedRows, err = server.ParseWinSize(*fixedWinSize)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
 	sessionID := ""
 	publicURL := ""
 	if *publicSession {
@@ -163,34 +391,150 @@ Flags:
 		"TTY_SHARE=1",
 	)
 
+	var controlListener net.Listener
+	if *controlSocket != "none" {
+		controlSocketPath := *controlSocket
+		var err error
+		if controlSocketPath == "" {
+			controlSocketPath, err = defaultControlSocketPath()
+		}
+		if err == nil {
+			controlListener, err = listenControlSocket(controlSocketPath)
+		}
+		if err != nil {
+			log.Errorf("Cannot listen on the control socket: %s", err.Error())
+			fmt.Printf("Cannot listen on the control socket: %s\n", err.Error())
+			return
+		}
+		defer controlListener.Close()
+		envVars = append(envVars, fmt.Sprintf("%s=%s", controlSocketEnv, controlSocketPath))
+	}
+
 	if publicURL != "" {
 		envVars = append(envVars,
 			fmt.Sprintf("TTY_SHARE_PUBLIC_URL=%s", publicURL),
 		)
 	}
 
-	ptyMaster := ptyMasterNew(*headless, *headlessCols, *headlessRows)
-	err := ptyMaster.Start(*commandName, strings.Fields(*commandArgs), envVars)
-	if err != nil {
-		log.Errorf("Cannot start the %s command: %s", *commandName, err.Error())
+	sanitizedBaseUrlPath := server.CleanBaseUrlPath(*baseUrlPath)
+	localURL := fmt.Sprintf("http://%s%s/s/local/", *listenAddress, sanitizedBaseUrlPath)
+	joinURLs := []string{localURL}
+	if publicURL != "" {
+		joinURLs = append(joinURLs, publicURL)
+	}
+
+	config := ttyServer.TTYServerConfig{
+		FrontListenAddress:    *listenAddress,
+		FrontendPath:          *frontendPath,
+		SessionID:             sessionID,
+		AllowTunneling:        *allowTunneling,
+		AllowReverseTunneling: *allowReverseTunneling,
+		TunnelPolicy:          tunnelPolicy,
+		TunnelUsers:           tunnelUsersList,
+		CrossOrigin:           *crossOrgin,
+		BaseUrlPath:           sanitizedBaseUrlPath,
+		WinSizePolicy:         winSizePolicy,
+		FixedCols:             fixedCols,
+		FixedRows:             fixedRows,
+		UploadDir:             *uploadDir,
+		OfferedFiles:          offeredFiles,
+		MaxFileSize:           maxFileSizeBytes,
+		FileUsers:             fileUsersList,
+		AuditLog:              auditLog,
+		ClipboardPush:         *allowClipboardPush,
+		IdleTimeout:           *idleTimeout,
+		MaxDuration:           *maxDuration,
+		ExpiresAt:             expiresAtTime,
+		ViewerIdleTimeout:     *viewerIdleTimeout,
+		MaxParticipants:       *maxParticipants,
+		ReadOnly:              *readOnly,
+		OutputBatchDelay:      *outputBatchDelay,
+		OutputBatchSize:       int(outputBatchBytes),
+		CompressionLevel:      *compressionLevel,
+		CompressionThreshold:  int(compressionThresholdBytes),
+		NoTunnelCompression:   *noTunnelCompression,
+		Version:               version,
+	}
+
+	if *pipe {
+		cols, rows := *headlessCols, *headlessRows
+		if fixedCols > 0 && fixedRows > 0 {
+			cols, rows = fixedCols, fixedRows
+		}
+		config.WinSizePolicy = server.WinSizePolicySharer
+		config.Scrollback = int(scrollbackBytes)
+		if publicURL != "" {
+			fmt.Printf("public session: %s\n", publicURL)
+		}
+		fmt.Printf("local session: %s\n", localURL)
+		runPipe(config, os.Stdin, cols, rows, controlListener, joinURLs)
 		return
 	}
 
+	command, commandArguments := *commandName, strings.Fields(*commandArgs)
+	if *tmuxTarget != "" || *screenName != "" {
+		var err error
+		if *tmuxTarget != "" && *screenName != "" {
+			fmt.Printf("Only one of --tmux and --screen can be used\n")
+			os.Exit(1)
+		}
+		// The command is the tmux or screen client, so the one given would be ignored
+		commandGiven := false
+		flag.Visit(func(f *flag.Flag) {
+			commandGiven = commandGiven || f.Name == "command" || f.Name == "args"
+		})
+		if commandGiven {
+			fmt.Printf("--command and --args can't be used with --tmux or --screen\n")
+			os.Exit(1)
+		}
+		if *tmuxTarget != "" {
+			if !tmuxSupportsClientFlags() {
+				fmt.Printf("Warning: tmux is older than 3.2, so the participants resize your own tmux client too, and the pane they attach to becomes the active one for you\n")
+			}
+			command, commandArguments, err = tmuxAttachCommand(*tmuxTarget)
+		} else {
+			command, commandArguments, err = screenAttachCommand(*screenName)
+		}
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}
+		envVars = multiplexerEnv(envVars)
+	}
+
+	ptyMaster := ptyMasterNew(*headless, *headlessCols, *headlessRows)
+	if *devicePath != "" {
+		dev, err := openDevice(*devicePath, *baudRate, deviceMode)
+		if err != nil {
+			log.Errorf("Cannot open the %s device: %s", *devicePath, err.Error())
+			fmt.Printf("Cannot open the %s device: %s\n", *devicePath, err.Error())
+			return
+		}
+		ptyMaster.StartDevice(dev)
+		// There's no application to redraw the device for the new participants
+		config.Scrollback = int(scrollbackBytes)
+	} else {
+		err = ptyMaster.Start(command, commandArguments, envVars)
+		if err != nil {
+			log.Errorf("Cannot start the %s command: %s", command, err.Error())
+			return
+		}
+	}
+
+	if *tmuxTarget != "" {
+		go watchTmuxTarget(*tmuxTarget, func() {
+			log.Debugf("The tmux target %s is gone", *tmuxTarget)
+			ptyMaster.Stop()
+		})
+	}
+
 	// Display the session information to the user, before showing any output from the command.
 	// Wait until the user presses Enter
 	if publicURL != "" {
 		fmt.Printf("public session: %s\n", publicURL)
 	}
 
-	// Ensure the base URL path does not end with a forward slash,
-	// and that there are no excessive forward slashes at the beginning.
-	// A base URL of "/" will be trimmed to an empty string.
-	sanitizedBaseUrlPath := strings.Trim(*baseUrlPath, "/")
-	if sanitizedBaseUrlPath != "" {
-		sanitizedBaseUrlPath = "/" + sanitizedBaseUrlPath
-	}
-
-	fmt.Printf("local session: http://%s%s/s/local/\n", *listenAddress, sanitizedBaseUrlPath)
+	fmt.Printf("local session: %s\n", localURL)
 
 	if !*noWaitEnter && !*headless {
 		fmt.Printf("Press Enter to continue!\n")
@@ -204,12 +548,69 @@ Flags:
 
 	ptyMaster.MakeRaw()
 	defer stopPtyAndRestore()
-	var pty server.PTYHandler = ptyMaster
-	if *readOnly {
-		pty = &nilPTY{}
+
+	ui := &hostUI{
+		pty:          ptyMaster,
+		out:          os.Stdout,
+		hostKey:      hostKeyByte,
+		hostKeyName:  *hostKey,
+		pauseKey:     pauseKeyByte,
+		pauseKeyName: *pauseKey,
+		size:         ptyMaster.GetWinSize,
+		refresh:      ptyMaster.Refresh,
+		urls:         joinURLs,
+		end:          func() { ptyMaster.Stop() },
+	}
+	// The warnings about the end of the session are shown to the sharer over the application, or
+	// only logged when running headless
+	onWarning := func(text string) {
+		log.Warnf("%s", text)
+	}
+	onPause := func(paused bool) {
+		log.Warnf("Paused sharing: %t", paused)
+	}
+	if !*headless {
+		onWarning = ui.Notify
+		onPause = ui.OnPause
+	}
+	// Set from the goroutines ending the session, e.g.: the lifetime watcher, or the control socket
+	var endMutex sync.Mutex
+	endReason := ""
+	onEnd := func(reason string) {
+		endMutex.Lock()
+		endReason = reason
+		endMutex.Unlock()
+		ptyMaster.Stop()
 	}
 
-	server := createServer(*listenAddress, *frontendPath, pty, sessionID, *allowTunneling, *crossOrgin, sanitizedBaseUrlPath)
+	if *approveJoins {
+		config.JoinApprover = ui.ApproveJoin
+	}
+	if *tunnelApprove {
+		config.TunnelApprover = ui.Approve
+	}
+	if *uploadApprove {
+		config.FileApprover = ui.Approve
+	}
+	config.PTY = ptyMaster
+	config.PTYResizer = ptyMaster
+	config.OnWarning = onWarning
+	config.OnEnd = onEnd
+	config.OnPause = onPause
+
+	server := ttyServer.NewTTYServer(config)
+	ui.server = server
+	if controlListener != nil {
+		go serveControlSocket(controlListener, &ControlService{
+			server:    server,
+			pty:       ptyMaster,
+			urls:      joinURLs,
+			startedAt: time.Now(),
+			stop: func() {
+				onEnd("stopped with tty-share ctl")
+			},
+		})
+	}
 	if cols, rows, e := ptyMaster.GetWinSize(); e == nil {
 		server.WindowSize(cols, rows)
 	}
@@ -222,7 +623,7 @@ Flags:
 	var mw io.Writer
 	mw = server
 	if !*headless {
-		mw = io.MultiWriter(os.Stdout, server)
+		mw = io.MultiWriter(ui.Output(), server)
 	}
 
 	go func() {
@@ -242,7 +643,7 @@ Flags:
 
 	if !*headless {
 		go func() {
-			_, err := io.Copy(ptyMaster, os.Stdin)
+			_, err := io.Copy(ui, os.Stdin)
 			if err != nil {
 				stopPtyAndRestore()
 			}
@@ -250,6 +651,14 @@ Flags:
 	}
 
 	ptyMaster.Wait()
+	endMutex.Lock()
+	if endReason != "" {
+		fmt.Printf("\n\rThe session ended (%s)\n\r", endReason)
+	}
+	endMutex.Unlock()
 	fmt.Printf("tty-share finished\n\n\r")
-	server.Stop()
+	// Let the file transfers in progress finish, for a while
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	server.Shutdown(ctx)
 }
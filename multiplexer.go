@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sharing an existing tmux or screen session works by starting, inside the tty-share pty, a
+// dedicated client attached to that session. The remote participants see (and drive) that client,
+// while the sharer keeps using their own client, undisturbed.
+
+var tmuxVersionRegexp = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+// tmuxAttachCommand builds the command used to attach a new tmux client to the given target, which
+// can be anything tmux accepts as a target: a session, a window or a pane.
+func tmuxAttachCommand(target string) (string, []string, error) {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		return "", nil, fmt.Errorf("cannot find tmux: %w", err)
+	}
+
+	if err := tmuxTargetExists(target); err != nil {
+		return "", nil, err
+	}
+
+	args := append(tmuxSocketArgs(), "attach-session")
+	if tmuxSupportsClientFlags() {
+		// ignore-size: our client doesn't take part in deciding the size of the tmux windows, so
+		// the sharer's own client is never resized because of the tty-share pty.
+		// active-pane: our client has its own active pane, so attaching to a pane target doesn't
+		// change the pane the sharer is looking at.
+		args = append(args, "-f", "ignore-size,active-pane")
+	}
+	args = append(args, "-t", target)
+
+	return "tmux", args, nil
+}
+
+// tmuxTargetExists returns an error if tmux can't resolve the given target (e.g.: the session was
+// killed, or the pane was closed)
+func tmuxTargetExists(target string) error {
+	out, err := exec.Command("tmux", append(tmuxSocketArgs(), "has-session", "-t", target)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot find the tmux target %s: %s", target, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// When tty-share runs inside tmux, $TMUX points to the socket of that tmux server. We remove $TMUX
+// from the environment of the attached client (see multiplexerEnv), so pass the socket explicitly,
+// to make sure we attach to the same tmux server the sharer is using.
+func tmuxSocketArgs() []string {
+	if socket := strings.Split(os.Getenv("TMUX"), ",")[0]; socket != "" {
+		return []string{"-S", socket}
+	}
+	return nil
+}
+
+// Client flags (attach-session -f) are supported only starting with tmux 3.2
+func tmuxSupportsClientFlags() bool {
+	out, err := exec.Command("tmux", "-V").Output()
+	if err != nil {
+		return false
+	}
+
+	m := tmuxVersionRegexp.FindStringSubmatch(string(out))
+	if m == nil {
+		// Development builds report "tmux master" or "tmux next-x.y". Assume they are new enough
+		return true
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major > 3 || (major == 3 && minor >= 2)
+}
+
+// watchTmuxTarget polls tmux and calls onGone once the target disappears. When the target is a
+// whole session, our client exits by itself when the session ends, but that's not the case for
+// windows or panes, so we need to watch for those.
+func watchTmuxTarget(target string, onGone func()) {
+	for {
+		time.Sleep(time.Second)
+		if err := tmuxTargetExists(target); err != nil {
+			onGone()
+			return
+		}
+	}
+}
+
+// screenAttachCommand builds the command used to attach to an existing screen session, in
+// multi-display mode, so the sharer's own display is not detached
+func screenAttachCommand(name string) (string, []string, error) {
+	if _, err := exec.LookPath("screen"); err != nil {
+		return "", nil, fmt.Errorf("cannot find screen: %w", err)
+	}
+	return "screen", []string{"-x", name}, nil
+}
+
+// multiplexerEnv removes from the environment the variables tmux and screen use to detect they run
+// nested inside one of their own sessions. Otherwise they refuse to attach, when tty-share itself
+// was started from inside tmux or screen.
+func multiplexerEnv(envVars []string) (env []string) {
+	for _, v := range envVars {
+		if strings.HasPrefix(v, "TMUX=") || strings.HasPrefix(v, "STY=") {
+			continue
+		}
+		env = append(env, v)
+	}
+	return
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	ttyServer "github.com/elisescu/tty-share/server"
+	log "github.com/sirupsen/logrus"
+)
+
+var errPipeInput = errors.New("there's no application to type in, when sharing a pipe")
+
+// The PTYHandler of the --pipe sessions: there's no application to type in, or to redraw
+type pipeInput struct{}
+
+func (pipeInput) Write(data []byte) (int, error) {
+	return 0, errPipeInput
+}
+
+func (pipeInput) Refresh() {
+}
+
+// Turns the line feeds which don't follow a carriage return into CRLF, as the pty of a command
+// would do, so the lines of the shared output start at the first column
+type crlfWriter struct {
+	w      io.Writer
+	lastCR bool
+}
+
+func (cw *crlfWriter) Write(data []byte) (int, error) {
+	out := make([]byte, 0, len(data)+len(data)/16)
+	for _, b := range data {
+		if b == '\n' && !cw.lastCR {
+			out = append(out, '\r')
+		}
+		out = append(out, b)
+		cw.lastCR = b == '\r'
+	}
+	if _, err := cw.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Shares what is read from the input, e.g.: the output of another command, in a read only
+// session of the given size, until the input ends, or the session ends. The participants who join
+// later get the scrollback of the output
+func runPipe(config ttyServer.TTYServerConfig, input io.Reader, cols, rows int, controlListener net.Listener, urls []string) {
+	var endOnce sync.Once
+	ended := make(chan struct{})
+	endReason := ""
+	end := func(reason string) {
+		endOnce.Do(func() {
+			endReason = reason
+			close(ended)
+		})
+	}
+
+	config.PTY = pipeInput{}
+	config.ReadOnly = true
+	config.OnWarning = func(text string) {
+		log.Warnf("%s", text)
+	}
+	config.OnEnd = end
+	config.OnPause = func(paused bool) {
+		log.Warnf("Paused sharing: %t", paused)
+	}
+	server := ttyServer.NewTTYServer(config)
+	server.WindowSize(cols, rows)
+
+	if controlListener != nil {
+		go serveControlSocket(controlListener, &ControlService{
+			server:    server,
+			pty:       pipeInput{},
+			urls:      urls,
+			startedAt: time.Now(),
+			stop: func() {
+				end("stopped with tty-share ctl")
+			},
+		})
+	}
+
+	go func() {
+		err := server.Run()
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("Server finished: %s", err.Error())
+			end(fmt.Sprintf("the server failed: %s", err.Error()))
+		}
+	}()
+
+	go func() {
+		_, err := io.Copy(&crlfWriter{w: server}, input)
+		if err != nil {
+			log.Errorf("Cannot read the shared input: %s", err.Error())
+		}
+		end("")
+	}()
+
+	<-ended
+	if endReason != "" {
+		fmt.Printf("The session ended (%s)\n", endReason)
+	}
+	fmt.Printf("tty-share finished\n")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	server.Shutdown(ctx)
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCRLFWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &crlfWriter{w: &out}
+	for _, data := range []string{"one\ntwo\r\n", "three\r", "\nfour\n\n"} {
+		if n, err := w.Write([]byte(data)); err != nil || n != len(data) {
+			t.Fatalf("unexpected write: %d %v", n, err)
+		}
+	}
+	if expected := "one\r\ntwo\r\nthree\r\nfour\r\n\r\n"; out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+}
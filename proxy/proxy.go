@@ -1,11 +1,13 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"io"
 	"net"
+	"time"
 
 	"github.com/hashicorp/yamux"
 	log "github.com/sirupsen/logrus"
@@ -23,19 +25,29 @@ type HelloServer struct {
 	Data      string
 }
 
-type proxyConnection struct {
+// Connection is the connection to a tty-proxy server, which makes the local session public. The
+// connections the proxy gets for the session are forwarded to the local server
+type Connection struct {
 	muxSession      *yamux.Session
 	backConnAddress string
 	SessionID       string
 	PublicURL       string
 }
 
-func NewProxyConnection(backConnAddrr, proxyAddr string, noTLS bool) (*proxyConnection, error) {
+// NewProxyConnection connects to the tty-proxy server at proxyAddr, which forwards the connections
+// to the local server at backConnAddrr
+func NewProxyConnection(backConnAddrr, proxyAddr string, noTLS bool) (*Connection, error) {
+	return Connect(context.Background(), backConnAddrr, proxyAddr, noTLS)
+}
+
+// Connect is like NewProxyConnection, but the context can cancel the connection while it's made
+func Connect(ctx context.Context, backConnAddrr, proxyAddr string, noTLS bool) (*Connection, error) {
 	var conn net.Conn
 	var err error
 
+	dialer := &net.Dialer{}
 	if noTLS {
-		conn, err = net.Dial("tcp", proxyAddr)
+		conn, err = dialer.DialContext(ctx, "tcp", proxyAddr)
 		if err != nil {
 			return nil, err
 		}
@@ -44,12 +56,27 @@ func NewProxyConnection(backConnAddrr, proxyAddr string, noTLS bool) (*proxyConn
 		if err != nil {
 			return nil, err
 		}
-		conn, err = tls.Dial("tcp", proxyAddr, &tls.Config{RootCAs: roots})
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{RootCAs: roots}}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", proxyAddr)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	// The hello messages are exchanged while the context is alive
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	helloDone := make(chan struct{})
+	defer close(helloDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-helloDone:
+		}
+	}()
+
 	// C -> S: HelloCLient
 	// S -> C: HelloServer {sesionID}
 	je := json.NewEncoder(conn)
@@ -71,9 +98,10 @@ func NewProxyConnection(backConnAddrr, proxyAddr string, noTLS bool) (*proxyConn
 	}
 
 	log.Debugf("Connected to %s tty-proxy: version=%s, sessionID=%s", helloS.PublicURL, helloS.Version, helloS.SessionID)
+	conn.SetDeadline(time.Time{})
 	session, err := yamux.Server(conn, nil)
 
-	return &proxyConnection{
+	return &Connection{
 		muxSession:      session,
 		backConnAddress: backConnAddrr,
 		SessionID:       helloS.SessionID,
@@ -81,7 +109,7 @@ func NewProxyConnection(backConnAddrr, proxyAddr string, noTLS bool) (*proxyConn
 	}, nil
 }
 
-func (p *proxyConnection) RunProxy() {
+func (p *Connection) RunProxy() {
 	for {
 		frontConn, err := p.muxSession.Accept()
 		if err != nil {
@@ -104,7 +132,7 @@ func (p *proxyConnection) RunProxy() {
 	}
 }
 
-func (p *proxyConnection) Stop() {
+func (p *Connection) Stop() {
 	p.muxSession.Close()
 }
 
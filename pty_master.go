@@ -5,9 +5,8 @@ import (
 	"os/exec"
 	"os/signal"
 	"syscall"
-	"time"
 
-	ptyDevice "github.com/creack/pty"
+	"github.com/elisescu/tty-share/share"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -17,12 +16,14 @@ type onWindowChangedCB func(int, int)
 // This defines a PTY Master whih will encapsulate the command we want to run, and provide simple
 // access to the command, to write and read IO, but also to control the window size.
 type ptyMaster struct {
-	ptyFile           *os.File
-	command           *exec.Cmd
+	// The command, running in its own pty
+	process           *share.Process
 	terminalInitState *terminal.State
 	headless          bool
 	headlessCols      int
 	headlessRows      int
+	// Shared instead of the command, if set (see StartDevice)
+	device *device
 }
 
 func ptyMasterNew(headless bool, headlessCols, headlessRows int) *ptyMaster {
@@ -33,24 +34,28 @@ func isStdinTerminal() bool {
 	return terminal.IsTerminal(0)
 }
 
-func (pty *ptyMaster) Start(command string, args []string, envVars []string) (err error) {
-	pty.command = exec.Command(command, args...)
-	pty.command.Env = envVars
-	pty.ptyFile, err = ptyDevice.Start(pty.command)
-
+func (pty *ptyMaster) Start(command string, args []string, envVars []string) error {
+	cols, rows, err := pty.GetWinSize()
 	if err != nil {
-		return
+		return err
 	}
 
-	// Set the initial window size
-	cols, rows := pty.headlessCols, pty.headlessRows
+	cmd := exec.Command(command, args...)
+	cmd.Env = envVars
+	pty.process, err = share.StartProcess(cmd, cols, rows)
+	return err
+}
 
-	if !pty.headless {
-		cols, rows, err = terminal.GetSize(0)
-	}
+// StartDevice shares the device, e.g.: a serial port, instead of starting a command
+func (pty *ptyMaster) StartDevice(dev *device) error {
+	pty.device = dev
 
+	cols, rows, err := pty.GetWinSize()
+	if err != nil {
+		return err
+	}
 	pty.SetWinSize(rows, cols)
-	return
+	return nil
 }
 
 func (pty *ptyMaster) MakeRaw() (err error) {
@@ -73,14 +78,9 @@ func (pty *ptyMaster) MakeRaw() (err error) {
 func (pty *ptyMaster) SetWinChangeCB(winChangedCB onWindowChangedCB) {
 	// Start listening for window changes if not running headless
 	if !pty.headless {
-		go onWindowChanges(func(cols, rows int) {
-			// TODO:policy: should the server decide here if we care about the size and set it
-			// right here?
-			pty.SetWinSize(rows, cols)
-
-			// Notify the ptyMaster user of the window changes, to be sent to the remote side
-			winChangedCB(cols, rows)
-		})
+		// The pty itself is not resized here: the server decides the size of the shared terminal,
+		// according to its window size policy
+		go onWindowChanges(winChangedCB)
 	}
 }
 
@@ -93,41 +93,41 @@ func (pty *ptyMaster) GetWinSize() (int, int, error) {
 }
 
 func (pty *ptyMaster) Write(b []byte) (int, error) {
-	return pty.ptyFile.Write(b)
+	if pty.device != nil {
+		return pty.device.Write(b)
+	}
+	return pty.process.Write(b)
 }
 
 func (pty *ptyMaster) Read(b []byte) (int, error) {
-	return pty.ptyFile.Read(b)
+	if pty.device != nil {
+		return pty.device.Read(b)
+	}
+	return pty.process.Read(b)
 }
 
 func (pty *ptyMaster) SetWinSize(rows, cols int) {
-	winSize := ptyDevice.Winsize{
-		Rows: uint16(rows),
-		Cols: uint16(cols),
+	if pty.device != nil {
+		pty.device.SetWinSize(rows, cols)
+		return
 	}
-	ptyDevice.Setsize(pty.ptyFile, &winSize)
+	pty.process.SetWinSize(rows, cols)
 }
 
+// Refresh makes the application redraw itself. A device has no application to redraw: the
+// participants get the scrollback of the session instead
 func (pty *ptyMaster) Refresh() {
-	// We wanna force the app to re-draw itself, but there doesn't seem to be a way to do that
-	// so we fake it by resizing the window quickly, making it smaller and then back big
-	cols, rows, err := pty.GetWinSize()
-
-	if err != nil {
-		return
+	if pty.device == nil {
+		pty.process.Refresh()
 	}
-
-	pty.SetWinSize(rows-1, cols)
-
-	go func() {
-		time.Sleep(time.Millisecond * 50)
-		pty.SetWinSize(rows, cols)
-	}()
 }
 
 func (pty *ptyMaster) Wait() (err error) {
-	err = pty.command.Wait()
-	return
+	if pty.device != nil {
+		<-pty.device.done
+		return nil
+	}
+	return pty.process.Wait()
 }
 
 func (pty *ptyMaster) Restore() {
@@ -139,13 +139,11 @@ func (pty *ptyMaster) Restore() {
 
 func (pty *ptyMaster) Stop() (err error) {
 	signal.Ignore(syscall.SIGWINCH)
-
-	pty.command.Process.Signal(syscall.SIGTERM)
-	// TODO: Find a proper wai to close the running command. Perhaps have a timeout after which,
-	// if the command hasn't reacted to SIGTERM, then send a SIGKILL
-	// (bash for example doesn't finish if only a SIGTERM has been sent)
-	pty.command.Process.Signal(syscall.SIGKILL)
-	return
+	if pty.device != nil {
+		return pty.device.Close()
+	}
+	pty.process.Stop()
+	return nil
 }
 
 func onWindowChanges(wcCB onWindowChangedCB) {
@@ -0,0 +1,750 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A minimal model of a VT100/xterm screen. It is fed the same output the remote terminal
+// application writes, and keeps track of what's displayed on the remote screen, so parts of it
+// can be rendered later (e.g.: into a viewport smaller than the remote window). It implements only
+// what terminal applications commonly use: cursor movement, erasing, scrolling regions, insert and
+// delete of chars and lines, colors and attributes, and the alternate screen.
+
+const (
+	attrBold = 1 << iota
+	attrDim
+	attrItalic
+	attrUnderline
+	attrBlink
+	attrReverse
+	attrHidden
+	attrStrike
+)
+
+// termColor encodes the default color (0), a palette color, or a 24 bit RGB color
+type termColor uint32
+
+const (
+	colorPalette termColor = 1 << 24
+	colorRGB     termColor = 2 << 24
+)
+
+type cellStyle struct {
+	fg    termColor
+	bg    termColor
+	attrs uint8
+}
+
+type cell struct {
+	// 0 for the second half of a wide char
+	r     rune
+	style cellStyle
+}
+
+type cursorState struct {
+	x, y    int
+	style   cellStyle
+	charset byte
+}
+
+// The states of the escape sequences parser
+const (
+	stateGround = iota
+	stateEscape
+	stateCharset
+	stateSkipByte
+	stateCSI
+	stateOSC
+	stateString
+	stateStringEscape
+)
+
+type screenModel struct {
+	cols, rows int
+	lines      [][]cell
+	mainLines  [][]cell
+	altActive  bool
+
+	cursor        cursorState
+	savedCursor   cursorState
+	wrapPending   bool
+	cursorVisible bool
+	autoWrap      bool
+	scrollTop     int
+	scrollBottom  int
+	lastRune      rune
+
+	state   int
+	params  []byte
+	utf8Buf []byte
+}
+
+func newScreenModel(cols, rows int) *screenModel {
+	s := &screenModel{}
+	s.reset(cols, rows)
+	return s
+}
+
+func (s *screenModel) reset(cols, rows int) {
+	*s = screenModel{
+		cols:          cols,
+		rows:          rows,
+		lines:         newLines(cols, rows, cellStyle{}),
+		cursorVisible: true,
+		autoWrap:      true,
+		scrollBottom:  rows - 1,
+		cursor:        cursorState{charset: 'B'},
+	}
+	s.savedCursor = s.cursor
+}
+
+func newLines(cols, rows int, style cellStyle) [][]cell {
+	lines := make([][]cell, rows)
+	for i := range lines {
+		lines[i] = newLine(cols, style)
+	}
+	return lines
+}
+
+func newLine(cols int, style cellStyle) []cell {
+	line := make([]cell, cols)
+	for i := range line {
+		line[i] = cell{r: ' ', style: style}
+	}
+	return line
+}
+
+// Resize changes the size of the screen, keeping the content at the top-left corner
+func (s *screenModel) Resize(cols, rows int) {
+	if cols <= 0 || rows <= 0 || (cols == s.cols && rows == s.rows) {
+		return
+	}
+
+	resizeLines := func(lines [][]cell) [][]cell {
+		if lines == nil {
+			return nil
+		}
+		// When the screen gets shorter, terminals drop the lines at the top
+		if len(lines) > rows {
+			lines = lines[len(lines)-rows:]
+		}
+		newLines := make([][]cell, rows)
+		for y := range newLines {
+			newLines[y] = newLine(cols, cellStyle{})
+			if y < len(lines) {
+				copy(newLines[y], lines[y])
+			}
+		}
+		return newLines
+	}
+
+	// The cursors follow the lines they are on
+	for _, cursor := range []*cursorState{&s.cursor, &s.savedCursor} {
+		if s.rows > rows && cursor.y >= rows {
+			cursor.y -= s.rows - rows
+		}
+	}
+	s.lines = resizeLines(s.lines)
+	s.mainLines = resizeLines(s.mainLines)
+	s.cols, s.rows = cols, rows
+	s.scrollTop, s.scrollBottom = 0, rows-1
+	s.wrapPending = false
+	s.cursor.x, s.cursor.y = s.clampX(s.cursor.x), s.clampY(s.cursor.y)
+	s.savedCursor.x, s.savedCursor.y = s.clampX(s.savedCursor.x), s.clampY(s.savedCursor.y)
+}
+
+// Moves the cursor back where it was saved, within the screen, in case it got smaller since
+func (s *screenModel) restoreCursor() {
+	s.cursor = s.savedCursor
+	s.cursor.x, s.cursor.y = s.clampX(s.cursor.x), s.clampY(s.cursor.y)
+	s.wrapPending = false
+}
+
+func (s *screenModel) Size() (cols, rows int) {
+	return s.cols, s.rows
+}
+
+// Cursor returns the position of the cursor, and whether it is visible
+func (s *screenModel) Cursor() (x, y int, visible bool) {
+	return s.cursor.x, s.cursor.y, s.cursorVisible
+}
+
+func (s *screenModel) clampX(x int) int {
+	if x < 0 {
+		return 0
+	}
+	if x >= s.cols {
+		return s.cols - 1
+	}
+	return x
+}
+
+func (s *screenModel) clampY(y int) int {
+	if y < 0 {
+		return 0
+	}
+	if y >= s.rows {
+		return s.rows - 1
+	}
+	return y
+}
+
+func (s *screenModel) Write(data []byte) (int, error) {
+	for _, b := range data {
+		s.feed(b)
+	}
+	return len(data), nil
+}
+
+func (s *screenModel) feed(b byte) {
+	switch s.state {
+	case stateGround:
+		s.ground(b)
+	case stateEscape:
+		s.escape(b)
+	case stateCharset:
+		s.cursor.charset = b
+		s.state = stateGround
+	case stateSkipByte:
+		s.state = stateGround
+	case stateCSI:
+		if b >= 0x40 && b <= 0x7e {
+			s.csi(b)
+			s.state = stateGround
+		} else if b == 0x1b {
+			s.state = stateEscape
+		} else if len(s.params) < 64 {
+			s.params = append(s.params, b)
+		}
+	case stateOSC, stateString:
+		// OSC sequences (window title, clipboard, etc.) don't change the screen, and are ignored
+		if b == 0x07 && s.state == stateOSC {
+			s.state = stateGround
+		} else if b == 0x1b {
+			s.state = stateStringEscape
+		}
+	case stateStringEscape:
+		// ESC \ terminates the string. Anything else is a new escape sequence
+		s.state = stateGround
+		if b != '\\' {
+			s.escape(b)
+		}
+	}
+}
+
+func (s *screenModel) ground(b byte) {
+	if len(s.utf8Buf) > 0 || b >= 0x80 {
+		s.utf8Buf = append(s.utf8Buf, b)
+		if utf8.FullRune(s.utf8Buf) {
+			r, _ := utf8.DecodeRune(s.utf8Buf)
+			s.utf8Buf = s.utf8Buf[:0]
+			s.put(r)
+		}
+		return
+	}
+
+	switch b {
+	case 0x1b:
+		s.state = stateEscape
+	case '\r':
+		s.cursor.x = 0
+		s.wrapPending = false
+	case '\n', '\v', '\f':
+		s.lineFeed()
+	case '\b':
+		if s.cursor.x > 0 {
+			s.cursor.x--
+		}
+		s.wrapPending = false
+	case '\t':
+		s.cursor.x = s.clampX((s.cursor.x/8 + 1) * 8)
+		s.wrapPending = false
+	default:
+		if b >= 0x20 && b < 0x7f {
+			r := rune(b)
+			if s.cursor.charset == '0' {
+				r = decSpecialGraphics(r)
+			}
+			s.put(r)
+		}
+	}
+}
+
+func (s *screenModel) escape(b byte) {
+	s.state = stateGround
+	switch b {
+	case '[':
+		s.state = stateCSI
+		s.params = s.params[:0]
+	case ']':
+		s.state = stateOSC
+	case 'P', 'X', '^', '_':
+		s.state = stateString
+	case '(':
+		s.state = stateCharset
+	case ')', '*', '+', '#', ' ', '%':
+		// Designating the other charsets, and other sequences with one more byte, are ignored
+		s.state = stateSkipByte
+	case '7':
+		s.savedCursor = s.cursor
+	case '8':
+		s.restoreCursor()
+	case 'D':
+		s.lineFeed()
+	case 'E':
+		s.cursor.x = 0
+		s.lineFeed()
+	case 'M':
+		s.reverseIndex()
+	case 'c':
+		s.reset(s.cols, s.rows)
+	}
+}
+
+func (s *screenModel) put(r rune) {
+	width := runeWidth(r)
+	if width == 0 {
+		return
+	}
+	if width == 2 && s.cols < 2 {
+		// Doesn't fit anywhere, so it takes one column
+		width = 1
+	}
+
+	if s.wrapPending {
+		s.cursor.x = 0
+		s.lineFeed()
+	}
+	if width == 2 && s.cursor.x == s.cols-1 {
+		// A wide char doesn't fit on the last column, so it goes to the next line
+		if s.autoWrap {
+			s.lines[s.cursor.y][s.cursor.x] = cell{r: ' ', style: s.cursor.style}
+			s.cursor.x = 0
+			s.lineFeed()
+		} else {
+			return
+		}
+	}
+
+	line := s.lines[s.cursor.y]
+	line[s.cursor.x] = cell{r: r, style: s.cursor.style}
+	if width == 2 {
+		line[s.cursor.x+1] = cell{r: 0, style: s.cursor.style}
+	}
+	s.lastRune = r
+
+	if s.cursor.x+width >= s.cols {
+		s.cursor.x = s.cols - 1
+		s.wrapPending = s.autoWrap
+	} else {
+		s.cursor.x += width
+	}
+}
+
+func (s *screenModel) lineFeed() {
+	s.wrapPending = false
+	if s.cursor.y == s.scrollBottom {
+		s.scrollUp(s.scrollTop, s.scrollBottom, 1)
+	} else if s.cursor.y < s.rows-1 {
+		s.cursor.y++
+	}
+}
+
+func (s *screenModel) reverseIndex() {
+	s.wrapPending = false
+	if s.cursor.y == s.scrollTop {
+		s.scrollDown(s.scrollTop, s.scrollBottom, 1)
+	} else if s.cursor.y > 0 {
+		s.cursor.y--
+	}
+}
+
+func (s *screenModel) blankStyle() cellStyle {
+	return cellStyle{bg: s.cursor.style.bg}
+}
+
+// Scrolls the lines between top and bottom (inclusive) up by n lines
+func (s *screenModel) scrollUp(top, bottom, n int) {
+	for i := 0; i < n; i++ {
+		copy(s.lines[top:bottom+1], s.lines[top+1:bottom+1])
+		s.lines[bottom] = newLine(s.cols, s.blankStyle())
+	}
+}
+
+// Scrolls the lines between top and bottom (inclusive) down by n lines
+func (s *screenModel) scrollDown(top, bottom, n int) {
+	for i := 0; i < n; i++ {
+		copy(s.lines[top+1:bottom+1], s.lines[top:bottom])
+		s.lines[top] = newLine(s.cols, s.blankStyle())
+	}
+}
+
+func (s *screenModel) eraseCells(y, from, to int) {
+	line := s.lines[y]
+	for x := from; x < to && x < s.cols; x++ {
+		line[x] = cell{r: ' ', style: s.blankStyle()}
+	}
+}
+
+func (s *screenModel) setAltScreen(on bool) {
+	if on == s.altActive {
+		return
+	}
+	s.altActive = on
+	if on {
+		s.mainLines = s.lines
+		s.lines = newLines(s.cols, s.rows, cellStyle{})
+	} else {
+		s.lines = s.mainLines
+		s.mainLines = nil
+	}
+}
+
+func (s *screenModel) csi(final byte) {
+	private := byte(0)
+	params := s.params
+	if len(params) > 0 && (params[0] == '?' || params[0] == '>' || params[0] == '=' || params[0] == '<') {
+		private = params[0]
+		params = params[1:]
+	}
+
+	// Parse the numeric params. Missing params are 0, and param(i, def) returns def for those, and
+	// for the negative ones, which no sequence takes
+	var args []int
+	for _, p := range strings.Split(string(params), ";") {
+		// Sub-params (e.g.: 38:2:r:g:b) are treated as separate params
+		for _, sp := range strings.Split(p, ":") {
+			n, _ := strconv.Atoi(sp)
+			args = append(args, n)
+		}
+	}
+	param := func(i, def int) int {
+		if i < len(args) && args[i] > 0 {
+			return args[i]
+		}
+		return def
+	}
+
+	if private == '?' {
+		if final == 'h' || final == 'l' {
+			s.setPrivateModes(args, final == 'h')
+		}
+		return
+	}
+	if private != 0 {
+		return
+	}
+
+	c := &s.cursor
+	if final != 'b' {
+		s.wrapPending = false
+	}
+
+	switch final {
+	case '@':
+		n := param(0, 1)
+		line := s.lines[c.y]
+		if n > s.cols-c.x {
+			n = s.cols - c.x
+		}
+		copy(line[c.x+n:], line[c.x:])
+		s.eraseCells(c.y, c.x, c.x+n)
+	case 'A':
+		c.y = s.clampY(c.y - param(0, 1))
+	case 'B', 'e':
+		c.y = s.clampY(c.y + param(0, 1))
+	case 'C', 'a':
+		c.x = s.clampX(c.x + param(0, 1))
+	case 'D':
+		c.x = s.clampX(c.x - param(0, 1))
+	case 'E':
+		c.x, c.y = 0, s.clampY(c.y+param(0, 1))
+	case 'F':
+		c.x, c.y = 0, s.clampY(c.y-param(0, 1))
+	case 'G', '`':
+		c.x = s.clampX(param(0, 1) - 1)
+	case 'H', 'f':
+		c.x, c.y = s.clampX(param(1, 1)-1), s.clampY(param(0, 1)-1)
+	case 'd':
+		c.y = s.clampY(param(0, 1) - 1)
+	case 'J':
+		switch param(0, 0) {
+		case 0:
+			s.eraseCells(c.y, c.x, s.cols)
+			for y := c.y + 1; y < s.rows; y++ {
+				s.eraseCells(y, 0, s.cols)
+			}
+		case 1:
+			s.eraseCells(c.y, 0, c.x+1)
+			for y := 0; y < c.y; y++ {
+				s.eraseCells(y, 0, s.cols)
+			}
+		case 2, 3:
+			for y := 0; y < s.rows; y++ {
+				s.eraseCells(y, 0, s.cols)
+			}
+		}
+	case 'K':
+		switch param(0, 0) {
+		case 0:
+			s.eraseCells(c.y, c.x, s.cols)
+		case 1:
+			s.eraseCells(c.y, 0, c.x+1)
+		case 2:
+			s.eraseCells(c.y, 0, s.cols)
+		}
+	case 'L', 'M':
+		if c.y < s.scrollTop || c.y > s.scrollBottom {
+			return
+		}
+		n := param(0, 1)
+		if n > s.scrollBottom-c.y+1 {
+			n = s.scrollBottom - c.y + 1
+		}
+		if final == 'L' {
+			s.scrollDown(c.y, s.scrollBottom, n)
+		} else {
+			s.scrollUp(c.y, s.scrollBottom, n)
+		}
+		c.x = 0
+	case 'P':
+		n := param(0, 1)
+		line := s.lines[c.y]
+		if n > s.cols-c.x {
+			n = s.cols - c.x
+		}
+		copy(line[c.x:], line[c.x+n:])
+		s.eraseCells(c.y, s.cols-n, s.cols)
+	case 'S', 'T':
+		// Scrolling more than the region only blanks it
+		n := param(0, 1)
+		if n > s.scrollBottom-s.scrollTop+1 {
+			n = s.scrollBottom - s.scrollTop + 1
+		}
+		if final == 'S' {
+			s.scrollUp(s.scrollTop, s.scrollBottom, n)
+		} else {
+			s.scrollDown(s.scrollTop, s.scrollBottom, n)
+		}
+	case 'X':
+		s.eraseCells(c.y, c.x, c.x+param(0, 1))
+	case 'b':
+		// Capped at a line, so a huge count doesn't keep the client busy
+		n := param(0, 1)
+		if n > s.cols {
+			n = s.cols
+		}
+		for i := n; i > 0 && s.lastRune != 0; i-- {
+			s.put(s.lastRune)
+		}
+	case 'm':
+		s.sgr(args)
+	case 'r':
+		top, bottom := param(0, 1)-1, param(1, s.rows)-1
+		if 0 <= top && top < bottom && bottom < s.rows {
+			s.scrollTop, s.scrollBottom = top, bottom
+			c.x, c.y = 0, 0
+		}
+	case 's':
+		s.savedCursor = s.cursor
+	case 'u':
+		s.restoreCursor()
+	}
+}
+
+func (s *screenModel) setPrivateModes(modes []int, on bool) {
+	for _, mode := range modes {
+		switch mode {
+		case 7:
+			s.autoWrap = on
+		case 25:
+			s.cursorVisible = on
+		case 47, 1047:
+			s.setAltScreen(on)
+		case 1049:
+			if on {
+				s.savedCursor = s.cursor
+				s.setAltScreen(true)
+			} else {
+				s.setAltScreen(false)
+				s.restoreCursor()
+			}
+		}
+	}
+}
+
+func (s *screenModel) sgr(args []int) {
+	st := &s.cursor.style
+	if len(args) == 0 {
+		args = []int{0}
+	}
+
+	extendedColor := func(i int) (termColor, int) {
+		if i+1 < len(args) && args[i+1] == 5 && i+2 < len(args) {
+			return colorPalette | termColor(args[i+2]&0xff), i + 2
+		}
+		if i+1 < len(args) && args[i+1] == 2 && i+4 < len(args) {
+			return colorRGB | termColor((args[i+2]&0xff)<<16|(args[i+3]&0xff)<<8|args[i+4]&0xff), i + 4
+		}
+		return 0, len(args)
+	}
+
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == 0:
+			*st = cellStyle{}
+		case a == 1:
+			st.attrs |= attrBold
+		case a == 2:
+			st.attrs |= attrDim
+		case a == 3:
+			st.attrs |= attrItalic
+		case a == 4:
+			st.attrs |= attrUnderline
+		case a == 5 || a == 6:
+			st.attrs |= attrBlink
+		case a == 7:
+			st.attrs |= attrReverse
+		case a == 8:
+			st.attrs |= attrHidden
+		case a == 9:
+			st.attrs |= attrStrike
+		case a == 21 || a == 22:
+			st.attrs &^= attrBold | attrDim
+		case a == 23:
+			st.attrs &^= attrItalic
+		case a == 24:
+			st.attrs &^= attrUnderline
+		case a == 25:
+			st.attrs &^= attrBlink
+		case a == 27:
+			st.attrs &^= attrReverse
+		case a == 28:
+			st.attrs &^= attrHidden
+		case a == 29:
+			st.attrs &^= attrStrike
+		case a >= 30 && a <= 37:
+			st.fg = colorPalette | termColor(a-30)
+		case a == 38:
+			st.fg, i = extendedColor(i)
+		case a == 39:
+			st.fg = 0
+		case a >= 40 && a <= 47:
+			st.bg = colorPalette | termColor(a-40)
+		case a == 48:
+			st.bg, i = extendedColor(i)
+		case a == 49:
+			st.bg = 0
+		case a >= 90 && a <= 97:
+			st.fg = colorPalette | termColor(a-90+8)
+		case a >= 100 && a <= 107:
+			st.bg = colorPalette | termColor(a-100+8)
+		}
+	}
+}
+
+// sgrSequence returns the escape sequence which sets the given style, starting from the default one
+func (st cellStyle) sgrSequence() string {
+	params := []string{"0"}
+	attrsCodes := []struct {
+		attr uint8
+		code string
+	}{
+		{attrBold, "1"}, {attrDim, "2"}, {attrItalic, "3"}, {attrUnderline, "4"},
+		{attrBlink, "5"}, {attrReverse, "7"}, {attrHidden, "8"}, {attrStrike, "9"},
+	}
+	for _, ac := range attrsCodes {
+		if st.attrs&ac.attr != 0 {
+			params = append(params, ac.code)
+		}
+	}
+
+	color := func(c termColor, base int) {
+		switch {
+		case c&colorRGB != 0:
+			params = append(params, strconv.Itoa(base+8), "2",
+				strconv.Itoa(int(c>>16&0xff)), strconv.Itoa(int(c>>8&0xff)), strconv.Itoa(int(c&0xff)))
+		case c&colorPalette != 0 && c&0xff < 8:
+			params = append(params, strconv.Itoa(base+int(c&0xff)))
+		case c&colorPalette != 0 && c&0xff < 16:
+			params = append(params, strconv.Itoa(base+60+int(c&0xff)-8))
+		case c&colorPalette != 0:
+			params = append(params, strconv.Itoa(base+8), "5", strconv.Itoa(int(c&0xff)))
+		}
+	}
+	color(st.fg, 30)
+	color(st.bg, 40)
+
+	return "\033[" + strings.Join(params, ";") + "m"
+}
+
+// RenderLine returns the characters and escape sequences needed to draw width cells of the line y,
+// starting at the column x. Cells outside of the screen are rendered as blanks.
+func (s *screenModel) RenderLine(y, x, width int) string {
+	var b strings.Builder
+	style := cellStyle{}
+	b.WriteString(style.sgrSequence())
+
+	for col := x; col < x+width; col++ {
+		c := cell{r: ' '}
+		if y >= 0 && y < s.rows && col >= 0 && col < s.cols {
+			c = s.lines[y][col]
+		}
+		if c.r == 0 {
+			// Second half of a wide char. If the first half was rendered, this cell is covered
+			if col > x {
+				continue
+			}
+			c.r = ' '
+		} else if runeWidth(c.r) == 2 && col == x+width-1 {
+			// The first half of a wide char on the last column can't be fully rendered
+			c.r = ' '
+		}
+		if c.style != style {
+			style = c.style
+			b.WriteString(style.sgrSequence())
+		}
+		b.WriteRune(c.r)
+	}
+	b.WriteString(cellStyle{}.sgrSequence())
+	return b.String()
+}
+
+func decSpecialGraphics(r rune) rune {
+	const from = "`afgjklmnopqrstuvwxyz{|}~"
+	const to = "◆▒°±┘┐┌└┼⎺⎻─⎼⎽├┤┴┬│≤≥π≠£·"
+	if i := strings.IndexRune(from, r); i >= 0 {
+		return []rune(to)[i]
+	}
+	return r
+}
+
+// runeWidth returns the number of columns a rune takes in a terminal. Only the common wide and
+// zero-width ranges are considered.
+func runeWidth(r rune) int {
+	switch {
+	case r < 0x300:
+		return 1
+	case r <= 0x36f, r >= 0x200b && r <= 0x200f, r == 0xfe0f, r >= 0x20d0 && r <= 0x20ff:
+		return 0
+	case r >= 0x1100 && r <= 0x115f,
+		r >= 0x2e80 && r <= 0x303e,
+		r >= 0x3041 && r <= 0x33ff,
+		r >= 0x3400 && r <= 0x4dbf,
+		r >= 0x4e00 && r <= 0x9fff,
+		r >= 0xa000 && r <= 0xa4cf,
+		r >= 0xac00 && r <= 0xd7a3,
+		r >= 0xf900 && r <= 0xfaff,
+		r >= 0xfe30 && r <= 0xfe4f,
+		r >= 0xff00 && r <= 0xff60,
+		r >= 0xffe0 && r <= 0xffe6,
+		r >= 0x1f300 && r <= 0x1f64f,
+		r >= 0x1f900 && r <= 0x1f9ff,
+		r >= 0x20000 && r <= 0x3fffd:
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Returns the text of the screen, without the trailing spaces of each line
+func screenText(s *screenModel) string {
+	lines := []string{}
+	for _, line := range s.lines {
+		var b strings.Builder
+		for _, c := range line {
+			if c.r != 0 {
+				b.WriteRune(c.r)
+			}
+		}
+		lines = append(lines, strings.TrimRight(b.String(), " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestScreenModel(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"text and newlines", "ab\r\ncd", "ab\ncd\n\n"},
+		{"autowrap", "abcdefg", "abcde\nfg\n\n"},
+		{"scroll", "1\r\n2\r\n3\r\n4\r\n5", "2\n3\n4\n5"},
+		{"cursor position", "\033[2;3Hx\033[1;1Hy", "y\n  x\n\n"},
+		{"erase line", "abcde\033[1;3H\033[K", "ab\n\n\n"},
+		{"erase display", "ab\r\ncd\033[2J", "\n\n\n"},
+		{"insert and delete chars", "abcd\033[1;2H\033[2@\033[3P", "ac\n\n\n"},
+		{"insert line", "1\r\n2\r\n3\033[2;1H\033[L", "1\n\n2\n3"},
+		{"scroll region", "\033[2;3r\033[3;1H1\r\n2\r\n3", "\n2\n3\n"},
+		{"alternate screen", "main\033[?1049h\033[2Jalt\033[?1049l", "main\n\n\n"},
+		{"line drawing", "\033(0lqk\033(Bx", "┌─┐x\n\n\n"},
+		{"wide chars", "a世b", "a世b\n\n\n"},
+		{"repeat", "a\033[3b", "aaaa\n\n\n"},
+		{"ignored sequences", "\033]0;title\007\033[>c\033[?25la", "a\n\n\n"},
+		{"negative delete chars", "abc\033[1;2H\033[-1P", "ac\n\n\n"},
+		{"negative insert chars", "abc\033[1;2H\033[-1@", "a bc\n\n\n"},
+		{"scroll up more than the screen", "1\r\n2\033[999999999S", "\n\n\n"},
+		{"repeat more than a line", "a\033[999999999b", "aaaaa\na\n\n"},
+		{"negative scroll region", "\033[-3;5r1\r\n2\r\n3\r\n4\r\n5", "2\n3\n4\n5"},
+	}
+
+	for _, test := range tests {
+		s := newScreenModel(5, 4)
+		s.Write([]byte(test.input))
+		if text := screenText(s); text != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, text)
+		}
+	}
+}
+
+func TestScreenModelSplitSequences(t *testing.T) {
+	s := newScreenModel(10, 2)
+	input := "\033[1;31mred\033[0m 世"
+	for i := 0; i < len(input); i++ {
+		s.Write([]byte{input[i]})
+	}
+
+	if text := screenText(s); text != "red 世\n" {
+		t.Errorf("Unexpected screen %q", text)
+	}
+	red := cellStyle{fg: colorPalette | 1, attrs: attrBold}
+	if s.lines[0][0].style != red || s.lines[0][3].style != (cellStyle{}) {
+		t.Errorf("Unexpected styles: %v, %v", s.lines[0][0].style, s.lines[0][3].style)
+	}
+	if line := s.RenderLine(0, 0, 3); line != "\033[0m\033[0;1;31mred\033[0m" {
+		t.Errorf("Unexpected rendered line %q", line)
+	}
+}
+
+func TestScreenModelRestoreCursorAfterResize(t *testing.T) {
+	// Like vim, when the terminal gets shorter while it runs
+	s := newScreenModel(80, 40)
+	s.Write([]byte("\033[40;1H\033[?1049h"))
+	s.Resize(80, 20)
+	s.Write([]byte("\033[?1049lx"))
+	if x, y, _ := s.Cursor(); x != 1 || y != 19 {
+		t.Errorf("unexpected cursor %d,%d", x, y)
+	}
+
+	// Restored within a screen which got smaller after the resize, too
+	s.Write([]byte("\0337"))
+	s.Resize(10, 5)
+	s.Write([]byte("\0338y\033[s\033[u"))
+	if x, y, _ := s.Cursor(); x != 2 || y != 4 {
+		t.Errorf("unexpected cursor %d,%d", x, y)
+	}
+}
+
+func TestScreenModelWideCharOnOneColumn(t *testing.T) {
+	s := newScreenModel(1, 2)
+	s.Write([]byte("世a"))
+	if text := screenText(s); text != "世\na" {
+		t.Errorf("unexpected screen %q", text)
+	}
+}
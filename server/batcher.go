@@ -0,0 +1,92 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// The most output held by default, when the output is batched
+const defaultOutputBatchSize = 32 * 1024
+
+// Coalesces the output written in a short time, so it goes out in fewer, larger messages, e.g.:
+// when an application prints one character at a time, or a large file is printed. The output
+// following some input goes out right away, as it's likely its echo
+type outputBatcher struct {
+	write func(data []byte)
+	delay time.Duration
+	size  int
+
+	mutex sync.Mutex
+	buff  []byte
+	// Flushes the output held, once the delay passed. nil, if no output is held
+	timer *time.Timer
+	// Set on input, so the output which follows goes out right away
+	echo bool
+}
+
+func newOutputBatcher(write func(data []byte), delay time.Duration, size int) *outputBatcher {
+	if size <= 0 {
+		size = defaultOutputBatchSize
+	}
+	return &outputBatcher{write: write, delay: delay, size: size}
+}
+
+func (b *outputBatcher) Write(data []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.echo || len(b.buff)+len(data) >= b.size {
+		if len(b.buff) == 0 {
+			b.echo = false
+			b.write(data)
+			return len(data), nil
+		}
+		b.buff = append(b.buff, data...)
+		b.flushLocked()
+		return len(data), nil
+	}
+
+	b.buff = append(b.buff, data...)
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.delay, b.flush)
+	}
+	return len(data), nil
+}
+
+// Called on input, so the output which follows, likely its echo, goes out right away
+func (b *outputBatcher) input() {
+	b.mutex.Lock()
+	b.echo = true
+	b.mutex.Unlock()
+}
+
+// Sends the output held, if any
+func (b *outputBatcher) flush() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.flushLocked()
+}
+
+func (b *outputBatcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.echo = false
+	if len(b.buff) == 0 {
+		return
+	}
+	// The output is copied by the time write returns, so the buffer can be used again
+	b.write(b.buff)
+	b.buff = b.buff[:0]
+}
+
+// Drops the output held, if any
+func (b *outputBatcher) dropLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.echo = false
+	b.buff = b.buff[:0]
+}
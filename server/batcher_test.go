@@ -0,0 +1,60 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type testOutput struct {
+	mutex  sync.Mutex
+	writes []string
+}
+
+func (o *testOutput) write(data []byte) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.writes = append(o.writes, string(data))
+}
+
+func (o *testOutput) get() []string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return append([]string{}, o.writes...)
+}
+
+func TestOutputBatcher(t *testing.T) {
+	out := &testOutput{}
+	b := newOutputBatcher(out.write, 50*time.Millisecond, 8)
+
+	// Held, until the delay passes
+	b.Write([]byte("a"))
+	b.Write([]byte("b"))
+	if writes := out.get(); len(writes) != 0 {
+		t.Errorf("expected the output to be held, got %q", writes)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if writes := out.get(); len(writes) != 1 || writes[0] != "ab" {
+		t.Errorf("expected one write, got %q", writes)
+	}
+
+	// The output following some input goes out right away, once
+	b.input()
+	b.Write([]byte("c"))
+	b.Write([]byte("d"))
+	if writes := out.get(); len(writes) != 2 || writes[1] != "c" {
+		t.Errorf("expected the echo to go out right away, got %q", writes)
+	}
+
+	// Up to the size
+	b.Write([]byte("efghijk"))
+	if writes := out.get(); len(writes) != 3 || writes[2] != "defghijk" {
+		t.Errorf("expected the held output to go out at the size limit, got %q", writes)
+	}
+
+	b.Write([]byte("l"))
+	b.flush()
+	if writes := out.get(); len(writes) != 4 || writes[3] != "l" {
+		t.Errorf("expected the flush to send the held output, got %q", writes)
+	}
+}
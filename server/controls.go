@@ -0,0 +1,274 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ParticipantInfo describes a participant admitted in the session
+type ParticipantInfo struct {
+	ID         string
+	Name       string
+	RemoteAddr string
+	Role       ParticipantRole
+	JoinedAt   time.Time
+	// When the participant last typed, or resized its window
+	InputAt time.Time
+}
+
+// Shown to the participants while the sharing is paused, instead of the output
+const pausedScreen = "\033[0m\033[H\033[2J\r\nThe sharer paused the session. Please wait ...\r\n"
+
+// Returns the participants admitted in the session, in the order they joined
+func (session *ttyShareSession) participants() []ParticipantInfo {
+	session.mainRWLock.RLock()
+	defer session.mainRWLock.RUnlock()
+
+	infos := []ParticipantInfo{}
+	for _, rcv := range session.receivers.list() {
+		infos = append(infos, rcv.infoLocked())
+	}
+	return infos
+}
+
+// Describes the receiver. Call with mainRWLock locked
+func (rcv *ttyReceiver) infoLocked() ParticipantInfo {
+	return ParticipantInfo{
+		ID:         rcv.id,
+		Name:       rcv.name,
+		RemoteAddr: rcv.remoteAddr,
+		Role:       rcv.role,
+		JoinedAt:   rcv.joinedAt,
+		InputAt:    time.Unix(0, atomic.LoadInt64(&rcv.inputAt)),
+	}
+}
+
+// Disconnects the participant with the given ID, telling it why
+func (session *ttyShareSession) kick(id string) error {
+	var found *ttyReceiver
+	session.forEachReceiver(func(rcv *ttyReceiver) bool {
+		if rcv.id == id {
+			found = rcv
+			return false
+		}
+		return true
+	})
+	if found == nil {
+		return fmt.Errorf("no participant with the ID %s", id)
+	}
+
+	log.Infof("Removing the participant %s from the session", id)
+	found.conn.SendNotice("the sharer removed you from the session")
+	found.conn.ws.Close()
+	return nil
+}
+
+// Changes what the participant with the given ID can do in the session
+func (session *ttyShareSession) setRole(id string, role ParticipantRole) error {
+	if role != RoleViewer && role != RoleWriter {
+		return fmt.Errorf("a participant can't be made %s", role)
+	}
+
+	var found *ttyReceiver
+	session.mainRWLock.Lock()
+	for _, rcv := range session.receivers.list() {
+		if rcv.id == id {
+			found = rcv
+			break
+		}
+	}
+	changed := found != nil && found.role != role
+	if changed {
+		found.role = role
+	}
+	session.mainRWLock.Unlock()
+
+	if found == nil {
+		return fmt.Errorf("no participant with the ID %s", id)
+	}
+	if changed {
+		log.Infof("The participant %s is now a %s", id, role)
+		found.conn.SendNotice(fmt.Sprintf("the sharer made you a %s", role))
+		// Only the windows of the writers count for the size of the shared terminal
+		session.updateWindowSize()
+	}
+	return nil
+}
+
+// Fixes the size of the shared terminal, regardless of the window size policy. A size not set goes
+// back to the policy
+func (session *ttyShareSession) setWinSize(size MsgTTYWinSize) {
+	session.mainRWLock.Lock()
+	session.forcedWindowSize = size
+	session.mainRWLock.Unlock()
+
+	session.updateWindowSize()
+}
+
+// How often, at most, a participant is told its input is ignored
+const inputIgnoredNoticeInterval = 10 * time.Second
+
+// Tells whether the receiver can type in the shared terminal, and if not, why. The receivers not
+// admitted yet are ignored silently
+func (session *ttyShareSession) canWrite(rcv *ttyReceiver) (bool, string) {
+	session.mainRWLock.RLock()
+	defer session.mainRWLock.RUnlock()
+
+	switch {
+	case !rcv.admitted:
+		return false, ""
+	case session.paused:
+		return false, "the sharing is paused, your input is ignored"
+	case session.readOnly:
+		return false, "the session is read only, your input is ignored"
+	case rcv.role != RoleWriter:
+		return false, "you are a viewer, your input is ignored"
+	}
+	return true, ""
+}
+
+// Tells the receiver why its input is ignored, unless it was told recently
+func (session *ttyShareSession) ignoreInput(rcv *ttyReceiver, reason string) {
+	if reason == "" {
+		return
+	}
+	session.mainRWLock.Lock()
+	tell := time.Since(rcv.ignoredAt) >= inputIgnoredNoticeInterval
+	if tell {
+		rcv.ignoredAt = time.Now()
+	}
+	session.mainRWLock.Unlock()
+
+	if tell {
+		rcv.conn.SendNotice(reason)
+	}
+}
+
+func (session *ttyShareSession) setReadOnly(readOnly bool) {
+	session.mainRWLock.Lock()
+	changed := session.readOnly != readOnly
+	session.readOnly = readOnly
+	session.mainRWLock.Unlock()
+	if !changed {
+		return
+	}
+
+	log.Infof("Read only session: %t", readOnly)
+	if readOnly {
+		session.notify("the session is now read only")
+	} else {
+		session.notify("the session is no longer read only")
+	}
+	session.updateWindowSize()
+}
+
+func (session *ttyShareSession) isReadOnly() bool {
+	session.mainRWLock.RLock()
+	defer session.mainRWLock.RUnlock()
+	return session.readOnly
+}
+
+// Pauses or resumes the sharing. While paused, the receivers see the pausedScreen instead of the
+// output, and can't type. When resumed, the application is redrawn for them, or they get the
+// scrollback again, so none of the output written in between is shown.
+func (session *ttyShareSession) setPaused(paused bool) {
+	// The output the batcher holds when the sharing is paused goes out before the pausedScreen.
+	// When it's resumed, the output it holds was written while paused, so it's dropped. It stays
+	// locked until the sharing is paused or resumed, so no output slips in between
+	batcher := session.batcher
+	if batcher != nil {
+		batcher.mutex.Lock()
+		if paused {
+			batcher.flushLocked()
+		}
+	}
+	session.outputMutex.Lock()
+	session.mainRWLock.Lock()
+	changed := session.paused != paused
+	session.paused = paused
+	session.mainRWLock.Unlock()
+	if !changed {
+		session.outputMutex.Unlock()
+		if batcher != nil {
+			batcher.mutex.Unlock()
+		}
+		return
+	}
+	if batcher != nil && !paused {
+		batcher.dropLocked()
+	}
+
+	log.Infof("Paused sharing: %t", paused)
+	screen := []byte(pausedScreen)
+	if !paused {
+		screen = []byte("\033[0m\033[H\033[2J")
+		if session.scrollback != nil {
+			screen = append(screen, session.scrollback.Bytes()...)
+		}
+	}
+	session.broadcast(MsgTTYWrite{Data: screen, Size: len(screen)})
+	session.outputMutex.Unlock()
+	if batcher != nil {
+		batcher.mutex.Unlock()
+	}
+
+	if !paused && session.scrollback == nil {
+		session.ptyHandler.Refresh()
+	}
+	if session.onPause != nil {
+		session.onPause(paused)
+	}
+}
+
+func (session *ttyShareSession) isPaused() bool {
+	session.mainRWLock.RLock()
+	defer session.mainRWLock.RUnlock()
+	return session.paused
+}
+
+// Participants returns the participants admitted in the session
+func (server *TTYServer) Participants() []ParticipantInfo {
+	return server.session.participants()
+}
+
+// Kick disconnects the participant with the given ID. It can join again, unless the joins have to
+// be approved by the sharer
+func (server *TTYServer) Kick(id string) error {
+	return server.session.kick(id)
+}
+
+// SetRole makes the participant with the given ID a viewer, or a writer
+func (server *TTYServer) SetRole(id string, role ParticipantRole) error {
+	return server.session.setRole(id, role)
+}
+
+// SetWinSize fixes the size of the shared terminal, as the WinSizePolicyFixed policy does. A zero
+// size goes back to the configured policy
+func (server *TTYServer) SetWinSize(cols, rows int) {
+	server.session.setWinSize(MsgTTYWinSize{Cols: cols, Rows: rows})
+}
+
+// SetReadOnly stops all the participants from typing in the shared terminal, or lets the writers
+// type again
+func (server *TTYServer) SetReadOnly(readOnly bool) {
+	server.session.setReadOnly(readOnly)
+}
+
+// ReadOnly tells whether the participants are stopped from typing
+func (server *TTYServer) ReadOnly() bool {
+	return server.session.isReadOnly()
+}
+
+// SetPaused pauses or resumes sharing the output of the terminal. While paused, the participants
+// see a placeholder, and can't type
+func (server *TTYServer) SetPaused(paused bool) {
+	server.session.setPaused(paused)
+}
+
+// Paused tells whether the sharing is paused
+func (server *TTYServer) Paused() bool {
+	return server.session.isPaused()
+}
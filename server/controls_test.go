@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPause(t *testing.T) {
+	input := make(chanPTY, 1)
+	server := NewTTYServer(TTYServerConfig{SessionID: "abc", PTY: input, OutputBatchDelay: time.Hour})
+	app := httptest.NewServer(server)
+	defer app.Close()
+	defer server.Stop()
+	conn, _, _ := testJoin(t, app.URL, "alice")
+
+	// The output held when the sharing is paused goes out first
+	server.Write([]byte("public"))
+	server.SetPaused(true)
+	if output, _ := testReadOutput(conn, pausedScreen); output != "public"+pausedScreen {
+		t.Errorf("expected the output, then the paused screen, got %q", output)
+	}
+
+	// Neither the output, nor the input goes through while paused
+	server.Write([]byte("secret"))
+	server.batcher.flush()
+	conn.Write([]byte("x"))
+	output, notice := "", ""
+	for notice == "" {
+		err := conn.ReadAndHandle(TTYProtocolHandlers{
+			OnWrite:  func(data []byte) { output += string(data) },
+			OnNotice: func(text string) { notice = text },
+		})
+		if err != nil {
+			t.Fatalf("cannot read: %s", err.Error())
+		}
+	}
+	if output != "" {
+		t.Errorf("the output written while paused was sent: %q", output)
+	}
+	if !strings.Contains(notice, "paused") {
+		t.Errorf("expected to be told the sharing is paused, got %q", notice)
+	}
+	select {
+	case data := <-input:
+		t.Errorf("the input reached the application while paused: %q", data)
+	default:
+	}
+}
+
+func TestResumeDropsTheOutputWrittenWhilePaused(t *testing.T) {
+	server := NewTTYServer(TTYServerConfig{SessionID: "abc", PTY: testPTY{}, OutputBatchDelay: time.Hour, Scrollback: 1024})
+	app := httptest.NewServer(server)
+	defer app.Close()
+	defer server.Stop()
+	conn, _, _ := testJoin(t, app.URL, "alice")
+
+	// Resumed before the output written while paused would have been sent
+	server.Write([]byte("public"))
+	server.SetPaused(true)
+	server.Write([]byte("secret"))
+	server.SetPaused(false)
+	server.Write([]byte("after"))
+	server.batcher.flush()
+
+	output, _ := testReadOutput(conn, "after")
+	if strings.Contains(output, "secret") {
+		t.Errorf("the output written while paused was sent: %q", output)
+	}
+	if scrollback := string(server.session.scrollback.Bytes()); strings.Contains(scrollback, "secret") || !strings.Contains(scrollback, "after") {
+		t.Errorf("unexpected scrollback %q", scrollback)
+	}
+}
@@ -0,0 +1,423 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// The operations of the file transfer connections
+const (
+	// List the files offered for download
+	FileOpList = "list"
+	// Upload a file to the upload directory
+	FileOpPut = "put"
+	// Download one of the offered files
+	FileOpGet = "get"
+)
+
+// The codes of the file transfer errors
+const (
+	FileErrorDenied   = "denied"
+	FileErrorNotFound = "not-found"
+	FileErrorExists   = "exists"
+	FileErrorTooLarge = "too-large"
+	FileErrorChecksum = "checksum"
+	FileErrorFailed   = "failed"
+)
+
+// The size of the binary messages carrying the contents of the files
+const FileChunkSize = 32 * 1024
+
+// How long a file transfer connection can stay silent, before it's closed
+const fileIdleTimeout = 60 * time.Second
+
+// FileError is the reason a file transfer failed, as reported by the server
+type FileError struct {
+	// One of the FileError* codes
+	Code    string
+	Message string
+}
+
+func (e *FileError) Error() string {
+	return e.Message
+}
+
+// FileRequestMsg is the first message on a file transfer WS connection, sent by the client
+type FileRequestMsg struct {
+	// One of the FileOp* operations
+	Op string
+	// The token the participant got in its Welcome message, on the TTY connection
+	Token string
+	// The name of the file to upload or download, without any directory
+	Name string
+	// The size of the file to upload
+	Size int64
+}
+
+// FileInfo describes a file offered for download
+type FileInfo struct {
+	Name string
+	Size int64
+}
+
+// FileMsg is the text message following the FileRequestMsg, on a file transfer connection. It's
+// the answer of the server to the request, then, after the binary messages carrying the contents
+// of the file, the checksum of those, sent by the side which sent the file. After a put, the server
+// answers once more, to confirm the file was saved. A non empty Error ends the transfer.
+type FileMsg struct {
+	Error string     `json:",omitempty"`
+	Code  string     `json:",omitempty"`
+	Files []FileInfo `json:",omitempty"`
+	// The size of the downloaded file, in the answer to a get
+	Size int64 `json:",omitempty"`
+	// The hex encoded SHA-256 of the file contents
+	SHA256 string `json:",omitempty"`
+}
+
+// FileAuditEntry is written, as a JSON line, to the audit log, for each file transfer
+type FileAuditEntry struct {
+	Time            time.Time
+	Op              string
+	ParticipantID   string
+	ParticipantName string
+	RemoteAddr      string
+	Name            string
+	// The bytes transferred
+	Size   int64
+	SHA256 string `json:",omitempty"`
+	// Why the transfer failed, or was refused
+	Error string `json:",omitempty"`
+}
+
+// Writes the entries of the audit log, one at a time
+type auditLog struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (audit *auditLog) write(entry FileAuditEntry) {
+	if audit.w == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	if _, err := audit.w.Write(append(data, '\n')); err != nil {
+		log.Errorf("Cannot write to the audit log: %s", err.Error())
+	}
+}
+
+// SanitizeFileName checks the name of a transferred file is a plain file name, which can't point
+// outside of the directory it's saved to, or hide in it
+func SanitizeFileName(name string) (string, error) {
+	if name == "" || len(name) > 255 {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	if strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid file name %q: it can't start with a dot, or contain slashes", name)
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return "", fmt.Errorf("invalid file name %q: it can't contain control characters", name)
+		}
+	}
+	return name, nil
+}
+
+// Returns the participant with the given token, if it's allowed to transfer files
+func (server *TTYServer) fileParticipant(token string) (*ttyReceiver, error) {
+	participant := server.session.receiverByToken(token)
+	if participant == nil {
+		return nil, &FileError{Code: FileErrorDenied, Message: "the files can be transferred only by a participant of the session"}
+	}
+
+	if len(server.config.FileUsers) == 0 {
+		return participant, nil
+	}
+	if server.session.approvedAs(participant, server.config.FileUsers) {
+		return participant, nil
+	}
+	name := server.session.receiverName(participant)
+	return nil, &FileError{Code: FileErrorDenied, Message: fmt.Sprintf("the participant %q is not allowed to transfer files", name)}
+}
+
+// Sends the error as a FileMsg, and closes the connection
+func closeFilesWithError(wsConn *websocket.Conn, err error) {
+	msg := FileMsg{Error: err.Error(), Code: FileErrorFailed}
+	if fileErr, ok := err.(*FileError); ok {
+		msg.Code = fileErr.Code
+	}
+	wsConn.WriteJSON(msg)
+	closeFiles(wsConn)
+}
+
+func closeFiles(wsConn *websocket.Conn) {
+	wsConn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
+
+func (server *TTYServer) handleFilesWebsocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !server.startTransfer() {
+		http.Error(w, "the session ended", http.StatusServiceUnavailable)
+		return
+	}
+	defer server.transferDone()
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: FileChunkSize,
+	}
+	wsConn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error("Cannot upgrade to WS for the files route connection: ", err.Error())
+		return
+	}
+	defer wsConn.Close()
+	wsConn.SetReadLimit(2 * FileChunkSize)
+	wsConn.SetReadDeadline(time.Now().Add(fileIdleTimeout))
+
+	var req FileRequestMsg
+	if err := wsConn.ReadJSON(&req); err != nil {
+		log.Error("Cannot read the file transfer request ", err.Error())
+		return
+	}
+
+	participant, err := server.fileParticipant(req.Token)
+	if err != nil {
+		log.Warnf("File transfer refused: %s", err.Error())
+		closeFilesWithError(wsConn, err)
+		return
+	}
+
+	if req.Op == FileOpList {
+		wsConn.WriteJSON(FileMsg{Files: server.offeredFiles()})
+		closeFiles(wsConn)
+		return
+	}
+
+	entry := FileAuditEntry{
+		Time:            time.Now(),
+		Op:              req.Op,
+		ParticipantID:   participant.id,
+		ParticipantName: server.session.receiverName(participant),
+		RemoteAddr:      participant.remoteAddr,
+		Name:            req.Name,
+	}
+	switch req.Op {
+	case FileOpGet:
+		entry.Size, entry.SHA256, err = server.sendFile(wsConn, req.Name)
+	case FileOpPut:
+		entry.Size, entry.SHA256, err = server.receiveFile(wsConn, participant, req)
+	default:
+		err = &FileError{Code: FileErrorFailed, Message: fmt.Sprintf("unknown file operation %q", req.Op)}
+	}
+
+	if err != nil {
+		log.Warnf("The %s of the file %q by the participant %s failed: %s", req.Op, req.Name, participant.id, err.Error())
+		entry.Error = err.Error()
+		closeFilesWithError(wsConn, err)
+	} else {
+		log.Infof("The participant %s did a %s of the file %q (%d bytes)", participant.id, req.Op, req.Name, entry.Size)
+		closeFiles(wsConn)
+	}
+	server.audit.write(entry)
+}
+
+// Returns the files offered for download, which are still there
+func (server *TTYServer) offeredFiles() []FileInfo {
+	files := []FileInfo{}
+	for _, path := range server.config.OfferedFiles {
+		if stat, err := os.Stat(path); err == nil && stat.Mode().IsRegular() {
+			files = append(files, FileInfo{Name: filepath.Base(path), Size: stat.Size()})
+		}
+	}
+	return files
+}
+
+// Copies the data to w, counting it and computing its checksum
+type hashingWriter struct {
+	w     io.Writer
+	hash  hash.Hash
+	count int64
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	return &hashingWriter{w: w, hash: sha256.New()}
+}
+
+func (hw *hashingWriter) Write(data []byte) (int, error) {
+	n, err := hw.w.Write(data)
+	hw.hash.Write(data[:n])
+	hw.count += int64(n)
+	return n, err
+}
+
+func (hw *hashingWriter) sum() string {
+	return hex.EncodeToString(hw.hash.Sum(nil))
+}
+
+// Sends each write as a binary WS message
+type wsBinaryWriter struct {
+	wsConn *websocket.Conn
+}
+
+func (bw *wsBinaryWriter) Write(data []byte) (int, error) {
+	if err := bw.wsConn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Sends one of the offered files: its size, then its contents, then its checksum
+func (server *TTYServer) sendFile(wsConn *websocket.Conn, name string) (int64, string, error) {
+	var path string
+	for _, p := range server.config.OfferedFiles {
+		if filepath.Base(p) == name {
+			path = p
+			break
+		}
+	}
+	if path == "" {
+		return 0, "", &FileError{Code: FileErrorNotFound, Message: fmt.Sprintf("the file %q is not offered", name)}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", &FileError{Code: FileErrorNotFound, Message: fmt.Sprintf("cannot open the file %q", name)}
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		return 0, "", &FileError{Code: FileErrorNotFound, Message: fmt.Sprintf("the file %q is not a regular file", name)}
+	}
+
+	if err := wsConn.WriteJSON(FileMsg{Size: stat.Size()}); err != nil {
+		return 0, "", err
+	}
+
+	hw := newHashingWriter(&wsBinaryWriter{wsConn: wsConn})
+	if _, err := io.CopyBuffer(hw, file, make([]byte, FileChunkSize)); err != nil {
+		return hw.count, "", err
+	}
+	return hw.count, hw.sum(), wsConn.WriteJSON(FileMsg{SHA256: hw.sum()})
+}
+
+// Receives a file into the upload directory. It's written to a temporary file first, which gets
+// the final name only once its size and checksum are verified.
+func (server *TTYServer) receiveFile(wsConn *websocket.Conn, participant *ttyReceiver, req FileRequestMsg) (int64, string, error) {
+	if server.config.UploadDir == "" {
+		return 0, "", &FileError{Code: FileErrorDenied, Message: "uploads are not allowed"}
+	}
+	name, err := SanitizeFileName(req.Name)
+	if err != nil {
+		return 0, "", &FileError{Code: FileErrorFailed, Message: err.Error()}
+	}
+	if req.Size < 0 {
+		return 0, "", &FileError{Code: FileErrorFailed, Message: "invalid file size"}
+	}
+	if server.config.MaxFileSize > 0 && req.Size > server.config.MaxFileSize {
+		return 0, "", &FileError{Code: FileErrorTooLarge,
+			Message: fmt.Sprintf("the file is larger than the limit of %d bytes", server.config.MaxFileSize)}
+	}
+
+	path := filepath.Join(server.config.UploadDir, name)
+	if _, err := os.Lstat(path); err == nil {
+		return 0, "", &FileError{Code: FileErrorExists, Message: fmt.Sprintf("the file %q already exists", name)}
+	}
+
+	if server.config.FileApprover != nil {
+		approved := server.config.FileApprover(ApprovalRequest{
+			Kind:            ApprovalUpload,
+			ParticipantID:   participant.id,
+			ParticipantName: server.session.receiverName(participant),
+			RemoteAddr:      participant.remoteAddr,
+			Target:          fmt.Sprintf("%s (%d bytes)", name, req.Size),
+		})
+		if !approved {
+			return 0, "", &FileError{Code: FileErrorDenied, Message: fmt.Sprintf("the sharer didn't approve the upload of %s", name)}
+		}
+	}
+
+	tmpFile, err := os.CreateTemp(server.config.UploadDir, ".tty-share-upload-*")
+	if err != nil {
+		log.Errorf("Cannot create the upload file: %s", err.Error())
+		return 0, "", &FileError{Code: FileErrorFailed, Message: "cannot create the file"}
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	// Ready for the contents
+	if err := wsConn.WriteJSON(FileMsg{}); err != nil {
+		return 0, "", err
+	}
+
+	hw := newHashingWriter(tmpFile)
+	for {
+		wsConn.SetReadDeadline(time.Now().Add(fileIdleTimeout))
+		msgType, data, err := wsConn.ReadMessage()
+		if err != nil {
+			return hw.count, "", err
+		}
+
+		if msgType == websocket.BinaryMessage {
+			if hw.count+int64(len(data)) > req.Size {
+				return hw.count, "", &FileError{Code: FileErrorTooLarge, Message: "the file is larger than announced"}
+			}
+			if _, err := hw.Write(data); err != nil {
+				log.Errorf("Cannot write the upload file: %s", err.Error())
+				return hw.count, "", &FileError{Code: FileErrorFailed, Message: "cannot write the file"}
+			}
+			continue
+		}
+
+		var done FileMsg
+		if err := json.Unmarshal(data, &done); err != nil {
+			return hw.count, "", err
+		}
+		if hw.count != req.Size {
+			return hw.count, "", &FileError{Code: FileErrorFailed, Message: "the file is smaller than announced"}
+		}
+		if done.SHA256 != hw.sum() {
+			return hw.count, hw.sum(), &FileError{Code: FileErrorChecksum, Message: "the checksum of the file doesn't match"}
+		}
+		break
+	}
+
+	// The temporary files are created readable only by their owner
+	tmpFile.Chmod(0644)
+	if err := tmpFile.Close(); err != nil {
+		return hw.count, hw.sum(), &FileError{Code: FileErrorFailed, Message: "cannot write the file"}
+	}
+	// Unlike a rename, a link doesn't replace a file with the same name, created in the meantime
+	if err := os.Link(tmpFile.Name(), path); err != nil {
+		if os.IsExist(err) {
+			return hw.count, hw.sum(), &FileError{Code: FileErrorExists, Message: fmt.Sprintf("the file %q already exists", name)}
+		}
+		log.Errorf("Cannot save the upload file: %s", err.Error())
+		return hw.count, hw.sum(), &FileError{Code: FileErrorFailed, Message: "cannot save the file"}
+	}
+
+	return hw.count, hw.sum(), wsConn.WriteJSON(FileMsg{SHA256: hw.sum()})
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	for _, name := range []string{"notes.txt", "report 2024.pdf", "naïve.md"} {
+		if sanitized, err := SanitizeFileName(name); err != nil || sanitized != name {
+			t.Errorf("%q: unexpected result %q, %v", name, sanitized, err)
+		}
+	}
+
+	for _, name := range []string{"", ".", "..", ".bashrc", "../etc/passwd", "dir/file", `dir\file`, "a\x1b[2Jb", "a\nb"} {
+		if _, err := SanitizeFileName(name); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Uploads the files dropped over the terminal, to the upload directory of the sharer. Each file goes
+// over its own WS connection: the request, the contents as binary messages, then the checksum.
+
+const chunkSize = 32 * 1024;
+
+function toHex(buffer: ArrayBuffer): string {
+    return Array.from(new Uint8Array(buffer)).map((b) => b.toString(16).padStart(2, "0")).join("");
+}
+
+function formatBytes(n: number): string {
+    if (n < 1024) {
+        return n + " B";
+    }
+    if (n < 1024 * 1024) {
+        return (n / 1024).toFixed(1) + " kB";
+    }
+    return (n / (1024 * 1024)).toFixed(1) + " MB";
+}
+
+class FileUploader {
+    private wsAddress: string;
+    private getToken: () => string;
+    private statusElement: HTMLElement;
+
+    constructor(wsAddress: string, getToken: () => string, dropTarget: HTMLElement, statusElement: HTMLElement) {
+        this.wsAddress = wsAddress;
+        this.getToken = getToken;
+        this.statusElement = statusElement;
+
+        dropTarget.addEventListener("dragover", (ev: DragEvent) => {
+            ev.preventDefault();
+            ev.dataTransfer.dropEffect = "copy";
+        });
+        dropTarget.addEventListener("drop", async (ev: DragEvent) => {
+            ev.preventDefault();
+            // One file at a time, so the sharer gets one approval request at a time
+            for (const file of Array.from(ev.dataTransfer.files)) {
+                await this.upload(file);
+            }
+        });
+    }
+
+    private showStatus(text: string, done: boolean) {
+        this.statusElement.textContent = text;
+        this.statusElement.style.display = "block";
+        if (done) {
+            setTimeout(() => {
+                if (this.statusElement.textContent === text) {
+                    this.statusElement.style.display = "none";
+                }
+            }, 5000);
+        }
+    }
+
+    private async upload(file: File) {
+        if (!window.crypto || !window.crypto.subtle) {
+            this.showStatus(`Cannot upload ${file.name}: the checksum needs a secure (https) connection`, true);
+            return;
+        }
+
+        const contents = await file.arrayBuffer();
+        const sum = toHex(await window.crypto.subtle.digest("SHA-256", contents));
+
+        return new Promise<void>((resolve) => {
+            const connection = new WebSocket(this.wsAddress);
+            connection.binaryType = "arraybuffer";
+            // The server answers once to accept the file, and once to confirm it was saved
+            let accepted = false;
+            let finished = false;
+            const finish = (text: string) => {
+                if (!finished) {
+                    finished = true;
+                    this.showStatus(text, true);
+                    connection.close();
+                    resolve();
+                }
+            };
+
+            connection.onopen = () => {
+                this.showStatus(`${file.name}: waiting for the sharer`, false);
+                connection.send(JSON.stringify({ Op: "put", Token: this.getToken(), Name: file.name, Size: file.size }));
+            };
+
+            connection.onmessage = (ev: MessageEvent) => {
+                const msg = JSON.parse(ev.data);
+                if (msg.Error) {
+                    finish(`Cannot upload ${file.name}: ${msg.Error}`);
+                    return;
+                }
+                if (accepted) {
+                    finish(msg.SHA256 === sum ? `Uploaded ${file.name}` : `Cannot upload ${file.name}: the checksum doesn't match`);
+                    return;
+                }
+                accepted = true;
+                this.sendContents(connection, file, contents, sum);
+            };
+
+            connection.onclose = () => {
+                finish(`Cannot upload ${file.name}: the connection was closed`);
+            };
+        });
+    }
+
+    // Sends the contents in chunks, waiting for the WS buffer to drain, to show the progress
+    private sendContents(connection: WebSocket, file: File, contents: ArrayBuffer, sum: string) {
+        let offset = 0;
+        const sendMore = () => {
+            if (connection.readyState !== WebSocket.OPEN) {
+                return;
+            }
+            while (offset < contents.byteLength && connection.bufferedAmount < 4 * chunkSize) {
+                connection.send(contents.slice(offset, offset + chunkSize));
+                offset += chunkSize;
+            }
+            const sent = Math.min(offset, contents.byteLength) - connection.bufferedAmount;
+            const percent = contents.byteLength > 0 ? Math.floor(100 * Math.max(sent, 0) / contents.byteLength) : 100;
+            this.showStatus(`${file.name}: ${percent}% (${formatBytes(Math.max(sent, 0))} of ${formatBytes(file.size)})`, false);
+
+            if (offset < contents.byteLength || connection.bufferedAmount > 0) {
+                setTimeout(sendMore, 50);
+                return;
+            }
+            connection.send(JSON.stringify({ SHA256: sum }));
+        };
+        sendMore();
+    }
+}
+
+export {
+    FileUploader
+}
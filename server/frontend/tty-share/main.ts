@@ -4,6 +4,7 @@ import './main.css';
 import { Terminal } from 'xterm';
 
 import { TTYReceiver } from './tty-receiver';
+import { FileUploader } from './file-upload';
 
 const term = new Terminal({
     cursorBlink: true,
@@ -21,4 +22,18 @@ let ttyWindow = window as any;
 wsAddress += ttyWindow.location.host + ttyWindow.ttyInitialData.wsPath;
 
 
-const ttyReceiver = new TTYReceiver(wsAddress, document.getElementById('terminal') as HTMLDivElement);
+// The name to join the session with, from the ?name= query parameter
+const params = new URLSearchParams(window.location.search);
+const name = params.get("name") || "";
+// Let the applications set the clipboard (?clipboard=1), or read it (?clipboard-push=1)
+const clipboard = params.get("clipboard") === "1";
+const clipboardPush = params.get("clipboard-push") === "1";
+
+const ttyReceiver = new TTYReceiver(wsAddress, document.getElementById('terminal') as HTMLDivElement, name, clipboard, clipboardPush);
+
+// Drop files over the terminal, to upload them, if the sharer allows it
+if (ttyWindow.ttyInitialData.filesWsPath) {
+    const filesWsAddress = wsAddress.replace(ttyWindow.ttyInitialData.wsPath, ttyWindow.ttyInitialData.filesWsPath);
+    new FileUploader(filesWsAddress, () => ttyReceiver.token, document.getElementById('terminal') as HTMLDivElement,
+        document.getElementById('transfers') as HTMLDivElement);
+}
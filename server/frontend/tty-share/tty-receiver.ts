@@ -11,10 +11,23 @@ class TTYReceiver {
     private xterminal: Terminal;
     private containerElement: HTMLElement;
 
-    constructor(wsAddress: string, container: HTMLDivElement) {
+    // The token the server gave to this participant, in its Welcome message
+    public token: string = "";
+
+    constructor(wsAddress: string, container: HTMLDivElement, name: string, clipboard: boolean, clipboardPush: boolean) {
         console.log("Opening WS connection to ", wsAddress)
         const connection = new WebSocket(wsAddress);
 
+        // Introduce ourselves to the sharer. The server answers with the token needed to transfer
+        // files
+        connection.onopen = () => {
+            let helloMessage = {
+                Type: "Hello",
+                Data: base64.encode(JSON.stringify({ Name: name, Clipboard: clipboard, ClipboardPush: clipboardPush })),
+            }
+            connection.send(JSON.stringify(helloMessage));
+        }
+
         // TODO: expose some of these options in the UI
         this.xterminal = new Terminal({
             cursorBlink: true,
@@ -55,6 +68,19 @@ class TTYReceiver {
                 this.xterminal.write(base64.base64ToArrayBuffer(writeMsg.Data));
             }
 
+            if (message.Type === "Welcome") {
+                let welcomeMsg = JSON.parse(msgData)
+                this.token = welcomeMsg.Token;
+            }
+
+            if (message.Type === "Notice") {
+                this.showNotice(JSON.parse(msgData).Text);
+            }
+
+            if (message.Type === "Clipboard") {
+                this.handleClipboard(connection, JSON.parse(msgData), clipboard, clipboardPush);
+            }
+
             if (message.Type == "WinSize") {
                 let winSizeMsg = JSON.parse(msgData)
 
@@ -78,6 +104,51 @@ class TTYReceiver {
 
     }
 
+    // Shows a notice from the server, e.g.: that the session is about to end, for a while
+    private showNotice(text: string) {
+        const element = document.getElementById("notices");
+        if (!element) {
+            return;
+        }
+        element.textContent = "tty-share: " + text;
+        element.style.display = "block";
+        setTimeout(() => {
+            if (element.textContent === "tty-share: " + text) {
+                element.style.display = "none";
+            }
+        }, 10000);
+    }
+
+    // Sets the local clipboard to what the application copied, or answers its query with the
+    // contents of the local clipboard. The browsers allow these only on secure (https) pages
+    private handleClipboard(connection: WebSocket, clipMsg: any, clipboard: boolean, clipboardPush: boolean) {
+        if (!navigator.clipboard) {
+            console.log("The clipboard is not available");
+            return;
+        }
+
+        if (!clipMsg.Query) {
+            if (clipboard) {
+                const text = new TextDecoder().decode(base64.base64ToArrayBuffer(clipMsg.Data || ""));
+                navigator.clipboard.writeText(text).catch((err) => console.log("Cannot set the clipboard: ", err));
+            }
+            return;
+        }
+
+        if (clipboardPush) {
+            navigator.clipboard.readText().then((text) => {
+                let answer = {
+                    Selection: clipMsg.Selection,
+                    Data: base64.encode(text),
+                };
+                connection.send(JSON.stringify({
+                    Type: "Clipboard",
+                    Data: base64.encode(JSON.stringify(answer)),
+                }));
+            }).catch((err) => console.log("Cannot read the clipboard: ", err));
+        }
+    }
+
     // Get the pixels size of the element, after all CSS was applied. This will be used in an ugly
     // hack to guess what fontSize to set on the xterm object. Horrible hack, but I feel less bad
     // about it seeing that VSV does it too:
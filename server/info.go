@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The version of the TTY protocol, sent in the TTYSHARE-VERSION header, and in the ServerInfo
+const ProtocolVersion = 9
+
+// ServerInfo is served as JSON at /s/<session>/info, for the clients to find what the server and
+// the session support, and where to connect to, before joining
+type ServerInfo struct {
+	// The version of tty-share serving the session. Empty if not known
+	Version string
+	// The versions of the TTY protocol, and of the tunnel protocol
+	Protocol       int
+	TunnelProtocol int
+	// The paths of the WS connections, on the same host as the info. Empty for the connections
+	// the session doesn't allow
+	TTYWSPath    string
+	TunnelWSPath string
+	FilesWSPath  string
+	Features     ServerFeatures
+	Session      SessionMetadata
+}
+
+// ServerFeatures tells what the participants can do in the session
+type ServerFeatures struct {
+	// The participants can open tunnels (-L, -D), and reverse tunnels (-R)
+	Tunnels        bool
+	ReverseTunnels bool
+	// Only some of the participants, by their names, can open tunnels, or transfer files
+	TunnelUsersOnly bool
+	FileUsersOnly   bool
+	// The sharer approves each new tunnel destination, and each upload
+	TunnelApproval bool
+	UploadApproval bool
+	// The participants can upload files, or download the files the sharer offers
+	Uploads   bool
+	Downloads bool
+	// The sharer admits each new participant. This is how the participants are authenticated:
+	// anyone with the URL can ask to join
+	JoinApproval bool
+	// The WS connections are compressed (permessage-deflate), if the participant asks for it. The
+	// tunnels only if TunnelCompression is set too
+	Compression       bool
+	TunnelCompression bool
+	// The roles the participants can have
+	Roles []ParticipantRole
+	// The participants can answer the clipboard queries of the applications
+	ClipboardPush bool
+}
+
+// SessionMetadata describes the state of the session
+type SessionMetadata struct {
+	ID        string
+	StartedAt time.Time
+	// When the session ends, at the latest. Zero if it has no end set
+	EndsAt       time.Time
+	ReadOnly     bool
+	Paused       bool
+	Participants int
+	// No limit if 0
+	MaxParticipants int
+	// The size of the shared terminal. 0x0 until it's known
+	Cols int
+	Rows int
+}
+
+// Info returns what the server and the session support, as served at /s/<session>/info
+func (server *TTYServer) Info() ServerInfo {
+	return server.info(server.config.SessionID)
+}
+
+// Returns the Info, with the paths of the given session, e.g.: the local one
+func (server *TTYServer) info(session string) ServerInfo {
+	config := server.config
+	pathPrefix := config.BaseUrlPath + "/s/" + session
+	info := ServerInfo{
+		Version:        config.Version,
+		Protocol:       ProtocolVersion,
+		TunnelProtocol: TunProtocolVersion,
+		TTYWSPath:      pathPrefix + "/ws/",
+		Features: ServerFeatures{
+			Tunnels:           config.AllowTunneling,
+			ReverseTunnels:    config.AllowReverseTunneling,
+			TunnelUsersOnly:   len(config.TunnelUsers) > 0,
+			FileUsersOnly:     len(config.FileUsers) > 0,
+			TunnelApproval:    config.TunnelApprover != nil,
+			UploadApproval:    config.FileApprover != nil,
+			Uploads:           config.UploadDir != "",
+			Downloads:         len(config.OfferedFiles) > 0,
+			JoinApproval:      config.JoinApprover != nil,
+			Compression:       config.CompressionLevel != 0,
+			TunnelCompression: config.CompressionLevel != 0 && !config.NoTunnelCompression,
+			Roles:             []ParticipantRole{RoleViewer, RoleWriter},
+			ClipboardPush:     config.ClipboardPush,
+		},
+		Session: SessionMetadata{
+			ID:              session,
+			StartedAt:       server.startedAt,
+			EndsAt:          config.ExpiresAt,
+			ReadOnly:        server.ReadOnly(),
+			Paused:          server.Paused(),
+			Participants:    server.session.receivers.len(),
+			MaxParticipants: config.MaxParticipants,
+		},
+	}
+	if info.Features.Tunnels || info.Features.ReverseTunnels {
+		info.TunnelWSPath = pathPrefix + "/tws"
+	}
+	if info.Features.Uploads || info.Features.Downloads {
+		info.FilesWSPath = pathPrefix + "/fws"
+	}
+	if config.MaxDuration > 0 {
+		if endsAt := server.startedAt.Add(config.MaxDuration); info.Session.EndsAt.IsZero() || endsAt.Before(info.Session.EndsAt) {
+			info.Session.EndsAt = endsAt
+		}
+	}
+
+	server.session.mainRWLock.RLock()
+	info.Session.Cols = server.session.lastWindowSizeMsg.Cols
+	info.Session.Rows = server.session.lastWindowSizeMsg.Rows
+	server.session.mainRWLock.RUnlock()
+	return info
+}
+
+// Serves the Info as JSON, for the session the request was made for
+func (server *TTYServer) handleInfo(w http.ResponseWriter, r *http.Request, session string, crossOrigin bool) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	info := server.info(session)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if crossOrigin {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		log.Debugf("Cannot send the info: %s", err.Error())
+	}
+}
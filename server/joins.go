@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ParticipantRole is what a participant can do in the session
+type ParticipantRole int
+
+const (
+	// Not admitted in the session
+	RoleRejected ParticipantRole = iota
+	// Sees the session, but can't type in it
+	RoleViewer
+	// Sees the session, and types in it
+	RoleWriter
+)
+
+func (role ParticipantRole) String() string {
+	switch role {
+	case RoleViewer:
+		return "viewer"
+	case RoleWriter:
+		return "writer"
+	default:
+		return "rejected"
+	}
+}
+
+// ParseParticipantRole returns the role with the given name: viewer, or writer
+func ParseParticipantRole(name string) (ParticipantRole, error) {
+	switch name {
+	case "viewer":
+		return RoleViewer, nil
+	case "writer":
+		return RoleWriter, nil
+	}
+	return RoleRejected, fmt.Errorf("unknown role %q (supported: viewer, writer)", name)
+}
+
+// MarshalText encodes the role by its name, e.g. in JSON
+func (role ParticipantRole) MarshalText() ([]byte, error) {
+	return []byte(role.String()), nil
+}
+
+func (role *ParticipantRole) UnmarshalText(text []byte) error {
+	if string(text) == "rejected" {
+		*role = RoleRejected
+		return nil
+	}
+	r, err := ParseParticipantRole(string(text))
+	*role = r
+	return err
+}
+
+// JoinApprover asks the sharer to admit a new participant in the session, and returns its role.
+// Like the Approver, it can block until the sharer answers, and should give up at some point, by
+// returning RoleRejected.
+type JoinApprover func(req ApprovalRequest) ParticipantRole
+
+// How long to wait for a new participant to introduce itself, before asking the sharer to admit it
+// anyway. The participants older than the Hello message don't send it
+const helloTimeout = 3 * time.Second
+
+// Shown to the participants waiting to be admitted
+const waitingScreen = "\033[H\033[2J\r\nWaiting for the sharer to let you in ...\r\n"
+
+var errSessionFull = errors.New("the session is full, try again later")
+
+// Tells whether the session has room for another receiver. Call with mainRWLock locked
+func (session *ttyShareSession) isFullLocked() bool {
+	return session.maxParticipants > 0 && session.receivers.len() >= session.maxParticipants
+}
+
+// Admits the receiver in the session, if there's room for it, and if the sharer approves it,
+// when asked to. Returns why, if it was not admitted.
+func (session *ttyShareSession) admit(rcv *ttyReceiver, readDone <-chan struct{}) error {
+	session.mainRWLock.RLock()
+	full := session.isFullLocked()
+	session.mainRWLock.RUnlock()
+	if full {
+		return errSessionFull
+	}
+
+	role := RoleWriter
+	approvedName := ""
+	if session.joinApprover != nil {
+		rcv.conn.Write([]byte(waitingScreen))
+		select {
+		case <-rcv.hello:
+		case <-time.After(helloTimeout):
+		case <-readDone:
+			return errors.New("left before being admitted")
+		}
+
+		session.mainRWLock.RLock()
+		name := rcv.name
+		session.mainRWLock.RUnlock()
+		role = session.joinApprover(ApprovalRequest{
+			Kind:            ApprovalJoin,
+			ParticipantID:   rcv.id,
+			ParticipantName: name,
+			RemoteAddr:      rcv.remoteAddr,
+		})
+		if role == RoleRejected {
+			return errors.New("the sharer didn't let you in")
+		}
+		approvedName = name
+
+		select {
+		case <-readDone:
+			return errors.New("left before being admitted")
+		default:
+		}
+		// Clear the waiting screen
+		rcv.conn.Write([]byte("\033[H\033[2J"))
+	}
+
+	// No output goes out until the receiver got the scrollback, if there's one
+	session.outputMutex.Lock()
+	defer session.outputMutex.Unlock()
+	session.mainRWLock.Lock()
+	if session.isFullLocked() {
+		session.mainRWLock.Unlock()
+		return errSessionFull
+	}
+	rcv.role = role
+	rcv.approvedName = approvedName
+	rcv.admitted = true
+	rcv.joinedAt = time.Now()
+	welcome := rcv.helloed
+	session.receivers.add(rcv)
+	paused := session.paused
+	winSize := session.lastWindowSizeMsg
+	session.mainRWLock.Unlock()
+
+	if welcome {
+		rcv.conn.SendWelcome(rcv.id, rcv.token)
+	}
+	if session.scrollback != nil && !paused {
+		rcv.conn.SetWinSize(winSize.Cols, winSize.Rows)
+		rcv.conn.Write(session.scrollback.Bytes())
+	}
+	return nil
+}
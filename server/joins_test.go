@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// Connects to the session abc of the server at the URL, introducing itself with the name
+func testConnect(t *testing.T, url, name string) *TTYProtocolWSLocked {
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/s/abc/ws/", nil)
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err.Error())
+	}
+	t.Cleanup(func() { wsConn.Close() })
+	conn := NewTTYProtocolWSLocked(wsConn)
+	conn.SendHello(MsgTTYHello{Name: name})
+	return conn
+}
+
+// Reads the output until it contains the text, or until the connection is closed. Returns the
+// output, and whether the participant was welcomed
+func testReadOutput(conn *TTYProtocolWSLocked, text string) (string, bool) {
+	output, welcomed := "", false
+	for !strings.Contains(output, text) {
+		err := conn.ReadAndHandle(TTYProtocolHandlers{
+			OnWrite:   func(data []byte) { output += string(data) },
+			OnWelcome: func(id, token string) { welcomed = true },
+		})
+		if err != nil {
+			break
+		}
+	}
+	return output, welcomed
+}
+
+func TestJoinApproval(t *testing.T) {
+	requests := make(chan ApprovalRequest)
+	roles := make(chan ParticipantRole)
+	input := make(chanPTY, 1)
+	server := NewTTYServer(TTYServerConfig{
+		SessionID: "abc",
+		PTY:       input,
+		JoinApprover: func(req ApprovalRequest) ParticipantRole {
+			requests <- req
+			return <-roles
+		},
+	})
+	app := httptest.NewServer(server)
+	defer app.Close()
+	defer server.Stop()
+
+	// Turned away
+	conn := testConnect(t, app.URL, "mallory")
+	if output, _ := testReadOutput(conn, "Waiting for the sharer"); !strings.Contains(output, "Waiting for the sharer") {
+		t.Errorf("expected the waiting screen, got %q", output)
+	}
+	if req := <-requests; req.Kind != ApprovalJoin || req.ParticipantName != "mallory" {
+		t.Errorf("unexpected approval request: %+v", req)
+	}
+	roles <- RoleRejected
+	output, welcomed := testReadOutput(conn, "\x00")
+	if welcomed || !strings.Contains(output, "the sharer didn't let you in") {
+		t.Errorf("expected to be turned away, got %q (welcomed: %t)", output, welcomed)
+	}
+
+	// Let in as a viewer, whose input is ignored
+	conn = testConnect(t, app.URL, "bob")
+	<-requests
+	roles <- RoleViewer
+	testWelcome(t, conn)
+	conn.Write([]byte("rm -rf /\r"))
+	for notice := ""; notice == ""; {
+		err := conn.ReadAndHandle(TTYProtocolHandlers{OnNotice: func(text string) { notice = text }})
+		if err != nil {
+			t.Fatalf("cannot read: %s", err.Error())
+		}
+		if notice != "" && !strings.Contains(notice, "viewer") {
+			t.Errorf("unexpected notice %q", notice)
+		}
+	}
+	select {
+	case data := <-input:
+		t.Errorf("the input of a viewer reached the application: %q", data)
+	default:
+	}
+}
+
+func TestMaxParticipants(t *testing.T) {
+	server := NewTTYServer(TTYServerConfig{SessionID: "abc", PTY: testPTY{}, MaxParticipants: 1})
+	app := httptest.NewServer(server)
+	defer app.Close()
+	defer server.Stop()
+
+	testJoin(t, app.URL, "alice")
+	output, welcomed := testReadOutput(testConnect(t, app.URL, "bob"), "\x00")
+	if welcomed || !strings.Contains(output, errSessionFull.Error()) {
+		t.Errorf("expected the session to be full, got %q (welcomed: %t)", output, welcomed)
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long before the end of the session the participants and the sharer are warned
+var lifetimeWarnings = []time.Duration{5 * time.Minute, time.Minute, 10 * time.Second}
+
+// How long before disconnecting an idle viewer, it's warned
+const viewerIdleWarning = time.Minute
+
+// The limits of the session's lifetime. The zero values mean no limit
+type lifetimeLimits struct {
+	// The session ends after being idle this long: no input, no output, and no participants
+	idleTimeout time.Duration
+	maxDuration time.Duration
+	expiresAt   time.Time
+}
+
+// Decides when the session ends, according to the limits, and when to warn about it
+type lifetime struct {
+	limits    lifetimeLimits
+	startedAt time.Time
+	// The last time the session was active
+	activeAt time.Time
+	// The time left until the end, last time it was checked. The warnings are given when this
+	// crosses one of the lifetimeWarnings. Negative before the first check
+	lastLeft time.Duration
+}
+
+func newLifetime(limits lifetimeLimits, now time.Time) *lifetime {
+	return &lifetime{
+		limits:    limits,
+		startedAt: now,
+		activeAt:  now,
+		lastLeft:  -1,
+	}
+}
+
+// Returns when the session ends, and why, or a zero time if it doesn't
+func (lt *lifetime) end() (time.Time, string) {
+	var end time.Time
+	var reason string
+	earlier := func(t time.Time, why string) {
+		if end.IsZero() || t.Before(end) {
+			end, reason = t, why
+		}
+	}
+
+	if lt.limits.idleTimeout > 0 {
+		earlier(lt.activeAt.Add(lt.limits.idleTimeout), fmt.Sprintf("idle timeout of %s", lt.limits.idleTimeout))
+	}
+	if lt.limits.maxDuration > 0 {
+		earlier(lt.startedAt.Add(lt.limits.maxDuration), fmt.Sprintf("maximum duration of %s", lt.limits.maxDuration))
+	}
+	if !lt.limits.expiresAt.IsZero() {
+		earlier(lt.limits.expiresAt, fmt.Sprintf("expiry time %s", lt.limits.expiresAt.Format("2006-01-02 15:04")))
+	}
+	return end, reason
+}
+
+// Checks the limits at the given time, knowing if the session was active since the last check.
+// Returns the warning to give, if any, and whether the session ended, with the reason.
+func (lt *lifetime) check(now time.Time, active bool) (warning string, ended bool, reason string) {
+	if active {
+		lt.activeAt = now
+	}
+
+	end, reason := lt.end()
+	if end.IsZero() {
+		return "", false, ""
+	}
+	left := end.Sub(now)
+	if left <= 0 {
+		return "", true, reason
+	}
+
+	// Warn when the time left crosses one of the thresholds. It can grow back, with the activity
+	for _, before := range lifetimeWarnings {
+		if left <= before && lt.lastLeft > before {
+			warning = fmt.Sprintf("the session ends in %s (%s)", left.Round(time.Second), reason)
+			break
+		}
+	}
+	lt.lastLeft = left
+	return warning, false, ""
+}
+
+// Checks the limits of the session's lifetime, and of the participants' idle time, every second,
+// until the server stops
+func (server *TTYServer) watchLifetime() {
+	limits := lifetimeLimits{
+		idleTimeout: server.config.IdleTimeout,
+		maxDuration: server.config.MaxDuration,
+		expiresAt:   server.config.ExpiresAt,
+	}
+	lt := newLifetime(limits, time.Now())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-server.done:
+			return
+		case now := <-ticker.C:
+			if server.config.ViewerIdleTimeout > 0 {
+				server.session.checkIdleReceivers(now, server.config.ViewerIdleTimeout)
+			}
+
+			warning, ended, reason := lt.check(now, server.session.takeActivity())
+			if warning != "" {
+				log.Infof("Warning the participants: %s", warning)
+				server.session.notify(warning)
+				if server.config.OnWarning != nil {
+					server.config.OnWarning(warning)
+				}
+			}
+			if ended {
+				log.Infof("The session ended: %s", reason)
+				server.session.notify(fmt.Sprintf("the session ended (%s)", reason))
+				if server.config.OnEnd != nil {
+					server.config.OnEnd(reason)
+				}
+				return
+			}
+		}
+	}
+}
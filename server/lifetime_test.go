@@ -0,0 +1,54 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLifetimeMaxDuration(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	lt := newLifetime(lifetimeLimits{maxDuration: 10 * time.Minute}, start)
+
+	var warnings []string
+	for now := start; now.Before(start.Add(10 * time.Minute)); now = now.Add(time.Second) {
+		warning, ended, _ := lt.check(now, true)
+		if ended {
+			t.Fatalf("The session ended too early, at %s", now)
+		}
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+	if len(warnings) != 3 || !strings.Contains(warnings[0], "5m0s") || !strings.Contains(warnings[2], "10s") {
+		t.Errorf("Unexpected warnings %q", warnings)
+	}
+
+	if _, ended, reason := lt.check(start.Add(10*time.Minute), true); !ended || !strings.Contains(reason, "maximum duration") {
+		t.Errorf("The session didn't end: %s", reason)
+	}
+}
+
+func TestLifetimeIdle(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	lt := newLifetime(lifetimeLimits{idleTimeout: 2 * time.Minute, expiresAt: start.Add(time.Hour)}, start)
+
+	// Idle, then active again, just before the end
+	lt.check(start.Add(time.Second), false)
+	warning, ended, _ := lt.check(start.Add(61*time.Second), false)
+	if warning == "" || ended {
+		t.Errorf("Expected a warning, got %q", warning)
+	}
+	if _, ended, _ := lt.check(start.Add(119*time.Second), true); ended {
+		t.Errorf("The session ended, while active")
+	}
+
+	// Then idle for good
+	warning, _, _ = lt.check(start.Add(180*time.Second), false)
+	if !strings.Contains(warning, "idle timeout") {
+		t.Errorf("Expected a warning about the idle timeout, got %q", warning)
+	}
+	if _, ended, reason := lt.check(start.Add(240*time.Second), false); !ended || !strings.Contains(reason, "idle timeout") {
+		t.Errorf("The session didn't end: %s", reason)
+	}
+}
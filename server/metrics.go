@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// TrafficMetrics describes the data sent on some WS connections
+type TrafficMetrics struct {
+	// The bytes of the messages sent, before the compression
+	MessageBytes int64
+	// The bytes which went out on the connections, after the compression, framing included
+	WireBytes int64
+}
+
+// CompressionRatio returns how many times smaller the data got on the wire, e.g.: 4 when the
+// messages were compressed to a quarter of their size. 0 if nothing was sent yet
+func (m TrafficMetrics) CompressionRatio() float64 {
+	if m.WireBytes == 0 {
+		return 0
+	}
+	return float64(m.MessageBytes) / float64(m.WireBytes)
+}
+
+// Metrics describes the traffic of the session
+type Metrics struct {
+	// The output, and the other messages sent to the participants
+	TTY TrafficMetrics
+	// The data sent to the participants through their tunnels
+	Tunnels TrafficMetrics
+}
+
+// Counts the data sent on some WS connections
+type trafficCounter struct {
+	// Kept first, for the alignment needed by the atomic operations
+	messageBytes int64
+	wireBytes    int64
+}
+
+func (counter *trafficCounter) addMessage(size int) {
+	if counter != nil {
+		atomic.AddInt64(&counter.messageBytes, int64(size))
+	}
+}
+
+func (counter *trafficCounter) metrics() TrafficMetrics {
+	return TrafficMetrics{
+		MessageBytes: atomic.LoadInt64(&counter.messageBytes),
+		WireBytes:    atomic.LoadInt64(&counter.wireBytes),
+	}
+}
+
+// Counts the bytes written on the connection hijacked by the WS upgrader, once counting is set,
+// so the handshake isn't counted
+type wireCountingConn struct {
+	net.Conn
+	counter  *trafficCounter
+	counting int32
+}
+
+func (conn *wireCountingConn) Write(p []byte) (int, error) {
+	n, err := conn.Conn.Write(p)
+	if atomic.LoadInt32(&conn.counting) == 1 {
+		atomic.AddInt64(&conn.counter.wireBytes, int64(n))
+	}
+	return n, err
+}
+
+// Hands a wireCountingConn to the WS upgrader, instead of the connection of the HTTP request
+type wireCountingResponseWriter struct {
+	http.ResponseWriter
+	counter *trafficCounter
+	conn    *wireCountingConn
+}
+
+func (w *wireCountingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the connection cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = &wireCountingConn{Conn: conn, counter: w.counter}
+	return w.conn, bufio.NewReadWriter(rw.Reader, bufio.NewWriter(w.conn)), nil
+}
+
+// Starts counting the bytes written, once the WS handshake is done
+func (w *wireCountingResponseWriter) startCounting() {
+	if w.conn != nil {
+		atomic.StoreInt32(&w.conn.counting, 1)
+	}
+}
+
+// Metrics returns the traffic of the session so far
+func (server *TTYServer) Metrics() Metrics {
+	return Metrics{
+		TTY:     server.ttyTraffic.metrics(),
+		Tunnels: server.tunnelTraffic.metrics(),
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+)
+
+// The start of an OSC 52 sequence, which sets or queries the clipboard
+var osc52Prefix = []byte("\x1b]52;")
+
+// Longest OSC 52 sequence we wait for. Anything longer is passed through as it is
+const maxOSC52Size = 1024 * 1024
+
+// OSC52 is a clipboard sequence: ESC ] 52 ; <selection> ; <base64 data> terminated by BEL or ST
+type OSC52 struct {
+	// The clipboard to set or query, e.g.: c (the clipboard), p (the primary selection). Empty
+	// means the default one
+	Selection string
+	// The contents of the clipboard
+	Data []byte
+	// Set when the application asks for the contents of the clipboard, instead of setting it
+	Query bool
+}
+
+// Sequence returns the OSC 52 escape sequence, terminated by BEL
+func (clip OSC52) Sequence() []byte {
+	payload := "?"
+	if !clip.Query {
+		payload = base64.StdEncoding.EncodeToString(clip.Data)
+	}
+	return []byte(fmt.Sprintf("\x1b]52;%s;%s\a", clip.Selection, payload))
+}
+
+// OSC52Parser takes the OSC 52 sequences out of a stream of terminal data, or of keyboard input.
+// The sequences can be split across the writes after their prefix, so a sequence is kept from its
+// prefix until the rest of it arrives. The prefix itself has to come in one write: holding back a
+// lone ESC, or ESC ], would delay the Escape and Alt keys, or the end of the output, until the next
+// write.
+type OSC52Parser struct {
+	pending []byte
+}
+
+// Parses the contents of a sequence, between the prefix and the terminator. The invalid ones are
+// dropped
+func parseOSC52(content []byte) (OSC52, bool) {
+	sep := bytes.IndexByte(content, ';')
+	if sep < 0 {
+		return OSC52{}, false
+	}
+	clip := OSC52{Selection: string(content[:sep])}
+	payload := content[sep+1:]
+	if string(payload) == "?" {
+		clip.Query = true
+		return clip, true
+	}
+
+	data, err := base64.StdEncoding.DecodeString(string(payload))
+	if err != nil {
+		if data, err = base64.RawStdEncoding.DecodeString(string(payload)); err != nil {
+			return OSC52{}, false
+		}
+	}
+	clip.Data = data
+	return clip, true
+}
+
+// Returns the position of the terminator of the sequence starting at the beginning of data, and
+// its length, or -1 if it's not there yet
+func findOSCTerminator(data []byte) (int, int) {
+	for i := len(osc52Prefix); i < len(data); i++ {
+		if data[i] == '\a' {
+			return i, 1
+		}
+		if data[i] == '\x1b' && i+1 < len(data) && data[i+1] == '\\' {
+			return i, 2
+		}
+	}
+	return -1, 0
+}
+
+// Parse returns the data without the OSC 52 sequences, and the sequences it found. The data it
+// returns misses the end, if that's a sequence without its terminator yet, which is then returned
+// by the next calls.
+func (p *OSC52Parser) Parse(data []byte) ([]byte, []OSC52) {
+	// Most of the time, there's nothing to do
+	if len(p.pending) == 0 && !bytes.Contains(data, osc52Prefix) {
+		return data, nil
+	}
+
+	buff := append(p.pending, data...)
+	p.pending = nil
+	out := make([]byte, 0, len(buff))
+	var clips []OSC52
+
+	for len(buff) > 0 {
+		start := bytes.IndexByte(buff, '\x1b')
+		if start < 0 {
+			out = append(out, buff...)
+			break
+		}
+		out = append(out, buff[:start]...)
+		buff = buff[start:]
+
+		if bytes.HasPrefix(buff, osc52Prefix) {
+			end, termLen := findOSCTerminator(buff)
+			if end >= 0 {
+				if clip, ok := parseOSC52(buff[len(osc52Prefix):end]); ok {
+					clips = append(clips, clip)
+				}
+				buff = buff[end+termLen:]
+				continue
+			}
+			if len(buff) <= maxOSC52Size {
+				p.pending = append([]byte{}, buff...)
+				break
+			}
+		}
+
+		// Not a sequence we're interested in
+		out = append(out, buff[0])
+		buff = buff[1:]
+	}
+	return out, clips
+}
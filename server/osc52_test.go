@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOSC52Parser(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		output string
+		clips  []OSC52
+	}{
+		{"no sequence", []string{"hello \x1b[31mworld\x1b]0;title\a"}, "hello \x1b[31mworld\x1b]0;title\a", nil},
+		{"BEL", []string{"a\x1b]52;c;aGVsbG8=\ab"}, "ab", []OSC52{{Selection: "c", Data: []byte("hello")}}},
+		{"ST", []string{"a\x1b]52;p;aGVsbG8=\x1b\\b"}, "ab", []OSC52{{Selection: "p", Data: []byte("hello")}}},
+		{"query", []string{"\x1b]52;c;?\a"}, "", []OSC52{{Selection: "c", Query: true}}},
+		{"no padding", []string{"\x1b]52;;aGk\a"}, "", []OSC52{{Selection: "", Data: []byte("hi")}}},
+		{"split", []string{"a\x1b]52;", "c;aGVs", "bG8=\x1b", "\\b"}, "ab", []OSC52{{Selection: "c", Data: []byte("hello")}}},
+		{"split prefix", []string{"a\x1b]5", "2;c;YQ==\a"}, "a\x1b]52;c;YQ==\a", nil},
+		{"escape", []string{"\x1b"}, "\x1b", nil},
+		{"alt-]", []string{"\x1b]"}, "\x1b]", nil},
+		{"split, not a sequence", []string{"a\x1b]5", "3;x\a"}, "a\x1b]53;x\a", nil},
+		{"invalid", []string{"a\x1b]52;c;!!\ab"}, "ab", nil},
+		{"two", []string{"\x1b]52;c;YQ==\a-\x1b]52;c;Yg==\a"}, "-", []OSC52{{Selection: "c", Data: []byte("a")}, {Selection: "c", Data: []byte("b")}}},
+	}
+
+	for _, test := range tests {
+		var parser OSC52Parser
+		var output []byte
+		var clips []OSC52
+		for _, write := range test.writes {
+			out, c := parser.Parse([]byte(write))
+			output = append(output, out...)
+			clips = append(clips, c...)
+		}
+		if !bytes.Equal(output, []byte(test.output)) {
+			t.Errorf("%s: expected the output %q, got %q", test.name, test.output, output)
+		}
+		if !reflect.DeepEqual(clips, test.clips) {
+			t.Errorf("%s: expected the sequences %+v, got %+v", test.name, test.clips, clips)
+		}
+	}
+}
+
+func TestOSC52Sequence(t *testing.T) {
+	var parser OSC52Parser
+	clip := OSC52{Selection: "c", Data: []byte("copied text")}
+	if _, clips := parser.Parse(clip.Sequence()); len(clips) != 1 || !reflect.DeepEqual(clips[0], clip) {
+		t.Errorf("Unexpected sequences %+v", clips)
+	}
+}
+
+func TestAnswerClipboardWriterOnly(t *testing.T) {
+	input := make(chanPTY, 1)
+	server := NewTTYServer(TTYServerConfig{SessionID: "abc", PTY: input, ClipboardPush: true})
+	session := server.session
+	answer := OSC52{Selection: "c", Data: []byte("secret")}
+
+	viewer := &ttyReceiver{id: "viewer", clipboardPush: true, admitted: true, role: RoleViewer}
+	session.clipboardQueryAt = time.Now()
+	session.answerClipboard(viewer, answer)
+	select {
+	case data := <-input:
+		t.Errorf("the answer of a viewer reached the application: %q", data)
+	default:
+	}
+
+	writer := &ttyReceiver{id: "writer", clipboardPush: true, admitted: true, role: RoleWriter}
+	session.answerClipboard(writer, answer)
+	select {
+	case data := <-input:
+		if !bytes.Equal(data, answer.Sequence()) {
+			t.Errorf("expected the answer %q, got %q", answer.Sequence(), data)
+		}
+	default:
+		t.Errorf("the answer of a writer didn't reach the application")
+	}
+}
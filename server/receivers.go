@@ -0,0 +1,55 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// The receivers admitted in the session, in the order they joined. The set is copied when a
+// receiver is added or removed, which is rare, so the output can go to all of them without locking,
+// and without copying the set for each chunk of output
+type receiverSet struct {
+	// The current []*ttyReceiver. Replaced on each change, never changed in place
+	snapshot atomic.Value
+	// Serializes the changes
+	mutex sync.Mutex
+}
+
+func newReceiverSet() *receiverSet {
+	set := &receiverSet{}
+	set.snapshot.Store([]*ttyReceiver{})
+	return set
+}
+
+// Returns the receivers. The slice must not be changed
+func (set *receiverSet) list() []*ttyReceiver {
+	return set.snapshot.Load().([]*ttyReceiver)
+}
+
+func (set *receiverSet) len() int {
+	return len(set.list())
+}
+
+func (set *receiverSet) add(rcv *ttyReceiver) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	old := set.list()
+	receivers := make([]*ttyReceiver, len(old), len(old)+1)
+	copy(receivers, old)
+	set.snapshot.Store(append(receivers, rcv))
+}
+
+func (set *receiverSet) remove(rcv *ttyReceiver) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	old := set.list()
+	receivers := make([]*ttyReceiver, 0, len(old))
+	for _, r := range old {
+		if r != rcv {
+			receivers = append(receivers, r)
+		}
+	}
+	set.snapshot.Store(receivers)
+}
@@ -0,0 +1,27 @@
+package server
+
+import "testing"
+
+func TestReceiverSet(t *testing.T) {
+	set := newReceiverSet()
+	a, b, c := &ttyReceiver{id: "a"}, &ttyReceiver{id: "b"}, &ttyReceiver{id: "c"}
+	set.add(a)
+	set.add(b)
+
+	// The receivers taken before a change don't see it
+	before := set.list()
+	set.add(c)
+	set.remove(a)
+	if len(before) != 2 || before[0] != a || before[1] != b {
+		t.Errorf("the snapshot changed: %v", before)
+	}
+
+	after := set.list()
+	if set.len() != 2 || after[0] != b || after[1] != c {
+		t.Errorf("unexpected receivers: %v", after)
+	}
+	set.remove(a)
+	if set.len() != 2 {
+		t.Errorf("removing a missing receiver changed the set")
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import "bytes"
+
+// Keeps the last bytes of the output, to replay them to the receivers who join later, when there's
+// no application to redraw the terminal for them (e.g.: a shared pipe)
+type scrollback struct {
+	size int
+	// Up to twice the size, so the output is not copied on each write
+	data []byte
+}
+
+func newScrollback(size int) *scrollback {
+	return &scrollback{size: size}
+}
+
+func (sb *scrollback) Write(data []byte) {
+	sb.data = append(sb.data, data...)
+	if len(sb.data) > 2*sb.size {
+		sb.data = append([]byte(nil), sb.data[len(sb.data)-sb.size:]...)
+	}
+}
+
+// Returns the last bytes of the output, at most the size of the scrollback. When some output was
+// dropped, they start after a line break, not to replay half of an escape sequence, or of a
+// character
+func (sb *scrollback) Bytes() []byte {
+	if len(sb.data) <= sb.size {
+		return sb.data
+	}
+	tail := sb.data[len(sb.data)-sb.size:]
+	if i := bytes.IndexByte(tail, '\n'); i >= 0 {
+		tail = tail[i+1:]
+	}
+	return tail
+}
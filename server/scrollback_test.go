@@ -0,0 +1,32 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScrollback(t *testing.T) {
+	sb := newScrollback(10)
+	sb.Write([]byte("one\n"))
+	sb.Write([]byte("two\n"))
+	if out := string(sb.Bytes()); out != "one\ntwo\n" {
+		t.Errorf("unexpected scrollback: %q", out)
+	}
+
+	// Once full, it starts after the first line break of the last 10 bytes
+	sb.Write([]byte("three\n"))
+	if out := string(sb.Bytes()); out != "three\n" {
+		t.Errorf("unexpected scrollback: %q", out)
+	}
+
+	// Without line breaks, it's just the last 10 bytes
+	for i := 0; i < 10; i++ {
+		sb.Write([]byte("abc"))
+	}
+	if out := string(sb.Bytes()); out != strings.Repeat("abc", 4)[2:] {
+		t.Errorf("unexpected scrollback: %q", out)
+	}
+	if len(sb.data) > 20 {
+		t.Errorf("the scrollback keeps too much: %d bytes", len(sb.data))
+	}
+}
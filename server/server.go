@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -10,6 +11,10 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -17,6 +22,10 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// The size of the smallest message worth compressing, in bytes. The ones smaller than that don't
+// get much smaller, or get even larger
+const DefaultCompressionThreshold = 256
+
 const (
 	errorNotFound   = iota
 	errorNotAllowed = iota
@@ -27,6 +36,12 @@ type PTYHandler interface {
 	Refresh()
 }
 
+// PTYResizer is used by the server to change the size of the shared terminal, according to the
+// WinSizePolicy
+type PTYResizer interface {
+	SetWinSize(rows, cols int)
+}
+
 // SessionTemplateModel used for templating
 type AASessionTemplateModel struct {
 	SessionID string
@@ -42,15 +57,121 @@ type TTYServerConfig struct {
 	SessionID          string
 	AllowTunneling     bool
 	CrossOrigin        bool
-	BaseUrlPath        string
+	// The path the session is served under, e.g.: /tty, for /tty/s/local/. It is cleaned with
+	// CleanBaseUrlPath. The requests passed to ServeHTTP keep it in their paths
+	BaseUrlPath string
+	// Allow the clients to ask the server to listen for connections, and forward them back to the
+	// client side
+	AllowReverseTunneling bool
+	// Decides which destinations the tunnels can reach, and which ports of the loopback interface
+	// the reverse tunnels can listen on (see TunnelPolicy.CheckListen). If nil, all of them
+	TunnelPolicy *TunnelPolicy
+	// The names of the participants allowed to open tunnels. If empty, all of them. The names are
+	// checked against the ones the sharer let the participants in with, so none is allowed without
+	// a JoinApprover
+	TunnelUsers []string
+	// If set, the sharer is asked to approve each new tunnel destination of each participant
+	TunnelApprover Approver
+	// If nil, the server never resizes the shared terminal
+	PTYResizer    PTYResizer
+	WinSizePolicy WinSizePolicy
+	// Used only with the WinSizePolicyFixed policy
+	FixedCols int
+	FixedRows int
+	// The directory the participants can upload files to. If empty, uploads are not allowed
+	UploadDir string
+	// The paths of the files the participants can download, by their base name
+	OfferedFiles []string
+	// The size limit of the uploaded files. No limit if 0
+	MaxFileSize int64
+	// The names of the participants allowed to transfer files. If empty, all of them. Like the
+	// TunnelUsers, these need a JoinApprover
+	FileUsers []string
+	// If set, the sharer is asked to approve each upload
+	FileApprover Approver
+	// If set, each file transfer is logged to it, as a JSON line (see FileAuditEntry)
+	AuditLog io.Writer
+	// Let the participants answer the clipboard queries of the applications (OSC 52), with the
+	// contents of their own clipboard
+	ClipboardPush bool
+	// The session ends after being idle this long: no input, no output, and no participants. No
+	// limit if 0
+	IdleTimeout time.Duration
+	// The session ends after this long. No limit if 0
+	MaxDuration time.Duration
+	// The session ends at this time. No limit if zero
+	ExpiresAt time.Time
+	// The participants who don't type, or resize their window, this long, are disconnected. No
+	// limit if 0
+	ViewerIdleTimeout time.Duration
+	// Called with the warnings about the end of the session, which are also sent to the participants
+	OnWarning func(text string)
+	// Called when the session ends, because of one of the limits above
+	OnEnd func(reason string)
+	// If set, the new participants wait until the sharer admits them, as viewers or writers
+	JoinApprover JoinApprover
+	// The most participants in the session at the same time. No limit if 0
+	MaxParticipants int
+	// Stops the participants from typing. Can be changed later, with SetReadOnly
+	ReadOnly bool
+	// How many bytes of the output to keep, and replay to the participants who join later, instead
+	// of having the application redraw itself for them. For the sessions without an application to
+	// redraw, e.g.: a shared pipe. Nothing is kept if 0
+	Scrollback int
+	// How long the output is held, to go out with the output which follows, in fewer messages. The
+	// output following some input, likely its echo, is not held. Not held at all if 0
+	OutputBatchDelay time.Duration
+	// The most output held, in bytes. 32K if 0
+	OutputBatchSize int
+	// The level of the permessage-deflate compression of the WS connections, if the other side
+	// supports it: from 1 (best speed) to 9 (best compression), -1 for the default one, or -2 for
+	// Huffman only (see compress/flate). No compression if 0
+	CompressionLevel int
+	// The messages smaller than this many bytes are sent uncompressed, as compressing them doesn't
+	// pay off (see DefaultCompressionThreshold). All of them are compressed if 0
+	CompressionThreshold int
+	// Keeps the tunnels uncompressed, e.g.: when they carry encrypted data, which doesn't compress
+	NoTunnelCompression bool
+	// The version of tty-share, reported in the Info
+	Version string
+	// Called when the sharing is paused or resumed, with SetPaused
+	OnPause func(paused bool)
+	// Called when a participant is admitted in the session, and when it leaves
+	OnJoin  func(participant ParticipantInfo)
+	OnLeave func(participant ParticipantInfo)
 }
 
 // TTYServer represents the instance of a tty server
 type TTYServer struct {
-	httpServer       *http.Server
-	config           TTYServerConfig
-	session          *ttyShareSession
-	muxTunnelSession *yamux.Session
+	httpServer *http.Server
+	handler    http.Handler
+	config     TTYServerConfig
+	session    *ttyShareSession
+	tunnels    *tunnelRegistry
+	audit      *auditLog
+	// Batches the output, if set
+	batcher *outputBatcher
+	// Count the data sent on the TTY and on the tunnel WS connections
+	ttyTraffic    trafficCounter
+	tunnelTraffic trafficCounter
+	// When the server was created, for the Info
+	startedAt time.Time
+	// Closed when the server stops
+	done     chan struct{}
+	stopOnce sync.Once
+	// The file transfers in progress, which Shutdown waits for
+	transfers      sync.WaitGroup
+	transfersMutex sync.Mutex
+}
+
+// CleanBaseUrlPath returns the base URL path with a leading forward slash, and without a trailing
+// one. Both "" and "/" are cleaned to ""
+func CleanBaseUrlPath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
 }
 
 func (server *TTYServer) serveContent(w http.ResponseWriter, r *http.Request, name string) {
@@ -87,8 +208,13 @@ func (server *TTYServer) serveContent(w http.ResponseWriter, r *http.Request, na
 
 // NewTTYServer creates a new instance
 func NewTTYServer(config TTYServerConfig) (server *TTYServer) {
+	config.BaseUrlPath = CleanBaseUrlPath(config.BaseUrlPath)
 	server = &TTYServer{
-		config: config,
+		config:    config,
+		tunnels:   newTunnelRegistry(),
+		audit:     &auditLog{w: config.AuditLog},
+		done:      make(chan struct{}),
+		startedAt: time.Now(),
 	}
 	server.httpServer = &http.Server{
 		Addr: config.FrontListenAddress,
@@ -102,6 +228,8 @@ func NewTTYServer(config TTYServerConfig) (server *TTYServer) {
 		staticPath := baseUrlPath + "/s/" + session + "/static/"
 		ttyWsPath := baseUrlPath + "/s/" + session + "/ws/"
 		tunnelWsPath := baseUrlPath + "/s/" + session + "/tws"
+		filesWsPath := baseUrlPath + "/s/" + session + "/fws"
+		filesEnabled := config.UploadDir != "" || len(config.OfferedFiles) > 0
 		pathPrefix := baseUrlPath + "/s/" + session
 
 		routesHandler.PathPrefix(staticPath).Handler(http.StripPrefix(staticPath,
@@ -112,12 +240,15 @@ func NewTTYServer(config TTYServerConfig) (server *TTYServer) {
 		routesHandler.HandleFunc(pathPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
 			// Check the frontend/templates/tty-share.in.html file to see where the template applies
 			templateModel := struct {
-				PathPrefix string
-				WSPath     string
-			}{pathPrefix, ttyWsPath}
+				PathPrefix  string
+				WSPath      string
+				FilesWSPath string
+			}{pathPrefix, ttyWsPath, ""}
+			if filesEnabled {
+				templateModel.FilesWSPath = filesWsPath
+			}
 
-			// TODO Extract these in constants
-			w.Header().Add("TTYSHARE-VERSION", "2")
+			w.Header().Add("TTYSHARE-VERSION", strconv.Itoa(ProtocolVersion))
 
 			// Deprecated HEADER (from prev version)
 			// TODO: Find a proper way to stop handling backward versions
@@ -125,20 +256,32 @@ func NewTTYServer(config TTYServerConfig) (server *TTYServer) {
 
 			w.Header().Add("TTYSHARE-TTY-WSPATH", ttyWsPath)
 			w.Header().Add("TTYSHARE-TUNNEL-WSPATH", tunnelWsPath)
+			if filesEnabled {
+				w.Header().Add("TTYSHARE-FILES-WSPATH", filesWsPath)
+			}
 
 			server.handleWithTemplateHtml(w, r, "tty-share.in.html", templateModel)
 		})
+		routesHandler.HandleFunc(pathPrefix+"/info", func(w http.ResponseWriter, r *http.Request) {
+			server.handleInfo(w, r, session, config.CrossOrigin)
+		})
 		routesHandler.HandleFunc(ttyWsPath, func(w http.ResponseWriter, r *http.Request) {
 			server.handleTTYWebsocket(w, r, config.CrossOrigin)
 		})
-		if server.config.AllowTunneling {
+		if server.config.AllowTunneling || server.config.AllowReverseTunneling {
 			// tunnel websockets connection
 			routesHandler.HandleFunc(tunnelWsPath, func(w http.ResponseWriter, r *http.Request) {
 				server.handleTunnelWebsocket(w, r)
 			})
 		}
+		if filesEnabled {
+			// file transfer websockets connection
+			routesHandler.HandleFunc(filesWsPath, func(w http.ResponseWriter, r *http.Request) {
+				server.handleFilesWebsocket(w, r)
+			})
+		}
 		routesHandler.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			templateModel := struct{ PathPrefix string }{fmt.Sprintf("/s/%s", session)}
+			templateModel := struct{ PathPrefix string }{fmt.Sprintf("%s/s/%s", config.BaseUrlPath, session)}
 			server.handleWithTemplateHtml(w, r, "404.in.html", templateModel)
 		})
 	}
@@ -148,40 +291,77 @@ func NewTTYServer(config TTYServerConfig) (server *TTYServer) {
 	installHandlers("local")
 	installHandlers(config.SessionID)
 
-	server.httpServer.Handler = routesHandler
-	server.session = newTTYShareSession(config.PTY)
+	server.handler = routesHandler
+	server.httpServer.Handler = server
+	server.session = newTTYShareSession(config.PTY, config.PTYResizer, config.WinSizePolicy,
+		MsgTTYWinSize{Cols: config.FixedCols, Rows: config.FixedRows})
+	server.session.clipboardPush = config.ClipboardPush
+	server.session.joinApprover = config.JoinApprover
+	server.session.maxParticipants = config.MaxParticipants
+	server.session.readOnly = config.ReadOnly
+	server.session.compressionThreshold = config.CompressionThreshold
+	server.session.traffic = &server.ttyTraffic
+	if config.Scrollback > 0 {
+		server.session.scrollback = newScrollback(config.Scrollback)
+	}
+	if config.OutputBatchDelay > 0 {
+		server.batcher = newOutputBatcher(func(data []byte) {
+			server.session.Write(data)
+		}, config.OutputBatchDelay, config.OutputBatchSize)
+		server.session.onInput = server.batcher.input
+		server.session.batcher = server.batcher
+	}
+	server.session.onPause = config.OnPause
+	server.session.onJoin = config.OnJoin
+	server.session.onLeave = config.OnLeave
 
+	if config.IdleTimeout > 0 || config.MaxDuration > 0 || !config.ExpiresAt.IsZero() || config.ViewerIdleTimeout > 0 {
+		go server.watchLifetime()
+	}
 	return server
 }
 
+// Upgrades the request to a WS connection, with the compression level of the config, if the
+// compression was negotiated. The bytes it sends are counted in traffic
+func (server *TTYServer) upgrade(upgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Request, traffic *trafficCounter) (*websocket.Conn, error) {
+	countingWriter := &wireCountingResponseWriter{ResponseWriter: w, counter: traffic}
+	conn, err := upgrader.Upgrade(countingWriter, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	countingWriter.startCounting()
+	if upgrader.EnableCompression {
+		if err := conn.SetCompressionLevel(server.config.CompressionLevel); err != nil {
+			log.Warnf("Cannot set the compression level: %s", err.Error())
+		}
+	}
+	return conn, nil
+}
+
 func (server *TTYServer) handleTTYWebsocket(w http.ResponseWriter, r *http.Request, crossOrigin bool) {
 	if r.Method != "GET" {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		EnableCompression: server.config.CompressionLevel != 0,
 	}
 	if crossOrigin {
-		upgrader = websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			return true
 		}
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := server.upgrade(&upgrader, w, r, &server.ttyTraffic)
 
 	if err != nil {
 		log.Error("Cannot create the WS connection: ", err.Error())
 		return
 	}
 
-	// On a new connection, ask for a refresh/redraw of the terminal app
-	server.config.PTY.Refresh()
+	// The terminal app is redrawn once the new participant is admitted in the session
 	server.session.HandleWSConnection(conn)
 }
 
@@ -192,10 +372,11 @@ func (server *TTYServer) handleTunnelWebsocket(w http.ResponseWriter, r *http.Re
 	}
 
 	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		EnableCompression: server.config.CompressionLevel != 0 && !server.config.NoTunnelCompression,
 	}
-	wsConn, err := upgrader.Upgrade(w, r, nil)
+	wsConn, err := server.upgrade(&upgrader, w, r, &server.tunnelTraffic)
 
 	if err != nil {
 		log.Error("Cannot upgrade to WS for tunnel route connection: ", err.Error())
@@ -219,19 +400,82 @@ func (server *TTYServer) handleTunnelWebsocket(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	// In the first version of the protocol, all the streams went to the Address. Its clients don't
+	// have the token of a participant either, so they can't open tunnels anyway
+	if !tunInitMsg.Reverse && tunInitMsg.Version < TunProtocolVersion && !tunInitMsg.Dynamic {
+		log.Warnf("Tunnel to %s refused: the version %d of the tunnel protocol is not supported", tunInitMsg.Address, tunInitMsg.Version)
+		CloseTunnelWithError(wsConn, &TunnelError{Code: TunErrorDenied, Message: fmt.Sprintf("the tunnels need the tunnel protocol version %d or newer: update tty-share", TunProtocolVersion)})
+		return
+	}
+
+	if tunInitMsg.Reverse && !server.config.AllowReverseTunneling {
+		log.Warnf("Reverse tunnel to %s refused: not allowed", tunInitMsg.Address)
+		CloseTunnelWithError(wsConn, &TunnelError{Code: TunErrorDenied, Message: "reverse tunnels are not allowed"})
+		return
+	}
+
+	if !tunInitMsg.Reverse && !server.config.AllowTunneling {
+		log.Warnf("Tunnel to %s refused: not allowed", tunInitMsg.Address)
+		CloseTunnelWithError(wsConn, &TunnelError{Code: TunErrorDenied, Message: "tunnels are not allowed"})
+		return
+	}
+
+	participant, err := server.tunnelParticipant(tunInitMsg.Token)
+	if err != nil {
+		log.Warnf("Tunnel refused: %s", err.Error())
+		CloseTunnelWithError(wsConn, err)
+		return
+	}
+
+	tunnel := server.tunnels.add(participant, tunInitMsg.Reverse, func(reason error) {
+		CloseTunnelWithError(wsConn, reason)
+		wsConn.Close()
+	})
+	defer server.tunnels.remove(tunnel)
+	log.Debugf("Tunnel %s of the participant %s started", tunnel.id, participant.id)
+
+	// The tunnels of a participant don't outlive its connection to the session
+	tunnelDone := make(chan struct{})
+	defer close(tunnelDone)
+	go func() {
+		select {
+		case <-participant.gone:
+			tunnel.close(&TunnelError{Code: TunErrorDenied, Message: "the participant left the session"})
+		case <-tunnelDone:
+		}
+	}()
+
 	wsRW := &WSConnReadWriteCloser{
-		WsConn: wsConn,
+		WsConn:               wsConn,
+		CompressionThreshold: server.config.CompressionThreshold,
+		traffic:              &server.tunnelTraffic,
 	}
 
-	server.muxTunnelSession, err = yamux.Server(wsRW, nil)
+	if tunInitMsg.Reverse {
+		if err := server.config.TunnelPolicy.CheckListen(tunInitMsg.Address); err != nil {
+			log.Warnf("Reverse tunnel on %s refused: %s", tunInitMsg.Address, err.Error())
+			CloseTunnelWithError(wsConn, err)
+			return
+		}
+		if err := server.approveTunnel(participant, ApprovalReverseTunnel, tunInitMsg.Address); err != nil {
+			log.Warnf("Reverse tunnel refused: %s", err.Error())
+			CloseTunnelWithError(wsConn, err)
+			return
+		}
+		server.handleReverseTunnel(tunnel, wsRW, tunInitMsg.Address)
+		return
+	}
+
+	muxSession, err := yamux.Server(wsRW, nil)
 
 	if err != nil {
 		log.Error("Could not open a mux server: ", err.Error())
 		return
 	}
+	defer muxSession.Close()
 
 	for {
-		muxStream, err := server.muxTunnelSession.Accept()
+		muxStream, err := muxSession.Accept()
 
 		if err != nil {
 			if err != io.EOF {
@@ -240,27 +484,166 @@ func (server *TTYServer) handleTunnelWebsocket(w http.ResponseWriter, r *http.Re
 			return
 		}
 
-		localConn, err := net.Dial("tcp", tunInitMsg.Address)
+		go server.handleTunnelStream(tunnel, muxStream)
+	}
+}
+
+// Copies the data both ways, until one of the connections is closed
+func pipeConns(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		// Not sure yet which of the two io.Copy finishes first, so just close everything in both cases
+		defer a.Close()
+		defer b.Close()
+	}()
+	io.Copy(b, a)
+	defer a.Close()
+	defer b.Close()
+}
+
+// Returns the participant with the given token, if it's allowed to open tunnels
+func (server *TTYServer) tunnelParticipant(token string) (*ttyReceiver, error) {
+	participant := server.session.receiverByToken(token)
+	if participant == nil {
+		return nil, &TunnelError{Code: TunErrorDenied, Message: "the tunnels need to be opened by a participant of the session"}
+	}
+
+	if len(server.config.TunnelUsers) == 0 {
+		return participant, nil
+	}
+	if server.session.approvedAs(participant, server.config.TunnelUsers) {
+		return participant, nil
+	}
+	name := server.session.receiverName(participant)
+	return nil, &TunnelError{Code: TunErrorDenied, Message: fmt.Sprintf("the participant %q is not allowed to open tunnels", name)}
+}
+
+// Asks the sharer to approve the tunnel of the participant to the target, if the server was
+// configured so. The sharer is asked only once for each participant and target.
+func (server *TTYServer) approveTunnel(participant *ttyReceiver, kind, target string) error {
+	if server.config.TunnelApprover == nil {
+		return nil
+	}
+
+	req := ApprovalRequest{
+		Kind:            kind,
+		ParticipantID:   participant.id,
+		ParticipantName: server.session.receiverName(participant),
+		RemoteAddr:      participant.remoteAddr,
+		Target:          target,
+	}
+	approved, answered := server.tunnels.approval(req)
+	if !answered {
+		approved = server.config.TunnelApprover(req)
+		server.tunnels.setApproval(req, approved)
+	}
+
+	if !approved {
+		return &TunnelError{Code: TunErrorDenied, Message: fmt.Sprintf("the sharer didn't approve the %s to %s", kind, target)}
+	}
+	return nil
+}
+
+// Each stream of a tunnel, from version 2 of the protocol, starts with a message naming its
+// destination. Connect to it, and let the client know how that went, before piping the data. A
+// failed connection fails only this stream.
+func (server *TTYServer) handleTunnelStream(tunnel *activeTunnel, muxStream net.Conn) {
+	defer muxStream.Close()
+
+	var streamMsg TunStreamMsg
+	if err := ReadTunMsg(muxStream, &streamMsg); err != nil {
+		log.Warnf("Cannot read the tunnel stream message: %s", err.Error())
+		return
+	}
+
+	network := streamMsg.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	target := streamMsg.Address
+	if network != "tcp" {
+		target = network + " " + streamMsg.Address
+	}
+	if err := server.approveTunnel(tunnel.participant, ApprovalTunnel, target); err != nil {
+		log.Debugf("Cannot connect the tunnel stream to %s: %s", target, err.Error())
+		WriteTunMsg(muxStream, tunReplyFromErr(err))
+		return
+	}
+
+	localConn, err := server.config.TunnelPolicy.Dial(network, streamMsg.Address)
+	if err != nil {
+		log.Debugf("Cannot connect the tunnel stream to %s: %s", target, err.Error())
+		WriteTunMsg(muxStream, tunReplyFromErr(err))
+		return
+	}
+	localConn, done := tunnel.trackStream(target, localConn)
+	defer done()
+	defer localConn.Close()
+
+	if err := WriteTunMsg(muxStream, TunStreamReplyMsg{}); err != nil {
+		return
+	}
+
+	if network == "udp" {
+		PipeDatagrams(muxStream, localConn)
+		return
+	}
+	pipeConns(muxStream, localConn)
+}
+
+// Listens on the loopback interface of the server side, and forwards each accepted connection to
+// the client, over a new stream of the mux session. The client connects that stream further to its
+// own destination.
+func (server *TTYServer) handleReverseTunnel(tunnel *activeTunnel, wsRW *WSConnReadWriteCloser, address string) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		log.Errorf("Invalid reverse tunnel address %s: %s", address, err.Error())
+		return
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		log.Errorf("Cannot listen for the reverse tunnel: %s", err.Error())
+		return
+	}
+	defer listener.Close()
+
+	// The server side opens the streams here, so it's the mux client
+	muxSession, err := yamux.Client(wsRW, nil)
+	if err != nil {
+		log.Error("Could not open a mux client: ", err.Error())
+		return
+	}
+
+	go func() {
+		// Stop listening once the client side goes away
+		<-muxSession.CloseChan()
+		listener.Close()
+	}()
+
+	log.Debugf("Reverse tunnel listening on %s", listener.Addr().String())
+	for {
+		localConn, err := listener.Accept()
 		if err != nil {
-			log.Error("Cannot create local connection ", err.Error())
+			log.Debugf("Reverse tunnel listener closed: %s", err.Error())
+			muxSession.Close()
 			return
 		}
 
-		go func() {
-			io.Copy(muxStream, localConn)
-			// Not sure yet which of the two io.Copy finishes first, so just close everything in both cases
-			defer localConn.Close()
-			defer muxStream.Close()
-		}()
+		muxStream, err := muxSession.Open()
+		if err != nil {
+			log.Warnf("Cannot open a reverse tunnel stream: %s", err.Error())
+			localConn.Close()
+			continue
+		}
 
 		go func() {
-			io.Copy(localConn, muxStream)
-			// Not sure yet which of the two io.Copy finishes first, so just close everything in both cases
-			defer muxStream.Close()
-			defer localConn.Close()
+			localConn, done := tunnel.trackStream(localConn.RemoteAddr().String(), localConn)
+			defer done()
+			pipeConns(muxStream, localConn)
 		}()
 	}
-
 }
 
 func panicIfErr(err error) {
@@ -287,24 +670,143 @@ func (server *TTYServer) handleWithTemplateHtml(responseWriter http.ResponseWrit
 
 }
 
+// Run listens on the FrontListenAddress, and serves the session until the server stops
 func (server *TTYServer) Run() (err error) {
-	err = server.httpServer.ListenAndServe()
+	listener, err := net.Listen("tcp", server.config.FrontListenAddress)
+	if err != nil {
+		return err
+	}
+	return server.Serve(listener)
+}
+
+// Serve serves the session on the listener, until the server stops. The listener is closed then
+func (server *TTYServer) Serve(listener net.Listener) (err error) {
+	err = server.httpServer.Serve(listener)
 	log.Debug("Server finished")
 	return
 }
 
 func (server *TTYServer) Write(buff []byte) (written int, err error) {
+	if server.batcher != nil {
+		return server.batcher.Write(buff)
+	}
 	return server.session.Write(buff)
 }
 
+// WindowSize should be called when the size of the sharer's terminal changes. The size of the shared
+// terminal is then decided according to the configured WinSizePolicy.
 func (server *TTYServer) WindowSize(cols, rows int) (err error) {
 	return server.session.WindowSize(cols, rows)
 }
 
+// SharerInput should be called when the sharer types in the shared terminal. It is needed by the
+// WinSizePolicyFollowDriver policy.
+func (server *TTYServer) SharerInput() {
+	server.session.SharerInput()
+}
+
+// Tunnels returns the active tunnels of the participants
+func (server *TTYServer) Tunnels() []TunnelInfo {
+	infos := []TunnelInfo{}
+	for _, tunnel := range server.tunnels.list() {
+		infos = append(infos, tunnel.info(server.session.receiverName(tunnel.participant)))
+	}
+	return infos
+}
+
+// RevokeTunnel closes the tunnel with the given ID, and all its connections
+func (server *TTYServer) RevokeTunnel(id string) error {
+	return server.tunnels.revoke(id)
+}
+
+// ServeHTTP serves the session, so the server can be mounted in the router of another application,
+// instead of running its own HTTP server. The paths of the requests should still start with the
+// BaseUrlPath, e.g.: mount the server on the /tty/ prefix, without stripping it, for the /tty
+// BaseUrlPath. Once the server stops, the requests get a 503 error
+func (server *TTYServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-server.done:
+		http.Error(w, "the session ended", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	server.handler.ServeHTTP(w, r)
+}
+
+// Marks the server as stopped, so no new file transfers start
+func (server *TTYServer) markStopped() {
+	server.transfersMutex.Lock()
+	defer server.transfersMutex.Unlock()
+	server.stopOnce.Do(func() { close(server.done) })
+}
+
+// Counts a file transfer in progress. It returns false if the server stopped, and the transfer
+// shouldn't start. Otherwise, transferDone should be called when it's done
+func (server *TTYServer) startTransfer() bool {
+	server.transfersMutex.Lock()
+	defer server.transfersMutex.Unlock()
+	select {
+	case <-server.done:
+		return false
+	default:
+	}
+	server.transfers.Add(1)
+	return true
+}
+
+func (server *TTYServer) transferDone() {
+	server.transfers.Done()
+}
+
+// Closes the tunnels and the connections of the participants, which were hijacked from the HTTP
+// server, so it doesn't close them
+func (server *TTYServer) closeConnections() {
+	if server.batcher != nil {
+		server.batcher.flush()
+	}
+	for _, tunnel := range server.tunnels.list() {
+		tunnel.close(&TunnelError{Code: TunErrorDenied, Message: "the session ended"})
+	}
+	server.session.closeReceivers()
+}
+
+// Stop stops the server right away, closing all the connections
 func (server *TTYServer) Stop() error {
 	log.Debug("Stopping the server")
-	if server.muxTunnelSession != nil {
-		server.muxTunnelSession.Close()
+	server.markStopped()
+	err := server.httpServer.Close()
+	server.closeConnections()
+	return err
+}
+
+// Shutdown stops the server gracefully: it stops accepting connections, waits for the HTTP requests
+// and the file transfers in progress, then sends the rest of the output, tells the participants the
+// session ended, and disconnects them. If the context ends first, the rest of the connections are
+// closed right away, and the error of the context is returned
+func (server *TTYServer) Shutdown(ctx context.Context) error {
+	log.Debug("Shutting down the server")
+	server.markStopped()
+	err := server.httpServer.Shutdown(ctx)
+
+	transfersDone := make(chan struct{})
+	go func() {
+		server.transfers.Wait()
+		close(transfersDone)
+	}()
+	select {
+	case <-transfersDone:
+	case <-ctx.Done():
+		log.Debug("Closing the file transfers still in progress")
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	// The output still batched, and kept in the scrollback with it, goes out before the notice
+	if server.batcher != nil {
+		server.batcher.flush()
 	}
-	return server.httpServer.Close()
+	server.session.notify("the session ended")
+	server.closeConnections()
+	return err
 }
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCleanBaseUrlPath(t *testing.T) {
+	for path, expected := range map[string]string{
+		"":        "",
+		"/":       "",
+		"tty":     "/tty",
+		"/tty/":   "/tty",
+		"//a/b//": "/a/b",
+	} {
+		if cleaned := CleanBaseUrlPath(path); cleaned != expected {
+			t.Errorf("CleanBaseUrlPath(%q) = %q, expected %q", path, cleaned, expected)
+		}
+	}
+}
+
+func TestServeHTTPMounted(t *testing.T) {
+	server := NewTTYServer(TTYServerConfig{BaseUrlPath: "/tty/", SessionID: "abc"})
+	mux := http.NewServeMux()
+	mux.Handle("/tty/", server)
+	app := httptest.NewServer(mux)
+	defer app.Close()
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(app.URL + path)
+		if err != nil {
+			t.Fatalf("cannot get %s: %s", path, err.Error())
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, _ := get("/tty/s/abc/")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the session page, got %d", resp.StatusCode)
+	}
+	if path := resp.Header.Get("TTYSHARE-TTY-WSPATH"); path != "/tty/s/abc/ws/" {
+		t.Errorf("unexpected WS path: %q", path)
+	}
+
+	if _, body := get("/tty/s/missing/"); !strings.Contains(body, "/tty/s/abc/static/404.css") {
+		t.Errorf("expected the 404 page, with the base URL path, got %q", body)
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Errorf("cannot shut down: %s", err.Error())
+	}
+	if resp, _ := get("/tty/s/abc/"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the stopped server to refuse the request, got %d", resp.StatusCode)
+	}
+}
+
+type testPTY struct{}
+
+func (testPTY) Write(data []byte) (int, error) { return len(data), nil }
+func (testPTY) Refresh()                       {}
+
+func TestCompression(t *testing.T) {
+	server := NewTTYServer(TTYServerConfig{
+		SessionID:            "abc",
+		PTY:                  testPTY{},
+		CompressionLevel:     1,
+		CompressionThreshold: DefaultCompressionThreshold,
+	})
+	app := httptest.NewServer(server)
+	defer app.Close()
+	defer server.Stop()
+
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	wsConn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(app.URL, "http")+"/s/abc/ws/", nil)
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err.Error())
+	}
+	defer wsConn.Close()
+	if !strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		t.Errorf("the compression was not negotiated")
+	}
+
+	conn := NewTTYProtocolWSLocked(wsConn)
+	conn.SendHello(MsgTTYHello{Name: "alice"})
+	welcomed := false
+	for !welcomed {
+		err := conn.ReadAndHandle(TTYProtocolHandlers{OnWelcome: func(id, token string) { welcomed = true }})
+		if err != nil {
+			t.Fatalf("not welcomed: %s", err.Error())
+		}
+	}
+
+	output := strings.Repeat("all work and no play makes jack a dull boy\r\n", 200)
+	server.Write([]byte(output))
+	received := ""
+	for received != output {
+		err := conn.ReadAndHandle(TTYProtocolHandlers{OnWrite: func(data []byte) { received += string(data) }})
+		if err != nil {
+			t.Fatalf("cannot read the output: %s", err.Error())
+		}
+	}
+
+	metrics := server.Metrics().TTY
+	if metrics.MessageBytes < int64(len(output)) || metrics.CompressionRatio() < 4 {
+		t.Errorf("the output was not compressed: %+v", metrics)
+	}
+}
+
+// Joins the session abc of the server at the URL, and waits to be welcomed. Returns the connection,
+// the ID and the token of the participant
+func testJoin(t *testing.T, url, name string) (*TTYProtocolWSLocked, string, string) {
+	conn := testConnect(t, url, name)
+	id, token := testWelcome(t, conn)
+	return conn, id, token
+}
+
+// Waits for the participant to be welcomed, and returns its ID and token
+func testWelcome(t *testing.T, conn *TTYProtocolWSLocked) (string, string) {
+	id, token := "", ""
+	for token == "" {
+		err := conn.ReadAndHandle(TTYProtocolHandlers{OnWelcome: func(i, t string) { id, token = i, t }})
+		if err != nil {
+			t.Fatalf("not welcomed: %s", err.Error())
+		}
+	}
+	return id, token
+}
+
+// Passes the input of the participants to a channel
+type chanPTY chan []byte
+
+func (pty chanPTY) Write(data []byte) (int, error) {
+	pty <- append([]byte(nil), data...)
+	return len(data), nil
+}
+func (chanPTY) Refresh() {}
+
+func TestTunnelUsersApprovedNames(t *testing.T) {
+	input := make(chanPTY, 1)
+	server := NewTTYServer(TTYServerConfig{
+		SessionID:   "abc",
+		PTY:         input,
+		TunnelUsers: []string{"alice"},
+		FileUsers:   []string{"alice"},
+		JoinApprover: func(req ApprovalRequest) ParticipantRole {
+			return RoleWriter
+		},
+	})
+	app := httptest.NewServer(server)
+	defer app.Close()
+	defer server.Stop()
+
+	_, _, aliceToken := testJoin(t, app.URL, "alice")
+	if _, err := server.tunnelParticipant(aliceToken); err != nil {
+		t.Errorf("alice cannot open tunnels: %s", err.Error())
+	}
+	if _, err := server.fileParticipant(aliceToken); err != nil {
+		t.Errorf("alice cannot transfer files: %s", err.Error())
+	}
+
+	// Renaming itself doesn't get a participant the rights of another one
+	mallory, _, malloryToken := testJoin(t, app.URL, "mallory")
+	mallory.SendHello(MsgTTYHello{Name: "alice"})
+	mallory.Write([]byte("x"))
+	<-input
+	if _, err := server.tunnelParticipant(malloryToken); err == nil {
+		t.Errorf("mallory can open tunnels, after renaming itself")
+	}
+	if _, err := server.fileParticipant(malloryToken); err == nil {
+		t.Errorf("mallory can transfer files, after renaming itself")
+	}
+	if name := server.session.receiverName(server.session.receiverByToken(malloryToken)); name != "mallory" {
+		t.Errorf("mallory renamed itself to %q", name)
+	}
+}
+
+func TestTunnelUsersWithoutJoinApprover(t *testing.T) {
+	server := NewTTYServer(TTYServerConfig{SessionID: "abc", PTY: testPTY{}, TunnelUsers: []string{"alice"}})
+	rcv := &ttyReceiver{name: "alice", token: "secret"}
+	server.session.receivers.add(rcv)
+	if _, err := server.tunnelParticipant("secret"); err == nil {
+		t.Errorf("a participant not approved by the sharer can open tunnels")
+	}
+}
+
+func TestShutdownSendsTheOutputFirst(t *testing.T) {
+	server := NewTTYServer(TTYServerConfig{
+		SessionID:        "abc",
+		PTY:              testPTY{},
+		OutputBatchDelay: time.Hour,
+		OutputBatchSize:  1 << 20,
+	})
+	app := httptest.NewServer(server)
+	defer app.Close()
+
+	conn, _, _ := testJoin(t, app.URL, "alice")
+	server.Write([]byte("bye"))
+	go server.Shutdown(context.Background())
+	var received []string
+	for {
+		err := conn.ReadAndHandle(TTYProtocolHandlers{
+			OnWrite:  func(data []byte) { received = append(received, "output: "+string(data)) },
+			OnNotice: func(text string) { received = append(received, "notice: "+text) },
+		})
+		if err != nil {
+			break
+		}
+	}
+	expected := []string{"output: bye", "notice: the session ended"}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected %q, got %q", expected, received)
+	}
+}
+
+// Records the sizes the shared terminal is set to
+type sizesPTY chan MsgTTYWinSize
+
+func (pty sizesPTY) SetWinSize(rows, cols int) {
+	pty <- MsgTTYWinSize{Cols: cols, Rows: rows}
+}
+
+func TestWinSizeOnlyOfWriters(t *testing.T) {
+	sizes := make(sizesPTY, 10)
+	server := NewTTYServer(TTYServerConfig{
+		SessionID:     "abc",
+		PTY:           testPTY{},
+		PTYResizer:    sizes,
+		WinSizePolicy: WinSizePolicySmallest,
+		JoinApprover: func(req ApprovalRequest) ParticipantRole {
+			return RoleViewer
+		},
+	})
+	app := httptest.NewServer(server)
+	defer app.Close()
+	defer server.Stop()
+	nextSize := func() MsgTTYWinSize {
+		select {
+		case size := <-sizes:
+			return size
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the shared terminal was not resized")
+			return MsgTTYWinSize{}
+		}
+	}
+	server.WindowSize(120, 40)
+	if size := nextSize(); size != (MsgTTYWinSize{Cols: 120, Rows: 40}) {
+		t.Fatalf("expected the size of the sharer, got %v", size)
+	}
+
+	// The viewer's window doesn't count. It's told its input is ignored after its size is handled
+	viewer, id, _ := testJoin(t, app.URL, "viewer")
+	viewer.SetWinSize(2000, 10)
+	viewer.Write([]byte("x"))
+	for noticed := false; !noticed; {
+		if err := viewer.ReadAndHandle(TTYProtocolHandlers{OnNotice: func(string) { noticed = true }}); err != nil {
+			t.Fatalf("cannot read: %s", err.Error())
+		}
+	}
+	select {
+	case size := <-sizes:
+		t.Errorf("the window of a viewer resized the shared terminal to %v", size)
+	default:
+	}
+
+	// Until it's made a writer. Its size is kept within the sizes a terminal can have
+	server.SetRole(id, RoleWriter)
+	if size := nextSize(); size != (MsgTTYWinSize{Cols: 120, Rows: 10}) {
+		t.Errorf("expected the size of the writer, got %v", size)
+	}
+	server.SetReadOnly(true)
+	if size := nextSize(); size != (MsgTTYWinSize{Cols: 120, Rows: 40}) {
+		t.Errorf("expected the size of the sharer, in a read only session, got %v", size)
+	}
+}
+
+func TestTunnelProtocolV1Refused(t *testing.T) {
+	server := NewTTYServer(TTYServerConfig{SessionID: "abc", PTY: testPTY{}, AllowTunneling: true})
+	app := httptest.NewServer(server)
+	defer app.Close()
+	defer server.Stop()
+
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(app.URL, "http")+"/s/abc/tws", nil)
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err.Error())
+	}
+	defer wsConn.Close()
+	wsConn.WriteJSON(TunInitMsg{Address: "localhost:22"})
+	_, _, err = wsConn.ReadMessage()
+	closeErr, _ := err.(*websocket.CloseError)
+	tunErr := TunnelErrorFromClose(closeErr)
+	if tunErr == nil || !strings.Contains(tunErr.Message, fmt.Sprintf("version %d", TunProtocolVersion)) {
+		t.Errorf("expected an error naming the version of the protocol, got %v", err)
+	}
+}
@@ -1,114 +1,548 @@
 package server
 
 import (
-	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
 
-type ttyShareSession struct {
-	mainRWLock          sync.RWMutex
-	ttyProtoConnections *list.List
-	isAlive             bool
-	lastWindowSizeMsg   MsgTTYWinSize
-	ptyHandler           PTYHandler
+// The longest name a participant can have
+const maxParticipantNameLen = 32
+
+// How long the receivers have to answer a clipboard query of an application
+const clipboardQueryTimeout = 5 * time.Second
+
+// A remote participant connected to the session
+type ttyReceiver struct {
+	// When the participant last typed, or resized its window, in Unix nanoseconds. Kept first, for
+	// the alignment needed by the atomic operations
+	inputAt int64
+	conn    *TTYProtocolWSLocked
+	// The last window size reported by the receiver. Not set, if the receiver never reported it
+	winSize MsgTTYWinSize
+	// Identifies the participant for the duration of the session
+	id string
+	// The name the participant introduced itself with, in its first Hello. Empty, if it didn't
+	name string
+	// The name the sharer let the participant in with, when asked to (see JoinApprover). Empty
+	// otherwise
+	approvedName string
+	remoteAddr   string
+	// The secret the participant uses to identify itself on its other connections
+	token string
+	// Closed when the participant disconnects
+	gone chan struct{}
+	// Set if the participant wants the clipboard messages (see MsgTTYHello)
+	clipboard     bool
+	clipboardPush bool
+	// Set when the participant was warned it's about to be disconnected, for being idle
+	idleWarned bool
+	// Closed when the participant introduced itself, with the Hello message
+	hello   chan struct{}
+	helloed bool
+	// Set once the participant is admitted in the session. Until then, it gets no output
+	admitted bool
+	role     ParticipantRole
+	joinedAt time.Time
+	// When the participant was last told its input is ignored
+	ignoredAt time.Time
 }
 
-func copyList(l *list.List) *list.List {
-	newList := list.New()
-	for e := l.Front(); e != nil; e = e.Next() {
-		newList.PushBack(e.Value)
-	}
-	return newList
+type ttyShareSession struct {
+	// Set to 1 on any input or output. Used to tell if the session is idle
+	activity          int32
+	mainRWLock        sync.RWMutex
+	receivers         *receiverSet
+	isAlive           bool
+	lastWindowSizeMsg MsgTTYWinSize
+	sharerWindowSize  MsgTTYWinSize
+	ptyHandler        PTYHandler
+	ptyResizer        PTYResizer
+	winSizePolicy     WinSizePolicy
+	fixedWindowSize   MsgTTYWinSize
+	// Overrides the window size policy, when set (see setWinSize)
+	forcedWindowSize MsgTTYWinSize
+	// The receiver who typed last. nil, if that was the sharer
+	driver *ttyReceiver
+	// Used to create the IDs of the receivers
+	receiversCount int
+	// Takes the clipboard sequences out of the output, to send them as Clipboard messages
+	clipboardParser OSC52Parser
+	// Allow the receivers to answer the clipboard queries of the applications
+	clipboardPush bool
+	// When an application last asked for the clipboard. Only the first answer is passed to it
+	clipboardQueryAt time.Time
+	// If set, the sharer is asked to admit each new receiver
+	joinApprover JoinApprover
+	// The most receivers admitted at the same time. No limit if 0
+	maxParticipants int
+	// Stops all the receivers from typing
+	readOnly bool
+	// Set while the sharing is paused (see setPaused)
+	paused bool
+	// Keeps the output from going out while the sharing is paused or resumed
+	outputMutex sync.Mutex
+	// Serializes the changes of the size of the shared terminal (see updateWindowSize)
+	resizeMutex sync.Mutex
+	// If set, replayed to the new receivers, instead of having the application redraw itself
+	scrollback *scrollback
+	// Called on the input of the sharer and of the receivers, if set
+	onInput func()
+	// Holds the output before it's written to the session, if set (see setPaused)
+	batcher *outputBatcher
+	// The messages smaller than this go uncompressed to the receivers which negotiated the
+	// compression. All of them are compressed if 0
+	compressionThreshold int
+	// Counts the messages sent to the receivers, if set
+	traffic *trafficCounter
+	// Called after the sharing was paused or resumed
+	onPause func(paused bool)
+	// Called after a receiver was admitted, and after it left
+	onJoin  func(participant ParticipantInfo)
+	onLeave func(participant ParticipantInfo)
 }
 
-func newTTYShareSession(ptyHandler PTYHandler) *ttyShareSession {
+func newTTYShareSession(ptyHandler PTYHandler, ptyResizer PTYResizer, winSizePolicy WinSizePolicy, fixedWindowSize MsgTTYWinSize) *ttyShareSession {
 
 	ttyShareSession := &ttyShareSession{
-		ttyProtoConnections: list.New(),
-		ptyHandler:           ptyHandler,
+		receivers:       newReceiverSet(),
+		ptyHandler:      ptyHandler,
+		ptyResizer:      ptyResizer,
+		winSizePolicy:   winSizePolicy,
+		fixedWindowSize: fixedWindowSize,
 	}
 
 	return ttyShareSession
 }
 
+// WindowSize is called when the sharer's terminal changes its size
 func (session *ttyShareSession) WindowSize(cols, rows int) error {
 	session.mainRWLock.Lock()
-	session.lastWindowSizeMsg = MsgTTYWinSize{Cols: cols, Rows: rows}
+	session.sharerWindowSize = MsgTTYWinSize{Cols: cols, Rows: rows}
 	session.mainRWLock.Unlock()
 
-	session.forEachReceiverLock(func(rcvConn *TTYProtocolWSLocked) bool {
-		rcvConn.SetWinSize(cols, rows)
-		return true
-	})
+	session.updateWindowSize()
 	return nil
 }
 
+// SharerInput is called when the sharer types something in the shared terminal
+func (session *ttyShareSession) SharerInput() {
+	atomic.StoreInt32(&session.activity, 1)
+	session.setDriver(nil)
+	if session.onInput != nil {
+		session.onInput()
+	}
+}
+
+func (session *ttyShareSession) setDriver(driver *ttyReceiver) {
+	session.mainRWLock.Lock()
+	changed := session.driver != driver
+	session.driver = driver
+	session.mainRWLock.Unlock()
+
+	if changed && session.winSizePolicy == WinSizePolicyFollowDriver {
+		session.updateWindowSize()
+	}
+}
+
+// Tells whether the size of the window of the receiver counts for the size of the shared terminal:
+// only the ones of the admitted writers do, unless the session is read only. Call with mainRWLock
+// locked
+func (session *ttyShareSession) sizesTerminalLocked(rcv *ttyReceiver) bool {
+	return rcv.admitted && rcv.role == RoleWriter && !session.readOnly
+}
+
+// Computes the size of the shared terminal, according to the window size policy, and if it changed,
+// resizes the terminal and notifies all the receivers about it. Returns true if the size changed.
+func (session *ttyShareSession) updateWindowSize() bool {
+	// Held until the new size is applied, so the sizes computed concurrently are applied in order
+	session.resizeMutex.Lock()
+	defer session.resizeMutex.Unlock()
+
+	session.mainRWLock.Lock()
+	receiversSizes := []MsgTTYWinSize{}
+	for _, rcv := range session.receivers.list() {
+		if session.sizesTerminalLocked(rcv) {
+			receiversSizes = append(receiversSizes, rcv.winSize)
+		}
+	}
+	var driverSize *MsgTTYWinSize
+	if session.driver != nil && session.sizesTerminalLocked(session.driver) {
+		driverSize = &session.driver.winSize
+	}
+
+	winSize := effectiveWinSize(session.winSizePolicy, session.fixedWindowSize, session.sharerWindowSize, receiversSizes, driverSize)
+	if session.forcedWindowSize.isSet() {
+		winSize = session.forcedWindowSize
+	}
+	if !winSize.isSet() || winSize == session.lastWindowSizeMsg {
+		session.mainRWLock.Unlock()
+		return false
+	}
+	session.lastWindowSizeMsg = winSize
+	session.mainRWLock.Unlock()
+
+	log.Debugf("Shared window size: %dx%d (policy %s)", winSize.Cols, winSize.Rows, session.winSizePolicy)
+	if session.ptyResizer != nil {
+		session.ptyResizer.SetWinSize(winSize.Rows, winSize.Cols)
+	}
+
+	session.broadcast(winSize)
+	return true
+}
+
+// Write sends the output of the shared terminal to the receivers. It's called from one goroutine
+// only, as the clipboard sequences can be split across the writes.
 func (session *ttyShareSession) Write(data []byte) (int, error) {
-	session.forEachReceiverLock(func(rcvConn *TTYProtocolWSLocked) bool {
-		rcvConn.Write(data)
+	atomic.StoreInt32(&session.activity, 1)
+	session.outputMutex.Lock()
+	defer session.outputMutex.Unlock()
+
+	out, clips := session.clipboardParser.Parse(data)
+	if session.isPaused() {
+		return len(data), nil
+	}
+	if session.scrollback != nil {
+		session.scrollback.Write(out)
+	}
+	if len(out) > 0 && session.receivers.len() > 0 {
+		session.broadcast(MsgTTYWrite{Data: out, Size: len(out)})
+	}
+	for _, clip := range clips {
+		session.sendClipboard(clip)
+	}
+	return len(data), nil
+}
+
+// Sends the clipboard sequence to the receivers who asked for it
+func (session *ttyShareSession) sendClipboard(clip OSC52) {
+	if clip.Query {
+		if !session.clipboardPush {
+			return
+		}
+		session.mainRWLock.Lock()
+		session.clipboardQueryAt = time.Now()
+		session.mainRWLock.Unlock()
+	}
+
+	session.forEachReceiver(func(rcv *ttyReceiver) bool {
+		session.mainRWLock.RLock()
+		wanted := (clip.Query && rcv.clipboardPush) || (!clip.Query && rcv.clipboard)
+		session.mainRWLock.RUnlock()
+		if wanted {
+			rcv.conn.SendClipboard(clip)
+		}
 		return true
 	})
-	return len(data), nil
 }
 
-// Runs the callback cb for each of the receivers in the list of the receivers, as it was when
-// this function was called. Note that there might be receivers which might have lost
-// the connection since this function was called.
-// Return false in the callback to not continue for the rest of the receivers
-func (session *ttyShareSession) forEachReceiverLock(cb func(rcvConn *TTYProtocolWSLocked) bool) {
-	session.mainRWLock.RLock()
-	// TODO: Maybe find a better way?
-	rcvsCopy := copyList(session.ttyProtoConnections)
-	session.mainRWLock.RUnlock()
+// Passes the clipboard of the receiver to the application which asked for it, if it's the first
+// answer
+func (session *ttyShareSession) answerClipboard(rcv *ttyReceiver, clip OSC52) {
+	session.mainRWLock.Lock()
+	// Like its input, only the admitted writers can answer
+	answer := !clip.Query && rcv.clipboardPush && rcv.admitted && rcv.role == RoleWriter &&
+		!session.readOnly && !session.paused && time.Since(session.clipboardQueryAt) < clipboardQueryTimeout
+	if answer {
+		session.clipboardQueryAt = time.Time{}
+	}
+	session.mainRWLock.Unlock()
 
-	for receiverE := rcvsCopy.Front(); receiverE != nil; receiverE = receiverE.Next() {
-		receiver := receiverE.Value.(*TTYProtocolWSLocked)
-		if !cb(receiver) {
+	if answer {
+		log.Debugf("Participant %s answered the clipboard query", rcv.id)
+		session.ptyHandler.Write(clip.Sequence())
+	}
+}
+
+// Calls cb for each receiver, until it returns false. The receivers admitted, or gone in the
+// meantime might be missed, or included
+func (session *ttyShareSession) forEachReceiver(cb func(rcv *ttyReceiver) bool) {
+	for _, rcv := range session.receivers.list() {
+		if !cb(rcv) {
 			break
 		}
 	}
 }
 
+// Tells whether the session was active since the last call: if there was any input or output, or
+// if any participant is connected
+func (session *ttyShareSession) takeActivity() bool {
+	active := atomic.SwapInt32(&session.activity, 0) == 1
+
+	return active || session.receivers.len() > 0
+}
+
+// Disconnects all the receivers, e.g.: when the server stops
+func (session *ttyShareSession) closeReceivers() {
+	session.forEachReceiver(func(rcv *ttyReceiver) bool {
+		rcv.conn.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		rcv.conn.ws.Close()
+		return true
+	})
+}
+
+// Sends the message to all the receivers, encoded once
+func (session *ttyShareSession) broadcast(aMessage interface{}) {
+	msg, err := prepareMsg(aMessage)
+	if err != nil {
+		log.Errorf("Cannot encode the message: %s", err.Error())
+		return
+	}
+	session.forEachReceiver(func(rcv *ttyReceiver) bool {
+		rcv.conn.writePrepared(msg)
+		return true
+	})
+}
+
+// Sends the notice to all the receivers
+func (session *ttyShareSession) notify(text string) {
+	session.broadcast(MsgTTYNotice{Text: text})
+}
+
+// Warns the receivers who haven't typed, or resized their window, for almost the timeout, and
+// disconnects the ones idle for longer. Called from a single goroutine
+func (session *ttyShareSession) checkIdleReceivers(now time.Time, timeout time.Duration) {
+	session.forEachReceiver(func(rcv *ttyReceiver) bool {
+		idle := now.Sub(time.Unix(0, atomic.LoadInt64(&rcv.inputAt)))
+		switch {
+		case idle >= timeout:
+			log.Infof("Disconnecting the participant %s, idle for %s", rcv.id, idle.Round(time.Second))
+			rcv.conn.SendNotice(fmt.Sprintf("disconnected after being idle for %s", timeout))
+			rcv.conn.ws.Close()
+		case idle >= timeout-viewerIdleWarning:
+			if !rcv.idleWarned {
+				rcv.conn.SendNotice(fmt.Sprintf("you will be disconnected in %s, unless you type", (timeout - idle).Round(time.Second)))
+				rcv.idleWarned = true
+			}
+		default:
+			rcv.idleWarned = false
+		}
+		return true
+	})
+}
+
+// Keeps only the printable characters of the name a participant introduced itself with
+func sanitizeParticipantName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(name))
+
+	if runes := []rune(name); len(runes) > maxParticipantNameLen {
+		name = string(runes[:maxParticipantNameLen])
+	}
+	return name
+}
+
+func newParticipantToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// Returns the participant with the given token, or nil if there's none
+func (session *ttyShareSession) receiverByToken(token string) *ttyReceiver {
+	session.mainRWLock.RLock()
+	defer session.mainRWLock.RUnlock()
+
+	for _, rcv := range session.receivers.list() {
+		if token != "" && rcv.token == token {
+			return rcv
+		}
+	}
+	return nil
+}
+
+// Returns the name of the participant, as it was set with its Hello message
+func (session *ttyShareSession) receiverName(rcv *ttyReceiver) string {
+	session.mainRWLock.RLock()
+	defer session.mainRWLock.RUnlock()
+	return rcv.name
+}
+
+// Tells whether the sharer let the participant in under one of the names. The names the
+// participants introduce themselves with are not trusted otherwise, since anyone can choose them
+func (session *ttyShareSession) approvedAs(rcv *ttyReceiver, names []string) bool {
+	session.mainRWLock.RLock()
+	defer session.mainRWLock.RUnlock()
+	if rcv.approvedName == "" {
+		return false
+	}
+	for _, name := range names {
+		if rcv.approvedName == name {
+			return true
+		}
+	}
+	return false
+}
+
 // Will run on the TTYReceiver connection go routine (e.g.: on the websockets connection routine)
 // When HandleWSConnection will exit, the connection to the TTYReceiver will be closed
 func (session *ttyShareSession) HandleWSConnection(wsConn *websocket.Conn) {
-	protoConn := NewTTYProtocolWSLocked(wsConn)
+	rcv := &ttyReceiver{
+		inputAt:    time.Now().UnixNano(),
+		conn:       NewTTYProtocolWSLocked(wsConn),
+		remoteAddr: wsConn.RemoteAddr().String(),
+		token:      newParticipantToken(),
+		gone:       make(chan struct{}),
+		hello:      make(chan struct{}),
+		role:       RoleWriter,
+	}
+	rcv.conn.compressionThreshold = session.compressionThreshold
+	rcv.conn.traffic = session.traffic
 
 	session.mainRWLock.Lock()
-	rcvHandleEl := session.ttyProtoConnections.PushBack(protoConn)
-	winSize := session.lastWindowSizeMsg
+	session.receiversCount++
+	rcv.id = fmt.Sprintf("p%d", session.receiversCount)
 	session.mainRWLock.Unlock()
 
-	log.Debugf("New WS connection (%s). Serving ..", wsConn.RemoteAddr().String())
+	log.Debugf("New WS connection (%s), participant %s. Serving ..", rcv.remoteAddr, rcv.id)
 
-	// Sending the initial size of the window, if we have one
-	protoConn.SetWinSize(winSize.Cols, winSize.Rows)
+	// Read the messages of the receiver until it closes the connection on its end. Until it's
+	// admitted in the session, only its Hello and its window size are taken into account
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		session.readReceiver(rcv)
+	}()
 
-	// Wait until the TTYReceiver will close the connection on its end
-	for {
-		err := protoConn.ReadAndHandle(
-			func(data []byte) {
-				session.ptyHandler.Write(data)
-			},
-			func(cols, rows int) {
-				session.ptyHandler.Refresh()
-			},
-		)
+	err := session.admit(rcv, readDone)
+	if err != nil {
+		log.Infof("Participant %s not admitted: %s", rcv.id, err.Error())
+		rcv.conn.Write([]byte(fmt.Sprintf("\r\ntty-share: %s\r\n", err.Error())))
+		wsConn.Close()
+		<-readDone
+		close(rcv.gone)
+		return
+	}
 
-		if err != nil {
-			log.Debugf("Finished the WS reading loop: %s", err.Error())
-			break
+	// The new receiver needs a redraw of the terminal app, after the initial size of the window,
+	// unless it got the scrollback
+	session.mainRWLock.RLock()
+	winSize := session.lastWindowSizeMsg
+	session.mainRWLock.RUnlock()
+	rcv.conn.SetWinSize(winSize.Cols, winSize.Rows)
+	session.updateWindowSize()
+	// While paused, it gets the placeholder instead, and the redraw when the sharing is resumed
+	session.outputMutex.Lock()
+	paused := session.isPaused()
+	if paused {
+		rcv.conn.Write([]byte(pausedScreen))
+	}
+	session.outputMutex.Unlock()
+	if !paused && session.scrollback == nil {
+		session.ptyHandler.Refresh()
+	}
+
+	if session.onJoin != nil {
+		// Report the receiver with the name it introduces itself with
+		select {
+		case <-rcv.hello:
+		case <-readDone:
+		case <-time.After(helloTimeout):
 		}
+		session.mainRWLock.RLock()
+		info := rcv.infoLocked()
+		session.mainRWLock.RUnlock()
+		session.onJoin(info)
 	}
 
+	<-readDone
+
 	// Remove the recevier from the list of the receiver of this session, so we need to write-lock
 	session.mainRWLock.Lock()
-	session.ttyProtoConnections.Remove(rcvHandleEl)
+	session.receivers.remove(rcv)
+	if session.driver == rcv {
+		session.driver = nil
+	}
+	info := rcv.infoLocked()
 	session.mainRWLock.Unlock()
+	close(rcv.gone)
+	session.updateWindowSize()
+	if session.onLeave != nil {
+		session.onLeave(info)
+	}
 
 	wsConn.Close()
 	log.Debugf("Closed receiver connection")
 }
+
+// Reads and handles the messages of the receiver, until its connection is closed
+func (session *ttyShareSession) readReceiver(rcv *ttyReceiver) {
+	for {
+		err := rcv.conn.ReadAndHandle(TTYProtocolHandlers{
+			OnWrite: func(data []byte) {
+				if ok, reason := session.canWrite(rcv); !ok {
+					session.ignoreInput(rcv, reason)
+					return
+				}
+
+				atomic.StoreInt64(&rcv.inputAt, time.Now().UnixNano())
+				atomic.StoreInt32(&session.activity, 1)
+				session.setDriver(rcv)
+				if session.onInput != nil {
+					session.onInput()
+				}
+				session.ptyHandler.Write(data)
+			},
+			OnWinSize: func(cols, rows int) {
+				atomic.StoreInt64(&rcv.inputAt, time.Now().UnixNano())
+				session.mainRWLock.Lock()
+				rcv.winSize = clampReceiverWinSize(cols, rows)
+				admitted := rcv.admitted
+				session.mainRWLock.Unlock()
+
+				// If the size of the shared terminal didn't change, the receiver still needs a
+				// redraw, after its own window changed
+				if admitted && !session.updateWindowSize() {
+					session.ptyHandler.Refresh()
+				}
+			},
+			OnHello: func(hello MsgTTYHello) {
+				name := sanitizeParticipantName(hello.Name)
+				session.mainRWLock.Lock()
+				// The name can't change, once the participant introduced itself, since the sharer
+				// may have let it in by it
+				if rcv.helloed {
+					name = rcv.name
+				}
+				rcv.name = name
+				rcv.clipboard = hello.Clipboard
+				rcv.clipboardPush = hello.ClipboardPush
+				welcome := rcv.admitted && !rcv.helloed
+				if !rcv.helloed {
+					rcv.helloed = true
+					close(rcv.hello)
+				}
+				session.mainRWLock.Unlock()
+				log.Debugf("Participant %s is %q", rcv.id, name)
+
+				// The receivers waiting to be admitted are welcomed once they are
+				if welcome {
+					rcv.conn.SendWelcome(rcv.id, rcv.token)
+				}
+			},
+			OnClipboard: func(clip OSC52) {
+				session.answerClipboard(rcv, clip)
+			},
+		})
+
+		if err != nil {
+			log.Debugf("Finished the WS reading loop: %s", err.Error())
+			return
+		}
+	}
+}
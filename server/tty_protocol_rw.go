@@ -9,8 +9,12 @@ import (
 )
 
 const (
-	MsgIDWrite   = "Write"
-	MsgIDWinSize = "WinSize"
+	MsgIDWrite     = "Write"
+	MsgIDWinSize   = "WinSize"
+	MsgIDHello     = "Hello"
+	MsgIDWelcome   = "Welcome"
+	MsgIDClipboard = "Clipboard"
+	MsgIDNotice    = "Notice"
 )
 
 // Message used to encapsulate the rest of the bessages bellow
@@ -29,12 +33,62 @@ type MsgTTYWinSize struct {
 	Rows int
 }
 
+// Sent by the participants, after they connect, to introduce themselves
+type MsgTTYHello struct {
+	Name string
+	// Set to get the Clipboard messages, with the contents the applications copy to the clipboard
+	Clipboard bool
+	// Set to get the Clipboard messages with Query set, when the applications ask for the contents
+	// of the clipboard. The participant answers with a Clipboard message
+	ClipboardPush bool
+}
+
+// Sent by the server in reply to the Hello message. The token identifies the participant on the
+// other connections it makes to the server (e.g.: the tunnels)
+type MsgTTYWelcome struct {
+	ID    string
+	Token string
+}
+
+// Sent by the server when an application in the shared terminal sets the clipboard, or asks for
+// its contents, with an OSC 52 sequence. Sent by the participants to answer the latter.
+type MsgTTYClipboard struct {
+	Selection string
+	Data      []byte
+	Query     bool
+}
+
+// Sent by the server to let the participants know something about the session, e.g.: that it's
+// about to end
+type MsgTTYNotice struct {
+	Text string
+}
+
 type OnMsgWrite func(data []byte)
 type OnMsgWinSize func(cols, rows int)
+type OnMsgHello func(hello MsgTTYHello)
+type OnMsgWelcome func(id, token string)
+type OnMsgClipboard func(clip OSC52)
+type OnMsgNotice func(text string)
+
+// The callbacks for the messages read by ReadAndHandle. The messages without a callback are ignored
+type TTYProtocolHandlers struct {
+	OnWrite     OnMsgWrite
+	OnWinSize   OnMsgWinSize
+	OnHello     OnMsgHello
+	OnWelcome   OnMsgWelcome
+	OnClipboard OnMsgClipboard
+	OnNotice    OnMsgNotice
+}
 
 type TTYProtocolWSLocked struct {
 	ws   *websocket.Conn
 	lock sync.Mutex
+	// If the compression was negotiated, the messages smaller than this are sent uncompressed. All
+	// of them are compressed if 0
+	compressionThreshold int
+	// Counts the messages sent, if set
+	traffic *trafficCounter
 }
 
 func NewTTYProtocolWSLocked(ws *websocket.Conn) *TTYProtocolWSLocked {
@@ -46,29 +100,31 @@ func NewTTYProtocolWSLocked(ws *websocket.Conn) *TTYProtocolWSLocked {
 func marshalMsg(aMessage interface{}) (_ []byte, err error) {
 	var msg MsgWrapper
 
-	if writeMsg, ok := aMessage.(MsgTTYWrite); ok {
+	switch aMessage.(type) {
+	case MsgTTYWrite:
 		msg.Type = MsgIDWrite
-		msg.Data, err = json.Marshal(writeMsg)
-		//fmt.Printf("Sent write message %s\n", string(writeMsg.Data))
-		if err != nil {
-			return
-		}
-		return json.Marshal(msg)
-	}
-
-	if winChangedMsg, ok := aMessage.(MsgTTYWinSize); ok {
+	case MsgTTYWinSize:
 		msg.Type = MsgIDWinSize
-		msg.Data, err = json.Marshal(winChangedMsg)
-		if err != nil {
-			return
-		}
-		return json.Marshal(msg)
+	case MsgTTYHello:
+		msg.Type = MsgIDHello
+	case MsgTTYWelcome:
+		msg.Type = MsgIDWelcome
+	case MsgTTYClipboard:
+		msg.Type = MsgIDClipboard
+	case MsgTTYNotice:
+		msg.Type = MsgIDNotice
+	default:
+		return nil, nil
 	}
 
-	return nil, nil
+	msg.Data, err = json.Marshal(aMessage)
+	if err != nil {
+		return
+	}
+	return json.Marshal(msg)
 }
 
-func (handler *TTYProtocolWSLocked) ReadAndHandle(onWrite OnMsgWrite, onWinSize OnMsgWinSize) (err error) {
+func (handler *TTYProtocolWSLocked) ReadAndHandle(handlers TTYProtocolHandlers) (err error) {
 	var msg MsgWrapper
 
 	_, r, err := handler.ws.NextReader()
@@ -83,37 +139,121 @@ func (handler *TTYProtocolWSLocked) ReadAndHandle(onWrite OnMsgWrite, onWinSize
 		return
 	}
 
-	switch msg.Type {
-	case MsgIDWrite:
+	switch {
+	case msg.Type == MsgIDWrite && handlers.OnWrite != nil:
 		var msgWrite MsgTTYWrite
 		err = json.Unmarshal(msg.Data, &msgWrite)
 		if err == nil {
-			onWrite(msgWrite.Data)
+			handlers.OnWrite(msgWrite.Data)
 		}
-	case MsgIDWinSize:
+	case msg.Type == MsgIDWinSize && handlers.OnWinSize != nil:
 		var msgRemoteWinSize MsgTTYWinSize
 		err = json.Unmarshal(msg.Data, &msgRemoteWinSize)
 		if err == nil {
-			onWinSize(msgRemoteWinSize.Cols, msgRemoteWinSize.Rows)
+			handlers.OnWinSize(msgRemoteWinSize.Cols, msgRemoteWinSize.Rows)
+		}
+	case msg.Type == MsgIDHello && handlers.OnHello != nil:
+		var msgHello MsgTTYHello
+		err = json.Unmarshal(msg.Data, &msgHello)
+		if err == nil {
+			handlers.OnHello(msgHello)
+		}
+	case msg.Type == MsgIDWelcome && handlers.OnWelcome != nil:
+		var msgWelcome MsgTTYWelcome
+		err = json.Unmarshal(msg.Data, &msgWelcome)
+		if err == nil {
+			handlers.OnWelcome(msgWelcome.ID, msgWelcome.Token)
+		}
+	case msg.Type == MsgIDClipboard && handlers.OnClipboard != nil:
+		var msgClipboard MsgTTYClipboard
+		err = json.Unmarshal(msg.Data, &msgClipboard)
+		if err == nil {
+			handlers.OnClipboard(OSC52{Selection: msgClipboard.Selection, Data: msgClipboard.Data, Query: msgClipboard.Query})
+		}
+	case msg.Type == MsgIDNotice && handlers.OnNotice != nil:
+		var msgNotice MsgTTYNotice
+		err = json.Unmarshal(msg.Data, &msgNotice)
+		if err == nil {
+			handlers.OnNotice(msgNotice.Text)
 		}
 	}
 	return
 }
 
-func (handler *TTYProtocolWSLocked) SetWinSize(cols, rows int) (err error) {
-	msgWinChanged := MsgTTYWinSize{
-		Cols: cols,
-		Rows: rows,
+type preparedMsg struct {
+	*websocket.PreparedMessage
+	size int
+}
+
+// Encodes the message once, to be sent to many WS connections with writePrepared. It's compressed
+// at most once for each compression level, when it's sent
+func prepareMsg(aMessage interface{}) (*preparedMsg, error) {
+	data, err := marshalMsg(aMessage)
+	if err != nil {
+		return nil, err
 	}
-	data, err := marshalMsg(msgWinChanged)
+	msg, err := websocket.NewPreparedMessage(websocket.TextMessage, data)
 	if err != nil {
-		return
+		return nil, err
+	}
+	return &preparedMsg{PreparedMessage: msg, size: len(data)}, nil
+}
+
+// Turns the compression on for the messages large enough, and counts them. Called with the lock
+// held, before sending a message
+func (handler *TTYProtocolWSLocked) beforeSendLocked(size int) {
+	if handler.compressionThreshold > 0 {
+		handler.ws.EnableWriteCompression(size >= handler.compressionThreshold)
 	}
+	handler.traffic.addMessage(size)
+}
 
+// Writes a message encoded with prepareMsg to the WS connection
+func (handler *TTYProtocolWSLocked) writePrepared(msg *preparedMsg) error {
 	handler.lock.Lock()
-	err = handler.ws.WriteMessage(websocket.TextMessage, data)
-	handler.lock.Unlock()
-	return
+	defer handler.lock.Unlock()
+	handler.beforeSendLocked(msg.size)
+	return handler.ws.WritePreparedMessage(msg.PreparedMessage)
+}
+
+// Writes the message data to the WS connection, one message at a time
+func (handler *TTYProtocolWSLocked) writeData(data []byte) error {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	handler.beforeSendLocked(len(data))
+	return handler.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+// Writes a message to the WS connection, one at a time
+func (handler *TTYProtocolWSLocked) writeMsg(aMessage interface{}) (err error) {
+	data, err := marshalMsg(aMessage)
+	if err != nil {
+		return
+	}
+	return handler.writeData(data)
+}
+
+func (handler *TTYProtocolWSLocked) SendHello(hello MsgTTYHello) error {
+	return handler.writeMsg(hello)
+}
+
+func (handler *TTYProtocolWSLocked) SendWelcome(id, token string) error {
+	return handler.writeMsg(MsgTTYWelcome{ID: id, Token: token})
+}
+
+func (handler *TTYProtocolWSLocked) SendClipboard(clip OSC52) error {
+	return handler.writeMsg(MsgTTYClipboard{Selection: clip.Selection, Data: clip.Data, Query: clip.Query})
+}
+
+func (handler *TTYProtocolWSLocked) SendNotice(text string) error {
+	return handler.writeMsg(MsgTTYNotice{Text: text})
+}
+
+func (handler *TTYProtocolWSLocked) SetWinSize(cols, rows int) (err error) {
+	return handler.writeMsg(MsgTTYWinSize{
+		Cols: cols,
+		Rows: rows,
+	})
 }
 
 // Function to send data from one the sender to the server and the other way around.
@@ -127,8 +267,5 @@ func (handler *TTYProtocolWSLocked) Write(buff []byte) (n int, err error) {
 		return 0, err
 	}
 
-	handler.lock.Lock()
-	n, err = len(buff), handler.ws.WriteMessage(websocket.TextMessage, data)
-	handler.lock.Unlock()
-	return
+	return len(buff), handler.writeData(data)
 }
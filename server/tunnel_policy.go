@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The codes of the errors reported to the clients, when the server cannot connect a tunnel
+const (
+	TunErrorDenied     = "denied"
+	TunErrorDialFailed = "dial-failed"
+)
+
+// TunnelError is returned when a tunnel destination cannot be reached, either because the
+// TunnelPolicy doesn't allow it, or because the connection failed
+type TunnelError struct {
+	Code    string
+	Message string
+}
+
+func (e *TunnelError) Error() string {
+	return e.Message
+}
+
+// A rule matching tunnel destinations. It has either a host pattern, or a network, and a range of
+// ports, or a Unix socket path pattern. A zero range matches all ports
+type tunnelRule struct {
+	hostPattern string
+	network     *net.IPNet
+	portFrom    int
+	portTo      int
+	pathPattern string
+}
+
+// TunnelPolicy decides which destinations the tunnels can connect to, from the server side. Without
+// any rules, all destinations are allowed. Once there are rules, only the destinations matching an
+// allow rule, and not matching any deny rule, are allowed.
+type TunnelPolicy struct {
+	allow []tunnelRule
+	deny  []tunnelRule
+}
+
+// NewTunnelPolicy creates a policy from the given allow and deny rules. A rule is a host pattern
+// (e.g.: db.internal, *.example.com, or * for all hosts), an IP address, or a CIDR (e.g.:
+// 10.0.0.0/8), optionally followed by a port, or a range of ports (e.g.: *.example.com:443,
+// 10.0.0.0/8:8000-8999, [fd00::/8]:22). Rules starting with / are Unix socket path patterns (e.g.:
+// /var/run/*.sock).
+func NewTunnelPolicy(allow, deny []string) (*TunnelPolicy, error) {
+	policy := &TunnelPolicy{}
+	for _, r := range allow {
+		rule, err := parseTunnelRule(r)
+		if err != nil {
+			return nil, err
+		}
+		policy.allow = append(policy.allow, rule)
+	}
+	for _, r := range deny {
+		rule, err := parseTunnelRule(r)
+		if err != nil {
+			return nil, err
+		}
+		policy.deny = append(policy.deny, rule)
+	}
+	return policy, nil
+}
+
+func parseTunnelRule(rule string) (r tunnelRule, err error) {
+	if strings.HasPrefix(rule, "/") {
+		if _, err := path.Match(rule, ""); err != nil {
+			return r, fmt.Errorf("invalid path pattern in the tunnel rule %q", rule)
+		}
+		r.pathPattern = rule
+		return r, nil
+	}
+
+	host, ports := rule, ""
+	if strings.HasPrefix(rule, "[") {
+		end := strings.Index(rule, "]")
+		if end < 0 {
+			return r, fmt.Errorf("invalid tunnel rule %q: missing ]", rule)
+		}
+		host, ports = rule[1:end], strings.TrimPrefix(rule[end+1:], ":")
+	} else if strings.Count(rule, ":") == 1 {
+		// More than one colon means an IPv6 address, without a port
+		host, ports, _ = strings.Cut(rule, ":")
+	}
+
+	if ports != "" {
+		from, to, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			to = from
+		}
+		r.portFrom, err = strconv.Atoi(from)
+		if err == nil {
+			r.portTo, err = strconv.Atoi(to)
+		}
+		if err != nil || r.portFrom < 1 || r.portTo > 65535 || r.portFrom > r.portTo {
+			return r, fmt.Errorf("invalid ports in the tunnel rule %q", rule)
+		}
+	}
+
+	if host == "" {
+		return r, fmt.Errorf("invalid tunnel rule %q: missing host", rule)
+	}
+	if _, network, err := net.ParseCIDR(host); err == nil {
+		r.network = network
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		r.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		if _, err := path.Match(host, ""); err != nil {
+			return r, fmt.Errorf("invalid host pattern in the tunnel rule %q", rule)
+		}
+		r.hostPattern = strings.ToLower(host)
+	}
+	return r, nil
+}
+
+func (r tunnelRule) matches(host string, ip net.IP, port int) bool {
+	if r.pathPattern != "" {
+		return false
+	}
+	if r.portFrom != 0 && (port < r.portFrom || port > r.portTo) {
+		return false
+	}
+	if r.network != nil {
+		return r.network.Contains(ip)
+	}
+	matched, _ := path.Match(r.hostPattern, strings.ToLower(host))
+	return matched
+}
+
+func matchesAny(rules []tunnelRule, host string, ip net.IP, port int) bool {
+	for _, r := range rules {
+		if r.matches(host, ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows decides if the destination host, resolved to ip, can be reached on the given port
+func (policy *TunnelPolicy) allows(host string, ip net.IP, port int) bool {
+	if policy == nil || (len(policy.allow) == 0 && len(policy.deny) == 0) {
+		return true
+	}
+	if matchesAny(policy.deny, host, ip, port) {
+		return false
+	}
+	return matchesAny(policy.allow, host, ip, port)
+}
+
+func matchesAnyPath(rules []tunnelRule, socketPath string) bool {
+	for _, r := range rules {
+		if r.pathPattern == "" {
+			continue
+		}
+		if matched, _ := path.Match(r.pathPattern, socketPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsPath decides if the Unix socket at socketPath can be reached
+func (policy *TunnelPolicy) allowsPath(socketPath string) bool {
+	if policy == nil || (len(policy.allow) == 0 && len(policy.deny) == 0) {
+		return true
+	}
+	if matchesAnyPath(policy.deny, socketPath) {
+		return false
+	}
+	return matchesAnyPath(policy.allow, socketPath)
+}
+
+func deniedError(address string) *TunnelError {
+	return &TunnelError{Code: TunErrorDenied, Message: fmt.Sprintf("the tunnel destination %s is not allowed", address)}
+}
+
+// CheckListen returns a *TunnelError if the policy doesn't allow a reverse tunnel to listen on
+// the port of the address. The reverse tunnels listen on the loopback interface, so the port is
+// checked as localhost, or 127.0.0.1, e.g.: allowed by the rule localhost:8000-8999. A nil policy
+// allows everything.
+func (policy *TunnelPolicy) CheckListen(address string) error {
+	_, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return &TunnelError{Code: TunErrorDialFailed, Message: err.Error()}
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return &TunnelError{Code: TunErrorDialFailed, Message: fmt.Sprintf("invalid port %q", portStr)}
+	}
+	if !policy.allows("localhost", net.IPv4(127, 0, 0, 1), port) {
+		return &TunnelError{Code: TunErrorDenied, Message: fmt.Sprintf("listening on the port %d is not allowed", port)}
+	}
+	return nil
+}
+
+// Dial connects to the given address, over the tcp, udp or unix network, if the policy allows it.
+// Host names are resolved first, and each of the addresses they resolve to is checked, so the
+// connection is made to an address which was allowed, and not to whatever the name resolves to at
+// the time of the dial. A nil policy allows everything.
+func (policy *TunnelPolicy) Dial(network, address string) (net.Conn, error) {
+	switch network {
+	case "unix":
+		if !policy.allowsPath(address) {
+			return nil, deniedError(address)
+		}
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, &TunnelError{Code: TunErrorDialFailed, Message: err.Error()}
+		}
+		return conn, nil
+	case "tcp", "udp":
+	default:
+		return nil, &TunnelError{Code: TunErrorDialFailed, Message: fmt.Sprintf("unsupported network %q", network)}
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, &TunnelError{Code: TunErrorDialFailed, Message: err.Error()}
+	}
+	port, err := net.LookupPort(network, portStr)
+	if err != nil {
+		return nil, &TunnelError{Code: TunErrorDialFailed, Message: err.Error()}
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+		if err != nil {
+			return nil, &TunnelError{Code: TunErrorDialFailed, Message: err.Error()}
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	var lastErr error
+	allowed := false
+	for _, ip := range ips {
+		if !policy.allows(host, ip, port) {
+			continue
+		}
+		allowed = true
+		conn, err := net.Dial(network, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	if !allowed {
+		return nil, deniedError(address)
+	}
+	return nil, &TunnelError{Code: TunErrorDialFailed, Message: lastErr.Error()}
+}
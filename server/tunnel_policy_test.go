@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTunnelPolicy(t *testing.T) {
+	policy, err := NewTunnelPolicy(
+		[]string{"*.example.com:443", "10.0.0.0/8:8000-8999", "[fd00::/8]:22", "192.168.1.10"},
+		[]string{"10.0.0.5", "bad.example.com"})
+	if err != nil {
+		t.Fatalf("Cannot create the policy: %s", err.Error())
+	}
+
+	tests := []struct {
+		host     string
+		ip       string
+		port     int
+		expected bool
+	}{
+		{"www.example.com", "1.2.3.4", 443, true},
+		{"WWW.Example.com", "1.2.3.4", 443, true},
+		{"www.example.com", "1.2.3.4", 80, false},
+		{"bad.example.com", "1.2.3.4", 443, false},
+		{"10.1.2.3", "10.1.2.3", 8080, true},
+		{"10.1.2.3", "10.1.2.3", 9000, false},
+		{"10.0.0.5", "10.0.0.5", 8080, false},
+		{"db.internal", "10.1.2.3", 8500, true},
+		{"fd00::1", "fd00::1", 22, true},
+		{"fe80::1", "fe80::1", 22, false},
+		{"192.168.1.10", "192.168.1.10", 5432, true},
+		{"169.254.169.254", "169.254.169.254", 80, false},
+	}
+
+	for _, test := range tests {
+		if allowed := policy.allows(test.host, net.ParseIP(test.ip), test.port); allowed != test.expected {
+			t.Errorf("%s (%s) port %d: expected %v, got %v", test.host, test.ip, test.port, test.expected, allowed)
+		}
+	}
+}
+
+func TestTunnelPolicyNoRules(t *testing.T) {
+	var nilPolicy *TunnelPolicy
+	empty, _ := NewTunnelPolicy(nil, nil)
+	denyOnly, _ := NewTunnelPolicy(nil, []string{"169.254.0.0/16"})
+
+	ip := net.ParseIP("10.1.2.3")
+	if !nilPolicy.allows("host", ip, 22) || !empty.allows("host", ip, 22) {
+		t.Errorf("A policy without rules should allow everything")
+	}
+	if denyOnly.allows("host", ip, 22) {
+		t.Errorf("A policy with rules should deny by default")
+	}
+}
+
+func TestTunnelPolicyPaths(t *testing.T) {
+	policy, _ := NewTunnelPolicy([]string{"/var/run/*.sock", "10.0.0.0/8"}, []string{"/var/run/docker.sock"})
+
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{"/var/run/app.sock", true},
+		{"/var/run/docker.sock", false},
+		{"/var/run/sub/app.sock", false},
+		{"/tmp/app.sock", false},
+	}
+	for _, test := range tests {
+		if allowed := policy.allowsPath(test.path); allowed != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.path, test.expected, allowed)
+		}
+	}
+
+	if policy.allows("host", net.ParseIP("192.168.1.1"), 22) {
+		t.Errorf("Path rules should not match hosts")
+	}
+	if _, err := policy.Dial("unix", "/tmp/app.sock"); err == nil || err.(*TunnelError).Code != TunErrorDenied {
+		t.Errorf("Expected a denied error, got %v", err)
+	}
+}
+
+func TestTunnelPolicyInvalidRules(t *testing.T) {
+	for _, rule := range []string{"", ":22", "host:0", "host:80-22", "host:abc", "[fd00::/8:22", "a[b"} {
+		if _, err := NewTunnelPolicy([]string{rule}, nil); err == nil {
+			t.Errorf("Expected an error for the rule %q", rule)
+		}
+	}
+}
+
+func TestTunnelPolicyDialDenied(t *testing.T) {
+	policy, _ := NewTunnelPolicy([]string{"10.0.0.0/8"}, nil)
+	_, err := policy.Dial("tcp", "127.0.0.1:1")
+	tunErr, ok := err.(*TunnelError)
+	if !ok || tunErr.Code != TunErrorDenied {
+		t.Errorf("Expected a denied error, got %v", err)
+	}
+}
+
+func TestTunnelPolicyCheckListen(t *testing.T) {
+	policy, _ := NewTunnelPolicy([]string{"localhost:8000-8999", "10.0.0.0/8"}, []string{"127.0.0.1:8080"})
+	if err := policy.CheckListen("localhost:8000"); err != nil {
+		t.Errorf("Expected the port to be allowed: %s", err.Error())
+	}
+	for _, address := range []string{"localhost:22", "localhost:8080", "localhost:9000"} {
+		err := policy.CheckListen(address)
+		if tunErr, ok := err.(*TunnelError); !ok || tunErr.Code != TunErrorDenied {
+			t.Errorf("%s: expected a denied error, got %v", address, err)
+		}
+	}
+	if err := policy.CheckListen("localhost:http"); err == nil {
+		t.Errorf("Expected an error for an invalid port")
+	}
+
+	var noPolicy *TunnelPolicy
+	if err := noPolicy.CheckListen("localhost:22"); err != nil {
+		t.Errorf("Expected no policy to allow everything: %s", err.Error())
+	}
+}
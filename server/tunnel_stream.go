@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Largest tunnel stream message we accept. They only carry an address, or an error
+const maxTunMsgSize = 4096
+
+// TunStreamMsg is written by the client at the beginning of each stream of a tunnel, from version 2
+// of the tunnel protocol, and names the destination of that stream
+type TunStreamMsg struct {
+	Address string
+	// One of tcp (the default, if empty), udp or unix. The data of the udp streams is a sequence of
+	// datagrams (see WriteDatagram)
+	Network string
+}
+
+// TunStreamReplyMsg is the answer of the server to a TunStreamMsg. An empty Error means the server
+// is connected to the destination, and the raw connection data follows on the stream. Otherwise,
+// Code is one of the TunError* codes.
+type TunStreamReplyMsg struct {
+	Error string
+	Code  string
+}
+
+func tunReplyFromErr(err error) TunStreamReplyMsg {
+	if tunErr, ok := err.(*TunnelError); ok {
+		return TunStreamReplyMsg{Error: tunErr.Message, Code: tunErr.Code}
+	}
+	return TunStreamReplyMsg{Error: err.Error(), Code: TunErrorDialFailed}
+}
+
+// CloseTunnelWithError closes the tunnel WS connection, sending the reason as a JSON encoded
+// TunStreamReplyMsg, in the close message. Used when the whole tunnel fails, rather than one stream
+func CloseTunnelWithError(wsConn *websocket.Conn, err error) {
+	reply := tunReplyFromErr(err)
+	reason, _ := json.Marshal(reply)
+	// The reason in a close message can't be longer than 123 bytes, so keep only the code then
+	if len(reason) > 123 {
+		reason, _ = json.Marshal(TunStreamReplyMsg{Code: reply.Code})
+	}
+	wsConn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, string(reason)),
+		time.Now().Add(time.Second))
+}
+
+// TunnelErrorFromClose returns the error sent with CloseTunnelWithError, if that's how the tunnel
+// was closed
+func TunnelErrorFromClose(closeErr *websocket.CloseError) *TunnelError {
+	if closeErr == nil || closeErr.Code != websocket.ClosePolicyViolation {
+		return nil
+	}
+	var reply TunStreamReplyMsg
+	if json.Unmarshal([]byte(closeErr.Text), &reply) != nil {
+		return nil
+	}
+	if reply.Error == "" {
+		reply.Error = reply.Code
+	}
+	return &TunnelError{Code: reply.Code, Message: reply.Error}
+}
+
+// WriteTunMsg writes a tunnel stream message: a 2 bytes (big endian) length, followed by the JSON
+// encoded message. The length prefix lets the reader get the message without consuming any of the
+// connection data following it.
+func WriteTunMsg(w io.Writer, msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxTunMsgSize {
+		return errors.New("tunnel message too large")
+	}
+
+	buff := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buff, uint16(len(data)))
+	copy(buff[2:], data)
+	_, err = w.Write(buff)
+	return err
+}
+
+// ReadTunMsg reads a message written with WriteTunMsg
+func ReadTunMsg(r io.Reader, msg interface{}) error {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size > maxTunMsgSize {
+		return errors.New("tunnel message too large")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, msg)
+}
+
+// The largest datagram of a udp tunnel stream
+const maxDatagramSize = 65535
+
+// WriteDatagram writes one datagram on a udp tunnel stream: a 2 bytes (big endian) length, followed
+// by the data
+func WriteDatagram(w io.Writer, data []byte) error {
+	if len(data) > maxDatagramSize {
+		return errors.New("datagram too large")
+	}
+	buff := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buff, uint16(len(data)))
+	copy(buff[2:], data)
+	_, err := w.Write(buff)
+	return err
+}
+
+// ReadDatagram reads a datagram written with WriteDatagram into buff, which has to be large enough
+// for any datagram, and returns its size
+func ReadDatagram(r io.Reader, buff []byte) (int, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return 0, err
+	}
+	if int(size) > len(buff) {
+		return 0, errors.New("datagram too large")
+	}
+	return io.ReadFull(r, buff[:size])
+}
+
+// PipeDatagrams copies the datagrams of a udp tunnel stream to a connected UDP socket, and the
+// other way around, until one of them is closed
+func PipeDatagrams(stream io.ReadWriteCloser, conn net.Conn) {
+	go func() {
+		defer stream.Close()
+		defer conn.Close()
+		buff := make([]byte, maxDatagramSize)
+		for {
+			n, err := ReadDatagram(stream, buff)
+			if err != nil {
+				return
+			}
+			// A datagram which cannot be sent is lost, like with any UDP socket
+			conn.Write(buff[:n])
+		}
+	}()
+
+	defer stream.Close()
+	defer conn.Close()
+	buff := make([]byte, maxDatagramSize)
+	for {
+		n, err := conn.Read(buff)
+		if err != nil {
+			return
+		}
+		if WriteDatagram(stream, buff[:n]) != nil {
+			return
+		}
+	}
+}
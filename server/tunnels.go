@@ -0,0 +1,239 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The kinds of the requests the sharer can be asked to approve
+const (
+	ApprovalTunnel        = "tunnel"
+	ApprovalReverseTunnel = "reverse-tunnel"
+	ApprovalUpload        = "upload"
+	ApprovalJoin          = "join"
+)
+
+// ApprovalRequest is what the sharer is asked to approve, on behalf of a participant
+type ApprovalRequest struct {
+	// One of the Approval* kinds
+	Kind            string
+	ParticipantID   string
+	ParticipantName string
+	RemoteAddr      string
+	// The destination of the tunnel, the address the reverse tunnel listens on, or the file to
+	// upload. Empty for the joins
+	Target string
+}
+
+func (req ApprovalRequest) String() string {
+	who := req.ParticipantID
+	if req.ParticipantName != "" {
+		who = fmt.Sprintf("%s (%s)", req.ParticipantName, req.ParticipantID)
+	}
+
+	switch req.Kind {
+	case ApprovalReverseTunnel:
+		return fmt.Sprintf("%s from %s wants a reverse tunnel listening on %s", who, req.RemoteAddr, req.Target)
+	case ApprovalJoin:
+		return fmt.Sprintf("%s from %s wants to join the session", who, req.RemoteAddr)
+	case ApprovalUpload:
+		return fmt.Sprintf("%s from %s wants to upload %s", who, req.RemoteAddr, req.Target)
+	default:
+		return fmt.Sprintf("%s from %s wants a tunnel to %s", who, req.RemoteAddr, req.Target)
+	}
+}
+
+// Approver asks the sharer to approve a request, and returns the answer. It can block until the
+// sharer answers, and should give up at some point, by returning false.
+type Approver func(req ApprovalRequest) bool
+
+// TunnelStreamInfo describes one connection made through a tunnel
+type TunnelStreamInfo struct {
+	Destination string
+	// The bytes sent to the destination, and the ones received from it
+	BytesOut int64
+	BytesIn  int64
+}
+
+// TunnelInfo describes an active tunnel of a participant
+type TunnelInfo struct {
+	ID              string
+	ParticipantID   string
+	ParticipantName string
+	Reverse         bool
+	StartedAt       time.Time
+	// The connections currently made through the tunnel
+	Streams []TunnelStreamInfo
+	// The bytes of all the connections made through the tunnel, including the closed ones
+	BytesOut int64
+	BytesIn  int64
+}
+
+type tunnelStream struct {
+	// Kept first, for the alignment needed by the atomic operations
+	bytesOut    int64
+	bytesIn     int64
+	destination string
+}
+
+// Counts the bytes written to and read from the destination of a tunnel stream
+type countingConn struct {
+	net.Conn
+	stream *tunnelStream
+}
+
+func (conn *countingConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	atomic.AddInt64(&conn.stream.bytesIn, int64(n))
+	return n, err
+}
+
+func (conn *countingConn) Write(p []byte) (int, error) {
+	n, err := conn.Conn.Write(p)
+	atomic.AddInt64(&conn.stream.bytesOut, int64(n))
+	return n, err
+}
+
+type activeTunnel struct {
+	id          string
+	participant *ttyReceiver
+	reverse     bool
+	startedAt   time.Time
+	// Ends the tunnel, letting the participant know the reason
+	close func(reason error)
+
+	mutex    sync.Mutex
+	streams  []*tunnelStream
+	bytesOut int64
+	bytesIn  int64
+}
+
+// Tracks a connection made through the tunnel, to the destination, over conn. Use the returned
+// connection instead of conn, to count its bytes, and call done when it's closed.
+func (tunnel *activeTunnel) trackStream(destination string, conn net.Conn) (net.Conn, func()) {
+	stream := &tunnelStream{destination: destination}
+
+	tunnel.mutex.Lock()
+	tunnel.streams = append(tunnel.streams, stream)
+	tunnel.mutex.Unlock()
+
+	done := func() {
+		tunnel.mutex.Lock()
+		defer tunnel.mutex.Unlock()
+		for i, s := range tunnel.streams {
+			if s == stream {
+				tunnel.streams = append(tunnel.streams[:i], tunnel.streams[i+1:]...)
+				tunnel.bytesOut += atomic.LoadInt64(&stream.bytesOut)
+				tunnel.bytesIn += atomic.LoadInt64(&stream.bytesIn)
+				return
+			}
+		}
+	}
+	return &countingConn{Conn: conn, stream: stream}, done
+}
+
+func (tunnel *activeTunnel) info(participantName string) TunnelInfo {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+
+	info := TunnelInfo{
+		ID:              tunnel.id,
+		ParticipantID:   tunnel.participant.id,
+		ParticipantName: participantName,
+		Reverse:         tunnel.reverse,
+		StartedAt:       tunnel.startedAt,
+		BytesOut:        tunnel.bytesOut,
+		BytesIn:         tunnel.bytesIn,
+	}
+	for _, stream := range tunnel.streams {
+		streamInfo := TunnelStreamInfo{
+			Destination: stream.destination,
+			BytesOut:    atomic.LoadInt64(&stream.bytesOut),
+			BytesIn:     atomic.LoadInt64(&stream.bytesIn),
+		}
+		info.Streams = append(info.Streams, streamInfo)
+		info.BytesOut += streamInfo.BytesOut
+		info.BytesIn += streamInfo.BytesIn
+	}
+	return info
+}
+
+// The active tunnels of a session, and the answers the sharer gave to the approval requests
+type tunnelRegistry struct {
+	mutex        sync.Mutex
+	tunnels      []*activeTunnel
+	tunnelsCount int
+	// The answers of the sharer, for each participant and target
+	approvals map[string]bool
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{
+		approvals: map[string]bool{},
+	}
+}
+
+func (registry *tunnelRegistry) add(participant *ttyReceiver, reverse bool, close func(reason error)) *activeTunnel {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.tunnelsCount++
+	tunnel := &activeTunnel{
+		id:          fmt.Sprintf("t%d", registry.tunnelsCount),
+		participant: participant,
+		reverse:     reverse,
+		startedAt:   time.Now(),
+		close:       close,
+	}
+	registry.tunnels = append(registry.tunnels, tunnel)
+	return tunnel
+}
+
+func (registry *tunnelRegistry) remove(tunnel *activeTunnel) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	for i, t := range registry.tunnels {
+		if t == tunnel {
+			registry.tunnels = append(registry.tunnels[:i], registry.tunnels[i+1:]...)
+			return
+		}
+	}
+}
+
+func (registry *tunnelRegistry) list() []*activeTunnel {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return append([]*activeTunnel{}, registry.tunnels...)
+}
+
+func (registry *tunnelRegistry) revoke(id string) error {
+	for _, tunnel := range registry.list() {
+		if tunnel.id == id {
+			tunnel.close(&TunnelError{Code: TunErrorDenied, Message: "the tunnel was revoked by the sharer"})
+			return nil
+		}
+	}
+	return fmt.Errorf("no tunnel with the ID %s", id)
+}
+
+func approvalKey(req ApprovalRequest) string {
+	return req.ParticipantID + " " + req.Kind + " " + req.Target
+}
+
+// Returns the answer the sharer gave before to the same request, if any
+func (registry *tunnelRegistry) approval(req ApprovalRequest) (approved, answered bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	approved, answered = registry.approvals[approvalKey(req)]
+	return
+}
+
+func (registry *tunnelRegistry) setApproval(req ApprovalRequest, approved bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.approvals[approvalKey(req)] = approved
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestTunnelRegistry(t *testing.T) {
+	registry := newTunnelRegistry()
+	participant := &ttyReceiver{id: "p1"}
+
+	var closeReason error
+	tunnel := registry.add(participant, false, func(reason error) {
+		closeReason = reason
+	})
+
+	serverSide, destination := net.Pipe()
+	conn, done := tunnel.trackStream("db:5432", serverSide)
+	go func() {
+		buff := make([]byte, 5)
+		io.ReadFull(destination, buff)
+		destination.Write([]byte("hi"))
+	}()
+	conn.Write([]byte("hello"))
+	io.ReadFull(conn, make([]byte, 2))
+
+	info := tunnel.info("alice")
+	if len(info.Streams) != 1 || info.Streams[0].Destination != "db:5432" || info.BytesOut != 5 || info.BytesIn != 2 {
+		t.Errorf("Unexpected tunnel info %+v", info)
+	}
+
+	done()
+	info = tunnel.info("alice")
+	if len(info.Streams) != 0 || info.BytesOut != 5 || info.BytesIn != 2 {
+		t.Errorf("Unexpected tunnel info, after the stream ended: %+v", info)
+	}
+
+	if err := registry.revoke("t2"); err == nil {
+		t.Errorf("Expected an error, revoking an unknown tunnel")
+	}
+	if err := registry.revoke(tunnel.id); err != nil || closeReason == nil {
+		t.Errorf("The tunnel wasn't closed: %v", err)
+	}
+
+	registry.remove(tunnel)
+	if len(registry.list()) != 0 {
+		t.Errorf("The tunnel wasn't removed")
+	}
+}
+
+func TestSanitizeParticipantName(t *testing.T) {
+	if name := sanitizeParticipantName("  al\x1b[31mice\n "); name != "al[31mice" {
+		t.Errorf("Unexpected name %q", name)
+	}
+	if name := sanitizeParticipantName("0123456789012345678901234567890123456789"); len(name) != maxParticipantNameLen {
+		t.Errorf("The name wasn't truncated: %q", name)
+	}
+}
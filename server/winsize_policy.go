@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// WinSizePolicy decides the size of the shared terminal, based on the size of the sharer's
+// terminal and on the sizes reported by the remote participants
+type WinSizePolicy string
+
+const (
+	// The sharer's terminal size always wins
+	WinSizePolicySharer WinSizePolicy = "sharer"
+	// The smallest of all the terminals, so everyone sees the whole screen
+	WinSizePolicySmallest WinSizePolicy = "smallest"
+	// The largest of all the terminals
+	WinSizePolicyLargest WinSizePolicy = "largest"
+	// A fixed size, regardless of the participants' terminals
+	WinSizePolicyFixed WinSizePolicy = "fixed"
+	// The size of the terminal of whoever typed last
+	WinSizePolicyFollowDriver WinSizePolicy = "follow-driver"
+)
+
+var winSizePolicies = []WinSizePolicy{
+	WinSizePolicySharer,
+	WinSizePolicySmallest,
+	WinSizePolicyLargest,
+	WinSizePolicyFixed,
+	WinSizePolicyFollowDriver,
+}
+
+// ParseWinSizePolicy returns the policy with the given name. An empty name means the default
+// (sharer) policy.
+func ParseWinSizePolicy(name string) (WinSizePolicy, error) {
+	if name == "" {
+		return WinSizePolicySharer, nil
+	}
+
+	names := []string{}
+	for _, p := range winSizePolicies {
+		if string(p) == name {
+			return p, nil
+		}
+		names = append(names, string(p))
+	}
+	return "", fmt.Errorf("unknown window size policy %q (supported: %s)", name, strings.Join(names, ", "))
+}
+
+// The largest size of a terminal, which the window size ioctls take as 16 bit numbers
+const maxWinSize = 65535
+
+// ParseWinSize parses a <cols>x<rows> window size
+func ParseWinSize(size string) (cols, rows int, err error) {
+	colsText, rowsText, found := strings.Cut(size, "x")
+	cols, colsErr := strconv.Atoi(colsText)
+	rows, rowsErr := strconv.Atoi(rowsText)
+	if !found || colsErr != nil || rowsErr != nil || cols <= 0 || rows <= 0 || cols > maxWinSize || rows > maxWinSize {
+		return 0, 0, fmt.Errorf("invalid window size %q, expected <cols>x<rows>", size)
+	}
+	return cols, rows, nil
+}
+
+// The largest window the participants can ask the shared terminal to have. Larger ones would only
+// make the applications allocate huge screens
+const (
+	maxReceiverCols = 1000
+	maxReceiverRows = 1000
+)
+
+// Returns the window size a receiver reported, within the sizes the shared terminal can have. The
+// sizes not set, zero or negative, stay not set
+func clampReceiverWinSize(cols, rows int) MsgTTYWinSize {
+	if cols <= 0 || rows <= 0 {
+		return MsgTTYWinSize{}
+	}
+	if cols > maxReceiverCols {
+		cols = maxReceiverCols
+	}
+	if rows > maxReceiverRows {
+		rows = maxReceiverRows
+	}
+	return MsgTTYWinSize{Cols: cols, Rows: rows}
+}
+
+func (s MsgTTYWinSize) isSet() bool {
+	return s.Cols > 0 && s.Rows > 0
+}
+
+// effectiveWinSize computes the size of the shared terminal. Receivers which didn't report their
+// size (e.g.: the browser, which adapts to whatever size the terminal has) are not considered. A
+// nil driver means the sharer was the last one to type.
+func effectiveWinSize(policy WinSizePolicy, fixed, sharer MsgTTYWinSize, receivers []MsgTTYWinSize, driver *MsgTTYWinSize) MsgTTYWinSize {
+	switch policy {
+	case WinSizePolicyFixed:
+		return fixed
+	case WinSizePolicyFollowDriver:
+		if driver != nil && driver.isSet() {
+			return *driver
+		}
+		return sharer
+	case WinSizePolicySmallest, WinSizePolicyLargest:
+		size := sharer
+		for _, r := range receivers {
+			if !r.isSet() {
+				continue
+			}
+			if !size.isSet() {
+				size = r
+				continue
+			}
+			if policy == WinSizePolicySmallest {
+				if r.Cols < size.Cols {
+					size.Cols = r.Cols
+				}
+				if r.Rows < size.Rows {
+					size.Rows = r.Rows
+				}
+			} else {
+				if r.Cols > size.Cols {
+					size.Cols = r.Cols
+				}
+				if r.Rows > size.Rows {
+					size.Rows = r.Rows
+				}
+			}
+		}
+		return size
+	}
+	return sharer
+}
@@ -0,0 +1,76 @@
+package server
+
+import "testing"
+
+func TestEffectiveWinSize(t *testing.T) {
+	sharer := MsgTTYWinSize{Cols: 120, Rows: 40}
+	fixed := MsgTTYWinSize{Cols: 100, Rows: 30}
+	small := MsgTTYWinSize{Cols: 80, Rows: 50}
+	large := MsgTTYWinSize{Cols: 200, Rows: 20}
+	receivers := []MsgTTYWinSize{small, {}, large}
+
+	tests := []struct {
+		policy   WinSizePolicy
+		driver   *MsgTTYWinSize
+		expected MsgTTYWinSize
+	}{
+		{WinSizePolicySharer, &small, sharer},
+		{WinSizePolicyFixed, nil, fixed},
+		{WinSizePolicySmallest, nil, MsgTTYWinSize{Cols: 80, Rows: 20}},
+		{WinSizePolicyLargest, nil, MsgTTYWinSize{Cols: 200, Rows: 50}},
+		{WinSizePolicyFollowDriver, nil, sharer},
+		{WinSizePolicyFollowDriver, &large, large},
+		{WinSizePolicyFollowDriver, &MsgTTYWinSize{}, sharer},
+	}
+
+	for _, test := range tests {
+		size := effectiveWinSize(test.policy, fixed, sharer, receivers, test.driver)
+		if size != test.expected {
+			t.Errorf("Policy %s: expected %v, got %v", test.policy, test.expected, size)
+		}
+	}
+
+	// Receivers which didn't report their size are ignored, even when the sharer has no size
+	size := effectiveWinSize(WinSizePolicySmallest, fixed, MsgTTYWinSize{}, receivers, nil)
+	if size != (MsgTTYWinSize{Cols: 80, Rows: 20}) {
+		t.Errorf("Expected 80x20 without a sharer size, got %v", size)
+	}
+}
+
+func TestClampReceiverWinSize(t *testing.T) {
+	tests := []struct {
+		cols, rows int
+		expected   MsgTTYWinSize
+	}{
+		{80, 24, MsgTTYWinSize{Cols: 80, Rows: 24}},
+		{0, 24, MsgTTYWinSize{}},
+		{80, -1, MsgTTYWinSize{}},
+		{100000, 24, MsgTTYWinSize{Cols: maxReceiverCols, Rows: 24}},
+		{80, 1 << 30, MsgTTYWinSize{Cols: 80, Rows: maxReceiverRows}},
+	}
+	for _, test := range tests {
+		if size := clampReceiverWinSize(test.cols, test.rows); size != test.expected {
+			t.Errorf("%dx%d: expected %v, got %v", test.cols, test.rows, test.expected, size)
+		}
+	}
+}
+
+func TestParseWinSizePolicy(t *testing.T) {
+	if p, err := ParseWinSizePolicy(""); err != nil || p != WinSizePolicySharer {
+		t.Errorf("Expected the sharer policy by default, got %q (%v)", p, err)
+	}
+	if _, err := ParseWinSizePolicy("biggest"); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+	if cols, rows, err := ParseWinSize("132x43"); err != nil || cols != 132 || rows != 43 {
+		t.Errorf("Expected 132x43, got %dx%d (%v)", cols, rows, err)
+	}
+	if _, _, err := ParseWinSize("0x43"); err == nil {
+		t.Errorf("Expected an error for a zero window size")
+	}
+	for _, invalid := range []string{"80x24abc", "80x", "x24", "80 x24", "65536x24", "80x99999999999"} {
+		if _, _, err := ParseWinSize(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
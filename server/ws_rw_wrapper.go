@@ -6,13 +6,45 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// The version of the tunnel protocol. In the first version, the destination of all the streams
+// was the Address of the TunInitMsg, and a failed connection to it closed the whole tunnel. From
+// version 2, each stream names its own destination, and gets a reply (see TunStreamMsg). The
+// server supports only the version 2, for the tunnels other than the reverse ones.
+const TunProtocolVersion = 2
+
 type TunInitMsg struct {
+	// The version of the tunnel protocol the client speaks. Missing for the first version
+	Version int
+	// The address the server listens on, for the reverse tunnels. The destination of all the
+	// streams, in the first version of the protocol
 	Address string
+	// If set, the server listens on the port from Address, on its loopback interface, and forwards
+	// the connections it accepts to the client, which connects them further to its own destination
+	Reverse bool
+	// If set, each stream names its own destination, like from version 2 of the protocol. Kept for
+	// the servers which know only this flag
+	Dynamic bool
+	// The token the participant got in its Welcome message, on the TTY connection. The tunnels are
+	// tied to the participants opening them
+	Token string
 }
 
 type WSConnReadWriteCloser struct {
 	WsConn *websocket.Conn
-	reader io.Reader
+	// If the compression was negotiated, the writes smaller than this are sent uncompressed, e.g.:
+	// the headers of the multiplexed streams. All of them are compressed if 0
+	CompressionThreshold int
+	reader               io.Reader
+	// Counts the data written, if set
+	traffic *trafficCounter
+	// The close message received from the other side, if any
+	closeErr *websocket.CloseError
+}
+
+// CloseError returns the close message received from the other side, or nil if the connection
+// wasn't closed that way
+func (conn *WSConnReadWriteCloser) CloseError() *websocket.CloseError {
+	return conn.closeErr
 }
 
 func (conn *WSConnReadWriteCloser) Read(p []byte) (n int, err error) {
@@ -28,6 +60,9 @@ func (conn *WSConnReadWriteCloser) Read(p []byte) (n int, err error) {
 	// https://stackoverflow.com/questions/61108552/go-websocket-error-close-1006-abnormal-closure-unexpected-eof
 
 	filterErr := func() {
+		if closeErr, ok := err.(*websocket.CloseError); ok {
+			conn.closeErr = closeErr
+		}
 
 		if err != nil && !websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 			// if we have an error != nil, and it's one of the two, then return EOF
@@ -56,6 +91,10 @@ func (conn *WSConnReadWriteCloser) Read(p []byte) (n int, err error) {
 }
 
 func (conn *WSConnReadWriteCloser) Write(p []byte) (n int, err error) {
+	if conn.CompressionThreshold > 0 {
+		conn.WsConn.EnableWriteCompression(len(p) >= conn.CompressionThreshold)
+	}
+	conn.traffic.addMessage(len(p))
 	return len(p), conn.WsConn.WriteMessage(websocket.BinaryMessage, p)
 }
 
@@ -0,0 +1,287 @@
+package share
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/elisescu/tty-share/proxy"
+	"github.com/elisescu/tty-share/server"
+	log "github.com/sirupsen/logrus"
+)
+
+// Options configure the session shared by Host
+type Options struct {
+	// The command to share, and its arguments
+	Command []string
+	// Added to the environment of the command, which also gets TTY_SHARE=1, and the URLs of the
+	// session, in TTY_SHARE_LOCAL_URL and TTY_SHARE_PUBLIC_URL
+	Env []string
+	// The working directory of the command. The current one, if empty
+	Dir string
+	// The address to serve the session on. A free port on localhost, if empty
+	Listen string
+	// The address of a tty-proxy server (e.g.: on.tty-share.com:443), to make the session public
+	Proxy string
+	// Connect to the tty-proxy server without TLS
+	NoTLS bool
+	// The size of the shared terminal. 80x24, if not set
+	Cols int
+	Rows int
+	// If set, gets a copy of the output of the command
+	Output io.Writer
+	// If set, what is read from it is typed in the shared terminal, as the sharer
+	Input io.Reader
+	// Stops the participants from typing. Can be changed later, with Server().SetReadOnly
+	ReadOnly bool
+	// Decides the role of each new participant: writer, viewer, or rejected. If nil, they all
+	// join as writers
+	Roles server.JoinApprover
+	// The most participants in the session at the same time. No limit if 0
+	MaxParticipants int
+	// Called with the events of the session
+	OnEvent func(event Event)
+	// If set, called with the configuration of the server before it's created, to set the rest of
+	// its options, e.g.: the tunnels, the file transfers, the lifetime limits. The PTY and the
+	// callbacks are set by Host, and should be left as they are
+	Configure func(config *server.TTYServerConfig)
+}
+
+// How long to wait for the rest of the output of the command, after it exited
+const outputDrainTimeout = time.Second
+
+// Session is a session shared by Host
+type Session struct {
+	server    *server.TTYServer
+	process   *Process
+	proxy     *proxy.Connection
+	listener  net.Listener
+	localURL  string
+	publicURL string
+	onEvent   func(event Event)
+
+	mutex sync.Mutex
+	// Why the session ended, if it was ended, and not by the command exiting
+	endReason string
+	endErr    error
+	// Closed when the session ended
+	done chan struct{}
+	err  error
+}
+
+// Host runs the command in a terminal of its own, and shares it. It returns once the session can
+// be joined. The session ends when the command exits, when it's closed, or when the context is
+// canceled.
+func Host(ctx context.Context, opts Options) (*Session, error) {
+	if len(opts.Command) == 0 {
+		return nil, &Error{Op: "start", Err: errors.New("no command to share")}
+	}
+	if opts.Listen == "" {
+		opts.Listen = "localhost:0"
+	}
+	if opts.Cols <= 0 || opts.Rows <= 0 {
+		opts.Cols, opts.Rows = 80, 24
+	}
+
+	s := &Session{
+		onEvent: opts.OnEvent,
+		done:    make(chan struct{}),
+	}
+	var err error
+	s.listener, err = (&net.ListenConfig{}).Listen(ctx, "tcp", opts.Listen)
+	if err != nil {
+		return nil, &Error{Op: "listen", Err: err}
+	}
+	address := s.listener.Addr().String()
+
+	sessionID := ""
+	if opts.Proxy != "" {
+		s.proxy, err = proxy.Connect(ctx, address, opts.Proxy, opts.NoTLS)
+		if err != nil {
+			s.listener.Close()
+			return nil, &Error{Op: "proxy", Err: err}
+		}
+		go s.proxy.RunProxy()
+		sessionID = s.proxy.SessionID
+		s.publicURL = s.proxy.PublicURL
+	}
+
+	cmd := exec.Command(opts.Command[0], opts.Command[1:]...)
+	cmd.Dir = opts.Dir
+	cmd.Env = append(os.Environ(), "TTY_SHARE=1", fmt.Sprintf("TTY_SHARE_LOCAL_URL=http://%s", address))
+	if s.publicURL != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("TTY_SHARE_PUBLIC_URL=%s", s.publicURL))
+	}
+	cmd.Env = append(cmd.Env, opts.Env...)
+	s.process, err = StartProcess(cmd, opts.Cols, opts.Rows)
+	if err != nil {
+		s.closeNetwork()
+		return nil, &Error{Op: "start", Err: err}
+	}
+
+	config := server.TTYServerConfig{
+		FrontListenAddress: address,
+		PTY:                s.process,
+		PTYResizer:         s.process,
+		SessionID:          sessionID,
+		ReadOnly:           opts.ReadOnly,
+		JoinApprover:       opts.Roles,
+		MaxParticipants:    opts.MaxParticipants,
+		OnWarning: func(text string) {
+			s.emit(Warning{Text: text})
+		},
+		OnEnd: func(reason string) {
+			s.end(reason, nil)
+		},
+		OnPause: func(paused bool) {
+			s.emit(PauseChanged{Paused: paused})
+		},
+		OnJoin: func(participant server.ParticipantInfo) {
+			s.emit(ParticipantJoined{Participant: participant})
+		},
+		OnLeave: func(participant server.ParticipantInfo) {
+			s.emit(ParticipantLeft{Participant: participant})
+		},
+	}
+	if opts.Configure != nil {
+		opts.Configure(&config)
+	}
+	s.localURL = fmt.Sprintf("http://%s%s/s/local/", address, server.CleanBaseUrlPath(config.BaseUrlPath))
+	s.server = server.NewTTYServer(config)
+	s.server.WindowSize(opts.Cols, opts.Rows)
+
+	go func() {
+		err := s.server.Serve(s.listener)
+		log.Debugf("Stopped serving the session: %s", err.Error())
+	}()
+	if opts.Input != nil {
+		go io.Copy(s, opts.Input)
+	}
+	go s.run(ctx, opts.Output)
+	return s, nil
+}
+
+func (s *Session) emit(event Event) {
+	if s.onEvent != nil {
+		s.onEvent(event)
+	}
+}
+
+// Passes the output of the command to the server, until the command exits, then cleans up
+func (s *Session) run(ctx context.Context, output io.Writer) {
+	var out io.Writer = s.server
+	if output != nil {
+		out = io.MultiWriter(output, s.server)
+	}
+	outputDone := make(chan struct{})
+	go func() {
+		io.Copy(out, s.process)
+		close(outputDone)
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.end("the context was canceled", ctx.Err())
+		case <-s.done:
+		}
+	}()
+
+	err := s.process.Wait()
+	// The rest of the output might still be in the pty, unless other processes keep it open
+	select {
+	case <-outputDone:
+	case <-time.After(outputDrainTimeout):
+	}
+	s.process.Close()
+	s.server.Stop()
+	s.closeNetwork()
+
+	s.mutex.Lock()
+	reason := s.endReason
+	if reason == "" {
+		reason = "the command exited"
+		s.err = err
+	} else {
+		s.err = s.endErr
+	}
+	s.mutex.Unlock()
+
+	s.emit(Ended{Reason: reason})
+	close(s.done)
+}
+
+func (s *Session) closeNetwork() {
+	s.listener.Close()
+	if s.proxy != nil {
+		s.proxy.Stop()
+	}
+}
+
+// Ends the session, for the reason, unless it was ended before
+func (s *Session) end(reason string, err error) {
+	s.mutex.Lock()
+	ended := s.endReason != ""
+	if !ended {
+		s.endReason, s.endErr = reason, err
+	}
+	s.mutex.Unlock()
+
+	if !ended {
+		s.process.Stop()
+	}
+}
+
+// Server returns the server of the session, to see the participants, and control the session
+// (e.g.: Kick, SetRole, SetPaused)
+func (s *Session) Server() *server.TTYServer {
+	return s.server
+}
+
+// LocalURL returns the URL to join the session at, on this machine
+func (s *Session) LocalURL() string {
+	return s.localURL
+}
+
+// PublicURL returns the URL to join the session at, through the tty-proxy server. Empty if the
+// session is not public
+func (s *Session) PublicURL() string {
+	return s.publicURL
+}
+
+// Write types the data in the shared terminal, as the sharer
+func (s *Session) Write(data []byte) (int, error) {
+	s.server.SharerInput()
+	return s.process.Write(data)
+}
+
+// Resize changes the size of the sharer's terminal. The size of the shared terminal then follows
+// the window size policy of the server
+func (s *Session) Resize(cols, rows int) {
+	s.server.WindowSize(cols, rows)
+}
+
+// Close ends the session, and waits until it ended
+func (s *Session) Close() error {
+	s.end("the session was closed", nil)
+	<-s.done
+	return nil
+}
+
+// Done is closed when the session ended
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait waits until the session ends. It returns the error of the command, if it failed, or the
+// error of the context, if the session ended because the context was canceled
+func (s *Session) Wait() error {
+	<-s.done
+	return s.err
+}
@@ -0,0 +1,108 @@
+package share
+
+import (
+	"context"
+	"io"
+
+	"github.com/elisescu/tty-share/server"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// JoinOptions configure how a session is joined
+type JoinOptions struct {
+	// The name to join the session with, shown to the sharer
+	Name string
+	// The size of the participant's terminal, which might be used to decide the size of the
+	// shared terminal. Not reported, if not set
+	Cols int
+	Rows int
+	// Called with the events of the session
+	OnEvent func(event Event)
+}
+
+// Join joins the session at the URL, with the default options. See JoinOptions.Join
+func Join(ctx context.Context, sessionURL string, rw io.ReadWriter) error {
+	return JoinOptions{}.Join(ctx, sessionURL, rw)
+}
+
+// Join joins the session at the URL: the output of the shared terminal is written to rw, and what
+// is read from rw is typed in it. It returns once the session ends, or the participant is removed
+// from it (nil), or the context is canceled (the error of the context). rw is not closed, so a
+// Read blocked on it is left behind.
+func (opts JoinOptions) Join(ctx context.Context, sessionURL string, rw io.ReadWriter) error {
+	info, err := Lookup(ctx, sessionURL)
+	if err != nil {
+		return err
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	wsConn, _, err := dialer.DialContext(ctx, info.TTYURL, nil)
+	if err != nil {
+		return &Error{Op: "connect", Err: err}
+	}
+	defer wsConn.Close()
+	// The input is typed a few bytes at a time, which don't compress
+	wsConn.EnableWriteCompression(false)
+
+	emit := func(event Event) {
+		if opts.OnEvent != nil {
+			opts.OnEvent(event)
+		}
+	}
+
+	protoWS := server.NewTTYProtocolWSLocked(wsConn)
+	if opts.Cols > 0 && opts.Rows > 0 {
+		protoWS.SetWinSize(opts.Cols, opts.Rows)
+	}
+	protoWS.SendHello(server.MsgTTYHello{Name: opts.Name})
+
+	// Closing the connection ends the loop below
+	readDone := make(chan struct{})
+	defer close(readDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			wsConn.Close()
+		case <-readDone:
+		}
+	}()
+
+	go func() {
+		_, err := io.Copy(protoWS, rw)
+		log.Debugf("Stopped reading the input: %v", err)
+	}()
+
+	var writeErr error
+	for {
+		err := protoWS.ReadAndHandle(server.TTYProtocolHandlers{
+			OnWrite: func(data []byte) {
+				if _, err := rw.Write(data); err != nil && writeErr == nil {
+					writeErr = err
+					wsConn.Close()
+				}
+			},
+			OnWinSize: func(cols, rows int) {
+				emit(Resized{Cols: cols, Rows: rows})
+			},
+			OnWelcome: func(id, token string) {
+				emit(Welcomed{ID: id})
+			},
+			OnNotice: func(text string) {
+				emit(Notice{Text: text})
+			},
+		})
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Debugf("Cannot parse the message of the server: %s", err.Error())
+		}
+	}
+
+	if writeErr != nil {
+		return &Error{Op: "write", Err: writeErr}
+	}
+	return ctx.Err()
+}
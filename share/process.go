@@ -0,0 +1,99 @@
+package share
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	ptyDevice "github.com/creack/pty"
+)
+
+// Process is a command running in a pty of its own, as shared by Host, and by tty-share itself.
+// It's the server's PTYHandler and PTYResizer
+type Process struct {
+	cmd     *exec.Cmd
+	ptyFile *os.File
+	// The size the pty should have. Refresh() changes the size of the pty only temporarily
+	winSize      ptyDevice.Winsize
+	winSizeMutex sync.Mutex
+	// Set once the pty is closed, so it's not resized anymore
+	closed bool
+}
+
+// StartProcess starts the command in a new pty, of the given size
+func StartProcess(cmd *exec.Cmd, cols, rows int) (*Process, error) {
+	p := &Process{
+		cmd:     cmd,
+		winSize: ptyDevice.Winsize{Cols: uint16(cols), Rows: uint16(rows)},
+	}
+	var err error
+	p.ptyFile, err = ptyDevice.StartWithSize(cmd, &p.winSize)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Read reads the output of the command
+func (p *Process) Read(data []byte) (int, error) {
+	return p.ptyFile.Read(data)
+}
+
+// Write types the data in the terminal of the command
+func (p *Process) Write(data []byte) (int, error) {
+	return p.ptyFile.Write(data)
+}
+
+// SetWinSize resizes the pty, unless it's closed
+func (p *Process) SetWinSize(rows, cols int) {
+	p.winSizeMutex.Lock()
+	defer p.winSizeMutex.Unlock()
+	p.winSize = ptyDevice.Winsize{Rows: uint16(rows), Cols: uint16(cols)}
+	if !p.closed {
+		ptyDevice.Setsize(p.ptyFile, &p.winSize)
+	}
+}
+
+// Refresh makes the application redraw itself. There's no way to ask for that, so the pty is made
+// one row smaller for a moment
+func (p *Process) Refresh() {
+	p.winSizeMutex.Lock()
+	defer p.winSizeMutex.Unlock()
+	smaller := p.winSize
+	if smaller.Rows < 2 || p.closed {
+		return
+	}
+	smaller.Rows--
+	ptyDevice.Setsize(p.ptyFile, &smaller)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		// Restore the size the pty should have now, which might have changed in the meantime
+		p.winSizeMutex.Lock()
+		if !p.closed {
+			ptyDevice.Setsize(p.ptyFile, &p.winSize)
+		}
+		p.winSizeMutex.Unlock()
+	}()
+}
+
+// Wait waits until the command exits
+func (p *Process) Wait() error {
+	return p.cmd.Wait()
+}
+
+// Stop kills the command. Some, like bash, don't exit on SIGTERM alone
+func (p *Process) Stop() {
+	p.cmd.Process.Signal(syscall.SIGTERM)
+	p.cmd.Process.Signal(syscall.SIGKILL)
+}
+
+// Close closes the pty. It's not resized after that
+func (p *Process) Close() error {
+	p.winSizeMutex.Lock()
+	p.closed = true
+	p.winSizeMutex.Unlock()
+	return p.ptyFile.Close()
+}
@@ -0,0 +1,278 @@
+// Package share embeds tty-share in other programs: Host shares a command, in a terminal of its
+// own, and Join joins a session, from any io.ReadWriter. What happens in the session is reported
+// with the events below.
+//
+//	session, err := share.Host(ctx, share.Options{Command: []string{"bash"}})
+//	if err != nil {
+//		return err
+//	}
+//	fmt.Println("join at", session.LocalURL())
+//	return session.Wait()
+package share
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/elisescu/tty-share/server"
+)
+
+// Error is the error returned by the functions of this package. Op tells what failed: listen,
+// proxy, start, lookup, connect, or write
+type Error struct {
+	Op  string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Op, e.Err.Error())
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Event is something which happened in a session: one of the types below. The events are passed
+// to the OnEvent callbacks, which should return quickly
+type Event interface {
+	event()
+}
+
+// ParticipantJoined is sent to the host, when a participant is admitted in the session
+type ParticipantJoined struct {
+	Participant server.ParticipantInfo
+}
+
+// ParticipantLeft is sent to the host, when a participant leaves, or is removed from the session
+type ParticipantLeft struct {
+	Participant server.ParticipantInfo
+}
+
+// PauseChanged is sent to the host, when the sharing is paused or resumed
+type PauseChanged struct {
+	Paused bool
+}
+
+// Warning is sent to the host, when the session is about to end, because of one of its limits
+// (see server.TTYServerConfig)
+type Warning struct {
+	Text string
+}
+
+// Ended is sent to the host when the session ends, with the reason, e.g.: the command exited
+type Ended struct {
+	Reason string
+}
+
+// Welcomed is sent to the participant, once it's admitted in the session, with its ID
+type Welcomed struct {
+	ID string
+}
+
+// Notice is sent to the participant, when the server tells it something about the session
+type Notice struct {
+	Text string
+}
+
+// Resized is sent to the participant, when the size of the shared terminal changes
+type Resized struct {
+	Cols int
+	Rows int
+}
+
+func (ParticipantJoined) event() {}
+func (ParticipantLeft) event()   {}
+func (PauseChanged) event()      {}
+func (Warning) event()           {}
+func (Ended) event()             {}
+func (Welcomed) event()          {}
+func (Notice) event()            {}
+func (Resized) event()           {}
+
+// SessionInfo tells where to connect to, for a session
+type SessionInfo struct {
+	// The version of the protocol the server speaks
+	Protocol  int
+	TTYURL    string
+	TunnelURL string
+	// Empty if the server doesn't allow file transfers
+	FilesURL string
+	// What the server tells about itself, and about the session. nil for the servers older than
+	// the info endpoint, which tell only the URLs, and the Protocol
+	Server *server.ServerInfo
+}
+
+// Feature is something a participant can do in a session, if the server, and the session, support
+// it (see SessionInfo.Require)
+type Feature int
+
+const (
+	// Local tunnels (-L)
+	FeatureTunnels Feature = iota
+	// Tunnels listening on the side of the server (-R)
+	FeatureReverseTunnels
+	// Tunnels to the destinations chosen for each connection, like a SOCKS proxy (-D)
+	FeatureDynamicTunnels
+	// Tunnels to Unix sockets, and of UDP datagrams
+	FeatureTunnelNetworks
+	FeatureUploads
+	FeatureDownloads
+)
+
+type featureSpec struct {
+	name string
+	// The first version of the protocol supporting it
+	protocol int
+	// Tells if the session allows it
+	allowed func(features server.ServerFeatures) bool
+	// The flag of the sharer allowing it
+	flag string
+}
+
+var features = map[Feature]featureSpec{
+	FeatureTunnels: {"tunnels", 2,
+		func(f server.ServerFeatures) bool { return f.Tunnels }, "-A"},
+	FeatureReverseTunnels: {"reverse tunnels", 3,
+		func(f server.ServerFeatures) bool { return f.ReverseTunnels }, "--allow-reverse-tunnels"},
+	FeatureDynamicTunnels: {"dynamic tunnels", 4,
+		func(f server.ServerFeatures) bool { return f.Tunnels }, "-A"},
+	FeatureTunnelNetworks: {"tunnels to Unix sockets, and of UDP datagrams", 5,
+		func(f server.ServerFeatures) bool { return f.Tunnels }, "-A"},
+	FeatureUploads: {"uploads", 7,
+		func(f server.ServerFeatures) bool { return f.Uploads }, "--upload-dir"},
+	FeatureDownloads: {"downloads", 7,
+		func(f server.ServerFeatures) bool { return f.Downloads }, "--offer"},
+}
+
+func (feature Feature) String() string {
+	return features[feature].name
+}
+
+// UnsupportedError is returned by SessionInfo.Require, for a feature the server, or the session,
+// doesn't support
+type UnsupportedError struct {
+	Feature Feature
+	// Why it's not supported
+	Reason string
+}
+
+func (e *UnsupportedError) Error() string {
+	return e.Reason
+}
+
+// Require returns an *UnsupportedError, if the server, or the session, doesn't support the
+// feature. The servers older than the info endpoint tell only the version of their protocol, so
+// their sessions are assumed to allow what the protocol supports
+func (info *SessionInfo) Require(feature Feature) error {
+	spec := features[feature]
+	if info.Protocol < spec.protocol {
+		return &UnsupportedError{Feature: feature, Reason: fmt.Sprintf("the server is too old for %s (protocol %d, %d needed)",
+			spec.name, info.Protocol, spec.protocol)}
+	}
+	allowed := true
+	if info.Server != nil {
+		allowed = spec.allowed(info.Server.Features)
+	} else if feature == FeatureUploads || feature == FeatureDownloads {
+		allowed = info.FilesURL != ""
+	}
+	if !allowed {
+		return &UnsupportedError{Feature: feature, Reason: fmt.Sprintf("the session doesn't allow %s (the sharer allows them with %s)",
+			spec.name, spec.flag)}
+	}
+	return nil
+}
+
+// Lookup returns where to connect to, for the session at the URL, and what it supports, as told by
+// the server at its info endpoint. With the older servers, the URLs are taken from the headers of
+// the session page
+func Lookup(ctx context.Context, sessionURL string) (*SessionInfo, error) {
+	httpURL, err := url.Parse(sessionURL)
+	if err != nil {
+		return nil, &Error{Op: "lookup", Err: err}
+	}
+
+	// Build the WS URLs from the host part of the given http URL and the paths from the server
+	wsScheme := "ws"
+	if httpURL.Scheme == "https" {
+		wsScheme = "wss"
+	}
+	wsURL := func(path string) string {
+		if path == "" {
+			return ""
+		}
+		return wsScheme + "://" + httpURL.Host + path
+	}
+
+	serverInfo, err := getServerInfo(ctx, httpURL)
+	if err != nil {
+		return nil, &Error{Op: "lookup", Err: err}
+	}
+	if serverInfo != nil {
+		return &SessionInfo{
+			Protocol:  serverInfo.Protocol,
+			TTYURL:    wsURL(serverInfo.TTYWSPath),
+			TunnelURL: wsURL(serverInfo.TunnelWSPath),
+			FilesURL:  wsURL(serverInfo.FilesWSPath),
+			Server:    serverInfo,
+		}, nil
+	}
+
+	resp, err := get(ctx, sessionURL)
+	if err != nil {
+		return nil, &Error{Op: "lookup", Err: err}
+	}
+	resp.Body.Close()
+
+	info := &SessionInfo{
+		TTYURL:    wsURL(resp.Header.Get("TTYSHARE-TTY-WSPATH")),
+		TunnelURL: wsURL(resp.Header.Get("TTYSHARE-TUNNEL-WSPATH")),
+		FilesURL:  wsURL(resp.Header.Get("TTYSHARE-FILES-WSPATH")),
+	}
+	info.Protocol, _ = strconv.Atoi(resp.Header.Get("TTYSHARE-VERSION"))
+	if info.TTYURL == "" {
+		return nil, &Error{Op: "lookup", Err: fmt.Errorf("%s is not a tty-share session", sessionURL)}
+	}
+	return info, nil
+}
+
+func get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// Gets the info of the session at the URL. nil, without an error, if the server is older than the
+// info endpoint, and doesn't serve it
+func getServerInfo(ctx context.Context, sessionURL *url.URL) (*server.ServerInfo, error) {
+	infoURL := *sessionURL
+	infoURL.Path = strings.TrimSuffix(infoURL.Path, "/") + "/info"
+	infoURL.RawPath = ""
+	infoURL.RawQuery = ""
+	infoURL.Fragment = ""
+
+	resp, err := get(ctx, infoURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// The older servers answer with their 404 page
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		return nil, nil
+	}
+
+	var info server.ServerInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("invalid session info: %w", err)
+	}
+	if info.TTYWSPath == "" {
+		return nil, fmt.Errorf("%s is not a tty-share session", sessionURL)
+	}
+	return &info, nil
+}
@@ -0,0 +1,152 @@
+package share
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elisescu/tty-share/server"
+)
+
+// The participant's side of a test session: what it types, and the output it gets
+type testTerminal struct {
+	input *io.PipeReader
+	mutex sync.Mutex
+	out   bytes.Buffer
+}
+
+func (t *testTerminal) Read(data []byte) (int, error) {
+	return t.input.Read(data)
+}
+
+func (t *testTerminal) Write(data []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.out.Write(data)
+}
+
+func (t *testTerminal) output() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.out.String()
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for start := time.Now(); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestHostAndJoin(t *testing.T) {
+	events := make(chan Event, 16)
+	session, err := Host(context.Background(), Options{
+		Command: []string{"cat"},
+		OnEvent: func(event Event) { events <- event },
+	})
+	if err != nil {
+		t.Fatalf("cannot host: %s", err.Error())
+	}
+
+	input, typing := io.Pipe()
+	term := &testTerminal{input: input}
+	joined := make(chan error)
+	go func() {
+		joined <- JoinOptions{Name: "alice"}.Join(context.Background(), session.LocalURL(), term)
+	}()
+
+	event := <-events
+	if e, ok := event.(ParticipantJoined); !ok || e.Participant.Name != "alice" {
+		t.Errorf("expected alice to join, got %#v", event)
+	}
+
+	// cat echoes, and repeats what the participant types
+	typing.Write([]byte("hello\n"))
+	waitFor(t, "the output", func() bool { return strings.Count(term.output(), "hello") == 2 })
+
+	session.Close()
+	if err := <-joined; err != nil {
+		t.Errorf("expected the participant to leave without an error, got %s", err.Error())
+	}
+	for event := range events {
+		if e, ok := event.(Ended); ok {
+			if e.Reason != "the session was closed" {
+				t.Errorf("unexpected reason: %s", e.Reason)
+			}
+			break
+		}
+	}
+	if err := session.Wait(); err != nil {
+		t.Errorf("expected no error, got %s", err.Error())
+	}
+}
+
+func TestHostCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	session, err := Host(ctx, Options{Command: []string{"sleep", "10"}})
+	if err != nil {
+		t.Fatalf("cannot host: %s", err.Error())
+	}
+	cancel()
+	if err := session.Wait(); err != context.Canceled {
+		t.Errorf("expected the context's error, got %v", err)
+	}
+
+	if _, err := Host(context.Background(), Options{Command: []string{"/does/not/exist"}}); err == nil {
+		t.Errorf("expected an error")
+	} else if e, ok := err.(*Error); !ok || e.Op != "start" {
+		t.Errorf("expected a start error, got %#v", err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	ttyServer := server.NewTTYServer(server.TTYServerConfig{SessionID: "abc", AllowTunneling: true, Version: "1.2.3"})
+	app := httptest.NewServer(ttyServer)
+	defer app.Close()
+
+	info, err := Lookup(context.Background(), app.URL+"/s/local/?name=alice")
+	if err != nil {
+		t.Fatalf("cannot look the session up: %s", err.Error())
+	}
+	wsURL := "ws" + strings.TrimPrefix(app.URL, "http")
+	if info.Server == nil || info.Server.Version != "1.2.3" || info.Server.Session.ID != "local" ||
+		info.TTYURL != wsURL+"/s/local/ws/" || info.TunnelURL != wsURL+"/s/local/tws" || info.FilesURL != "" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if err := info.Require(FeatureDynamicTunnels); err != nil {
+		t.Errorf("expected the tunnels to be allowed: %s", err.Error())
+	}
+	var unsupported *UnsupportedError
+	if err := info.Require(FeatureReverseTunnels); !errors.As(err, &unsupported) || unsupported.Feature != FeatureReverseTunnels {
+		t.Errorf("expected the reverse tunnels not to be allowed, got %v", err)
+	}
+
+	// The older servers tell only the paths, and their protocol, in the headers of the page
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("TTYSHARE-VERSION", "3")
+		w.Header().Add("TTYSHARE-TTY-WSPATH", "/s/local/ws/")
+		w.Header().Add("TTYSHARE-TUNNEL-WSPATH", "/s/local/tws")
+	}))
+	defer old.Close()
+	info, err = Lookup(context.Background(), old.URL+"/s/local/")
+	if err != nil {
+		t.Fatalf("cannot look the old session up: %s", err.Error())
+	}
+	if info.Server != nil || info.Protocol != 3 || info.TTYURL != "ws"+strings.TrimPrefix(old.URL, "http")+"/s/local/ws/" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if err := info.Require(FeatureReverseTunnels); err != nil {
+		t.Errorf("expected the reverse tunnels to be assumed allowed: %s", err.Error())
+	}
+	if err := info.Require(FeatureDynamicTunnels); !errors.As(err, &unsupported) {
+		t.Errorf("expected the server to be too old for dynamic tunnels, got %v", err)
+	}
+}
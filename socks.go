@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/elisescu/tty-share/server"
+	log "github.com/sirupsen/logrus"
+)
+
+// A minimal SOCKS5 server (RFC 1928), used for the dynamic tunnels (-D). It supports only the
+// CONNECT command, without authentication, and IPv4, IPv6 and domain name destinations. Each SOCKS
+// connection is carried over its own tunnel stream, which names the destination, so the server
+// side connects to it.
+
+const (
+	socksVersion          = 5
+	socksNoAuth           = 0
+	socksNoAcceptable     = 0xff
+	socksCmdConnect       = 1
+	socksAddrIPv4         = 1
+	socksAddrDomain       = 3
+	socksAddrIPv6         = 4
+	socksSucceeded        = 0
+	socksNotAllowed       = 2
+	socksHostUnreach      = 4
+	socksCmdNotSupported  = 7
+	socksAddrNotSupported = 8
+)
+
+// Reads the SOCKS handshake from conn and returns the destination address the client asked for
+func socksHandshake(conn net.Conn) (string, error) {
+	// Greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == socksNoAuth
+	}
+	if !noAuth {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", errors.New("the SOCKS client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return "", err
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[1] != socksCmdConnect {
+		socksReply(conn, socksCmdNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if request[3] == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksAddrNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// Writes the reply to a SOCKS request. We don't know the address the server side used to connect
+// to the destination, so the bound address is always 0.0.0.0:0
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// Serves one SOCKS connection, forwarding it over a tunnel stream to the destination, opened with
+// openStream
+func serveSocksConn(conn net.Conn, openStream func(address string) (net.Conn, error)) {
+	defer conn.Close()
+
+	address, err := socksHandshake(conn)
+	if err != nil {
+		log.Debugf("SOCKS handshake failed: %s", err.Error())
+		return
+	}
+
+	stream, err := openStream(address)
+	if err != nil {
+		log.Debugf("Cannot tunnel the SOCKS connection to %s: %s", address, err.Error())
+		if tunErr, ok := err.(*server.TunnelError); ok && tunErr.Code == server.TunErrorDenied {
+			socksReply(conn, socksNotAllowed)
+		} else {
+			socksReply(conn, socksHostUnreach)
+		}
+		return
+	}
+	defer stream.Close()
+
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		return
+	}
+
+	go func() {
+		io.Copy(stream, conn)
+		defer stream.Close()
+		defer conn.Close()
+	}()
+	io.Copy(conn, stream)
+}
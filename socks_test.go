@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/elisescu/tty-share/server"
+)
+
+func TestServeSocksConn(t *testing.T) {
+	greeting := []byte{socksVersion, 1, socksNoAuth}
+	noAuth := []byte{socksVersion, socksNoAuth}
+	reply := func(status byte) []byte {
+		return []byte{socksVersion, status, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	connect := []byte{socksVersion, socksCmdConnect, 0}
+	ipv4 := []byte{socksAddrIPv4, 127, 0, 0, 1, 0, 80}
+	ipv6 := join([]byte{socksAddrIPv6}, net.ParseIP("fd00::1"), []byte{0x1f, 0x90})
+	domain := join([]byte{socksAddrDomain, 11}, []byte("example.com"), []byte{1, 0xbb})
+
+	tests := []struct {
+		name    string
+		request []byte
+		openErr error
+		// The destination of the stream opened, if any
+		address string
+		reply   []byte
+	}{
+		{"IPv4", join(greeting, connect, ipv4), nil, "127.0.0.1:80", join(noAuth, reply(socksSucceeded))},
+		{"IPv6", join(greeting, connect, ipv6), nil, "[fd00::1]:8080", join(noAuth, reply(socksSucceeded))},
+		{"domain", join(greeting, connect, domain), nil, "example.com:443", join(noAuth, reply(socksSucceeded))},
+		{"more methods", join([]byte{socksVersion, 3, 2, 1, socksNoAuth}, connect, ipv4), nil, "127.0.0.1:80", join(noAuth, reply(socksSucceeded))},
+		{"SOCKS4", []byte{4, 1, 0, 80, 127, 0, 0, 1, 0}, nil, "", nil},
+		{"authentication only", []byte{socksVersion, 1, 2}, nil, "", []byte{socksVersion, socksNoAcceptable}},
+		{"no methods", []byte{socksVersion, 0}, nil, "", []byte{socksVersion, socksNoAcceptable}},
+		{"bind", join(greeting, []byte{socksVersion, 2, 0}, ipv4), nil, "", join(noAuth, reply(socksCmdNotSupported))},
+		{"UDP associate", join(greeting, []byte{socksVersion, 3, 0}, ipv4), nil, "", join(noAuth, reply(socksCmdNotSupported))},
+		{"unknown address type", join(greeting, connect, []byte{5, 1, 2, 3, 4, 0, 80}), nil, "", join(noAuth, reply(socksAddrNotSupported))},
+		{"denied", join(greeting, connect, ipv4), &server.TunnelError{Code: server.TunErrorDenied}, "127.0.0.1:80", join(noAuth, reply(socksNotAllowed))},
+		{"unreachable", join(greeting, connect, domain), errors.New("no such host"), "example.com:443", join(noAuth, reply(socksHostUnreach))},
+	}
+
+	for _, test := range tests {
+		client, conn := net.Pipe()
+		address := ""
+		done := make(chan struct{})
+		go func() {
+			serveSocksConn(conn, func(a string) (net.Conn, error) {
+				address = a
+				if test.openErr != nil {
+					return nil, test.openErr
+				}
+				// The destination closes the connection right away
+				stream, destination := net.Pipe()
+				destination.Close()
+				return stream, nil
+			})
+			close(done)
+		}()
+		go client.Write(test.request)
+
+		received, _ := io.ReadAll(client)
+		<-done
+		client.Close()
+		if !bytes.Equal(received, test.reply) {
+			t.Errorf("%s: expected the reply %v, got %v", test.name, test.reply, received)
+		}
+		if address != test.address {
+			t.Errorf("%s: expected the destination %q, got %q", test.name, test.address, address)
+		}
+	}
+}
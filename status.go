@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/elisescu/tty-share/server"
+)
+
+// How long tty-share status and tty-share prompt wait for the answer. Short, as they are run for
+// each prompt
+const statusTimeout = 2 * time.Second
+
+// The default format of tty-share prompt: nothing when nobody joined
+const defaultPromptFormat = `{{if .Participants}}👀 {{.Participants}} participant{{if gt .Participants 1}}s{{end}}{{end}}`
+
+// The state of the session the shell runs in, as shown by tty-share status and tty-share prompt
+type sessionStatus struct {
+	LocalURL     string
+	PublicURL    string
+	Uptime       time.Duration `json:"-"`
+	UptimeSecs   int64
+	Paused       bool
+	ReadOnly     bool
+	Participants int
+	Viewers      int
+	Writers      int
+	// The names the participants joined with, or their IDs
+	Names []string
+	// The details of each participant
+	List []server.ParticipantInfo
+}
+
+var errNotShared = errors.New("not inside a shared terminal")
+
+// Asks the tty-share this shell runs under about the session. The environment of the shell tells
+// where its control socket is
+func querySessionStatus() (*sessionStatus, error) {
+	socket := os.Getenv(controlSocketEnv)
+	if os.Getenv("TTY_SHARE") != "1" || socket == "" {
+		return nil, errNotShared
+	}
+
+	var info ControlInfo
+	if err := callControl(socket, "Info", &ControlEmpty{}, &info, statusTimeout); err != nil {
+		return nil, err
+	}
+
+	status := &sessionStatus{
+		Uptime:       time.Since(info.StartedAt).Round(time.Second),
+		Paused:       info.Paused,
+		ReadOnly:     info.ReadOnly,
+		Participants: len(info.Participants),
+		Names:        []string{},
+		List:         info.Participants,
+	}
+	status.UptimeSecs = int64(status.Uptime.Seconds())
+	if len(info.URLs) > 0 {
+		status.LocalURL = info.URLs[0]
+	}
+	if len(info.URLs) > 1 {
+		status.PublicURL = info.URLs[1]
+	}
+	for _, p := range info.Participants {
+		if p.Role == server.RoleWriter {
+			status.Writers++
+		} else {
+			status.Viewers++
+		}
+		name := p.Name
+		if name == "" {
+			name = p.ID
+		}
+		status.Names = append(status.Names, name)
+	}
+	return status, nil
+}
+
+// Quotes the value for a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// Runs the status and prompt commands, returning the exit code
+func runStatusCommand(command string, args []string) int {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "Print the status as JSON, with the details of each participant")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `
+Usage:
+  tty-share status [--json]     # the participants, the URLs and the uptime of the session, as shell variables
+  tty-share prompt [<format>]   # a short status for PS1, or a tmux status bar. Prints nothing outside a shared terminal
+
+Both only work inside a terminal shared by tty-share. The format of the prompt is a Go template,
+with the fields: .Participants, .Viewers, .Writers, .Names, .Uptime, .Paused, .ReadOnly, .LocalURL,
+and .PublicURL. The default one is:
+  %s
+
+Flags:
+`, defaultPromptFormat)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = flags.Args()
+
+	if command == "prompt" {
+		format := defaultPromptFormat
+		if len(args) > 0 {
+			format = strings.Join(args, " ")
+		}
+		tmpl, err := template.New("prompt").Parse(format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid format: %s\n", err.Error())
+			return 2
+		}
+		// A prompt should never be in the way: outside a session, or when the session doesn't
+		// answer, print nothing
+		status, err := querySessionStatus()
+		if err != nil {
+			return 1
+		}
+		if err := tmpl.Execute(os.Stdout, status); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid format: %s\n", err.Error())
+			return 2
+		}
+		return 0
+	}
+
+	if len(args) > 0 {
+		flags.Usage()
+		return 2
+	}
+	status, err := querySessionStatus()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	if *jsonOutput {
+		data, _ := json.MarshalIndent(status, "", "  ")
+		fmt.Printf("%s\n", data)
+		return 0
+	}
+
+	// Lines which can be evaluated by a shell: eval "$(tty-share status)"
+	fmt.Printf("uptime=%d\n", status.UptimeSecs)
+	fmt.Printf("participants=%d\nviewers=%d\nwriters=%d\n", status.Participants, status.Viewers, status.Writers)
+	fmt.Printf("names=%s\n", shellQuote(strings.Join(status.Names, " ")))
+	fmt.Printf("paused=%t\nread_only=%t\n", status.Paused, status.ReadOnly)
+	fmt.Printf("local_url=%s\npublic_url=%s\n", shellQuote(status.LocalURL), shellQuote(status.PublicURL))
+	return 0
+}
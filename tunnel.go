@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elisescu/tty-share/server"
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+	log "github.com/sirupsen/logrus"
+)
+
+// The client side of the forward tunnels (-L and -D). With the servers speaking the version 2 of
+// the tunnel protocol, all of them share one tunnel WS connection, and each stream names its own
+// destination. Older servers get one WS connection for each -L tunnel, with a fixed destination.
+
+// The idle time after which the stream of a peer of a UDP tunnel is closed
+const udpIdleTimeout = 2 * time.Minute
+
+// A -L tunnel: the connections accepted on listenAddress go to remoteAddress, from the server side.
+// The networks are tcp, unix, or udp for both of them
+type localForward struct {
+	listenNetwork string
+	listenAddress string
+	remoteNetwork string
+	remoteAddress string
+}
+
+func isPort(s string) bool {
+	port, err := strconv.Atoi(s)
+	return err == nil && port > 0 && port <= 65535
+}
+
+// Splits spec on the colons which are not between brackets, and removes the brackets
+func splitForwardSpec(spec string) ([]string, error) {
+	parts := []string{}
+	var part strings.Builder
+	inBrackets := false
+	for _, r := range spec {
+		switch {
+		case r == '[' && !inBrackets:
+			inBrackets = true
+		case r == ']' && inBrackets:
+			inBrackets = false
+		case r == ':' && !inBrackets:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteRune(r)
+		}
+	}
+	if inBrackets {
+		return nil, fmt.Errorf("invalid tunnel %s: missing ]", spec)
+	}
+	return append(parts, part.String()), nil
+}
+
+// Parses a -L tunnel, like ssh does: [bind_address:]port:host:hostport, with the IPv6 addresses
+// between brackets. Both sides can be Unix socket paths instead, and a /udp suffix makes it a UDP
+// tunnel (e.g.: 5353:10.0.0.1:53/udp, /tmp/docker.sock:/var/run/docker.sock). Without a bind
+// address, only the loopback interface is used, and * means all the interfaces.
+func parseLocalForward(spec string) (f localForward, err error) {
+	invalid := fmt.Errorf("invalid tunnel %s, expected [bind_address:]port:host:hostport[/udp], with ports or Unix socket paths on either side", spec)
+
+	udp := false
+	if trimmed := strings.TrimSuffix(spec, "/udp"); trimmed != spec && isPort(trimmed[strings.LastIndex(trimmed, ":")+1:]) {
+		spec, udp = trimmed, true
+	}
+
+	parts, err := splitForwardSpec(spec)
+	if err != nil {
+		return f, err
+	}
+
+	// The remote side is either a Unix socket path, or a host and a port
+	var local []string
+	n := len(parts)
+	if n >= 2 && strings.HasPrefix(parts[n-1], "/") {
+		f.remoteNetwork, f.remoteAddress = "unix", parts[n-1]
+		local = parts[:n-1]
+	} else if n >= 3 && parts[n-2] != "" && isPort(parts[n-1]) {
+		f.remoteNetwork, f.remoteAddress = "tcp", net.JoinHostPort(parts[n-2], parts[n-1])
+		local = parts[:n-2]
+	} else {
+		return f, invalid
+	}
+
+	switch {
+	case len(local) == 1 && strings.HasPrefix(local[0], "/"):
+		f.listenNetwork, f.listenAddress = "unix", local[0]
+	case len(local) == 1 && isPort(local[0]):
+		f.listenNetwork, f.listenAddress = "tcp", net.JoinHostPort("localhost", local[0])
+	case len(local) == 2 && isPort(local[1]):
+		bindAddress := local[0]
+		if bindAddress == "*" {
+			bindAddress = ""
+		}
+		f.listenNetwork, f.listenAddress = "tcp", net.JoinHostPort(bindAddress, local[1])
+	default:
+		return f, invalid
+	}
+
+	if udp {
+		if f.listenNetwork != "tcp" || f.remoteNetwork != "tcp" {
+			return f, fmt.Errorf("invalid tunnel %s: UDP tunnels need ports on both sides", spec)
+		}
+		f.listenNetwork, f.remoteNetwork = "udp", "udp"
+	}
+	return f, nil
+}
+
+// Parses a -R tunnel: [bind_address:]port:host:hostport, with the IPv6 addresses between brackets.
+// The server listens only on its loopback interface, so that's the only bind address it takes.
+// Returns the address the server listens on, and the one the connections go to, from this side
+func parseReverseForward(spec string) (remoteAddress, localAddress string, err error) {
+	invalid := fmt.Errorf("invalid reverse tunnel %s, expected [bind_address:]port:host:hostport", spec)
+
+	parts, err := splitForwardSpec(spec)
+	if err != nil {
+		return "", "", err
+	}
+	bindAddress := "localhost"
+	if len(parts) == 4 {
+		bindAddress, parts = parts[0], parts[1:]
+		if ip := net.ParseIP(bindAddress); bindAddress != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return "", "", fmt.Errorf("invalid reverse tunnel %s: the server listens only on its loopback interface", spec)
+		}
+	}
+	if len(parts) != 3 || !isPort(parts[0]) || parts[1] == "" || !isPort(parts[2]) {
+		return "", "", invalid
+	}
+	return net.JoinHostPort(bindAddress, parts[0]), net.JoinHostPort(parts[1], parts[2]), nil
+}
+
+// Copies the data both ways, until one of the connections is closed
+func pipeConns(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		defer a.Close()
+		defer b.Close()
+	}()
+	io.Copy(b, a)
+	defer a.Close()
+	defer b.Close()
+}
+
+// Dials a tunnel WS connection, negotiating its compression if compress is set, and sends the init
+// message on it
+func dialTunnel(tunnelURL string, initMsg server.TunInitMsg, compress bool) (*server.WSConnReadWriteCloser, error) {
+	wsConn, err := dialWS(tunnelURL, compress)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(initMsg)
+	if err == nil {
+		err = wsConn.WriteMessage(websocket.TextMessage, data)
+	}
+	if err != nil {
+		wsConn.Close()
+		return nil, err
+	}
+	return &server.WSConnReadWriteCloser{
+		WsConn:               wsConn,
+		CompressionThreshold: server.DefaultCompressionThreshold,
+	}, nil
+}
+
+// Logs the reason the server closed the tunnel for, if it gave one
+func logTunnelClosed(wsRWC *server.WSConnReadWriteCloser, name string) {
+	if tunErr := server.TunnelErrorFromClose(wsRWC.CloseError()); tunErr != nil {
+		log.Errorf("The %s was closed by the server (%s): %s", name, tunErr.Code, tunErr.Message)
+	}
+}
+
+// Opens a stream to the given destination, and waits for the server to connect it. If the server
+// cannot, the error is a *server.TunnelError
+func openTunnelStream(session *yamux.Session, network, address string) (net.Conn, error) {
+	stream, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	var reply server.TunStreamReplyMsg
+	err = server.WriteTunMsg(stream, server.TunStreamMsg{Address: address, Network: network})
+	if err == nil {
+		err = server.ReadTunMsg(stream, &reply)
+	}
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if reply.Error != "" {
+		stream.Close()
+		return nil, &server.TunnelError{Code: reply.Code, Message: reply.Error}
+	}
+	return stream, nil
+}
+
+// Calls handle for each connection accepted by the listener, until it's closed
+func acceptLoop(listener net.Listener, handle func(conn net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Debugf("Stopped accepting tunnel connections on %s: %s", listener.Addr(), err.Error())
+			return
+		}
+		go handle(conn)
+	}
+}
+
+// Forwards the datagrams received on the local UDP socket, over the tunnel. Each peer sending
+// datagrams gets its own stream, so the replies can be sent back to it
+func serveUDPForward(packetConn net.PacketConn, session *yamux.Session, remoteAddress string) {
+	streams := map[string]net.Conn{}
+	var streamsMutex sync.Mutex
+
+	buff := make([]byte, 65535)
+	for {
+		n, peer, err := packetConn.ReadFrom(buff)
+		if err != nil {
+			log.Debugf("Stopped reading the UDP tunnel datagrams on %s: %s", packetConn.LocalAddr(), err.Error())
+			return
+		}
+
+		streamsMutex.Lock()
+		stream, ok := streams[peer.String()]
+		streamsMutex.Unlock()
+
+		if !ok {
+			stream, err = openTunnelStream(session, "udp", remoteAddress)
+			if err != nil {
+				log.Warnf("Cannot tunnel the datagrams from %s to %s: %s", peer, remoteAddress, err.Error())
+				continue
+			}
+
+			streamsMutex.Lock()
+			streams[peer.String()] = stream
+			streamsMutex.Unlock()
+
+			go func(stream net.Conn, peer net.Addr) {
+				defer func() {
+					streamsMutex.Lock()
+					delete(streams, peer.String())
+					streamsMutex.Unlock()
+					stream.Close()
+				}()
+
+				replyBuff := make([]byte, 65535)
+				for {
+					stream.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+					n, err := server.ReadDatagram(stream, replyBuff)
+					if err != nil {
+						return
+					}
+					packetConn.WriteTo(replyBuff[:n], peer)
+				}
+			}(stream, peer)
+		}
+
+		if err := server.WriteDatagram(stream, buff[:n]); err != nil {
+			log.Debugf("Cannot tunnel a datagram from %s: %s", peer, err.Error())
+		}
+	}
+}
+
+func (c *ttyShareClient) runForwardTunnels(tunnelURL string, serverProtocol int) {
+	forwards := []localForward{}
+	for _, spec := range c.tunnelAddresses {
+		f, err := parseLocalForward(spec)
+		if err != nil {
+			log.Errorf("%s", err.Error())
+			return
+		}
+		forwards = append(forwards, f)
+	}
+
+	if len(forwards) == 0 && c.dynamicTunnel == "" {
+		return
+	}
+
+	// The servers which know dynamic tunnels also know streams naming their own destinations. The
+	// session supports the tunnels asked for (see requireFeatures)
+	if serverProtocol < 4 {
+		for _, f := range forwards {
+			go c.runLegacyForward(tunnelURL, f)
+		}
+		return
+	}
+
+	wsRWC, err := dialTunnel(tunnelURL, server.TunInitMsg{
+		Version: server.TunProtocolVersion,
+		Dynamic: true,
+		Token:   c.participantToken,
+	}, c.tunnelCompression)
+	if err != nil {
+		log.Errorf("Cannot create a tunnel connection with the server: %s", err.Error())
+		return
+	}
+	defer wsRWC.Close()
+
+	session, err := yamux.Client(wsRWC, nil)
+	if err != nil {
+		log.Errorf("Could not create mux client: %s", err.Error())
+		return
+	}
+	c.addTunnelCloser(session)
+
+	listeners := []io.Closer{}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	for _, f := range forwards {
+		if f.listenNetwork == "udp" {
+			packetConn, err := net.ListenPacket("udp", f.listenAddress)
+			if err != nil {
+				log.Errorf("Could not listen locally for the tunnel to %s: %s", f.remoteAddress, err.Error())
+				continue
+			}
+			listeners = append(listeners, packetConn)
+			c.addTunnelCloser(packetConn)
+			go serveUDPForward(packetConn, session, f.remoteAddress)
+			continue
+		}
+
+		listener, err := net.Listen(f.listenNetwork, f.listenAddress)
+		if err != nil {
+			log.Errorf("Could not listen locally for the tunnel to %s: %s", f.remoteAddress, err.Error())
+			continue
+		}
+		listeners = append(listeners, listener)
+		c.addTunnelCloser(listener)
+
+		f := f
+		go acceptLoop(listener, func(conn net.Conn) {
+			stream, err := openTunnelStream(session, f.remoteNetwork, f.remoteAddress)
+			if err != nil {
+				log.Warnf("Cannot tunnel a connection to %s: %s", f.remoteAddress, err.Error())
+				conn.Close()
+				return
+			}
+			pipeConns(conn, stream)
+		})
+	}
+
+	if c.dynamicTunnel != "" {
+		// [bind_address:]port. Like ssh, listen only on the loopback interface by default
+		listenAddress := net.JoinHostPort("localhost", c.dynamicTunnel)
+		if _, _, err := net.SplitHostPort(c.dynamicTunnel); err == nil {
+			listenAddress = c.dynamicTunnel
+		}
+
+		listener, err := net.Listen("tcp", listenAddress)
+		if err != nil {
+			log.Errorf("Could not listen locally for the dynamic tunnel: %s", err.Error())
+		} else {
+			listeners = append(listeners, listener)
+			c.addTunnelCloser(listener)
+			go acceptLoop(listener, func(conn net.Conn) {
+				serveSocksConn(conn, func(address string) (net.Conn, error) {
+					return openTunnelStream(session, "tcp", address)
+				})
+			})
+		}
+	}
+
+	<-session.CloseChan()
+	logTunnelClosed(wsRWC, "tunnel")
+}
+
+// Runs a -L tunnel with the first version of the tunnel protocol, on its own WS connection
+func (c *ttyShareClient) runLegacyForward(tunnelURL string, f localForward) {
+	wsRWC, err := dialTunnel(tunnelURL, server.TunInitMsg{Address: f.remoteAddress, Token: c.participantToken}, c.tunnelCompression)
+	if err != nil {
+		log.Errorf("Cannot create a tunnel connection with the server. Server needs to allow that")
+		return
+	}
+	defer wsRWC.Close()
+
+	listener, err := net.Listen(f.listenNetwork, f.listenAddress)
+	if err != nil {
+		log.Errorf("Could not listen locally for the tunnel: %s", err.Error())
+		return
+	}
+	defer listener.Close()
+	c.addTunnelCloser(listener)
+
+	session, err := yamux.Server(wsRWC, nil)
+	if err != nil {
+		log.Errorf("Could not create mux server: %s", err.Error())
+		return
+	}
+	c.addTunnelCloser(session)
+
+	go acceptLoop(listener, func(conn net.Conn) {
+		stream, err := session.Open()
+		if err != nil {
+			log.Warn("Cannot create a muxer to the remote, over ws: ", err.Error())
+			conn.Close()
+			return
+		}
+		pipeConns(conn, stream)
+	})
+
+	<-session.CloseChan()
+	logTunnelClosed(wsRWC, fmt.Sprintf("tunnel to %s", f.remoteAddress))
+}
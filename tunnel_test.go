@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseLocalForward(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected localForward
+	}{
+		{"8080:example.com:80", localForward{"tcp", "localhost:8080", "tcp", "example.com:80"}},
+		{"0.0.0.0:8080:example.com:80", localForward{"tcp", "0.0.0.0:8080", "tcp", "example.com:80"}},
+		{"*:8080:example.com:80", localForward{"tcp", ":8080", "tcp", "example.com:80"}},
+		{"[::1]:8080:[fd00::1]:80", localForward{"tcp", "[::1]:8080", "tcp", "[fd00::1]:80"}},
+		{"5353:10.0.0.1:53/udp", localForward{"udp", "localhost:5353", "udp", "10.0.0.1:53"}},
+		{"2375:/var/run/docker.sock", localForward{"tcp", "localhost:2375", "unix", "/var/run/docker.sock"}},
+		{"/tmp/db.sock:db.internal:5432", localForward{"unix", "/tmp/db.sock", "tcp", "db.internal:5432"}},
+		{"/tmp/docker.sock:/var/run/docker.sock", localForward{"unix", "/tmp/docker.sock", "unix", "/var/run/docker.sock"}},
+		{"2375:/tmp/udp", localForward{"tcp", "localhost:2375", "unix", "/tmp/udp"}},
+	}
+
+	for _, test := range tests {
+		f, err := parseLocalForward(test.spec)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.spec, err.Error())
+		} else if f != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.spec, test.expected, f)
+		}
+	}
+
+	for _, spec := range []string{"", "8080", "8080:example.com", "8080::80", "x:example.com:80",
+		"8080:example.com:x", "[::1:8080:example.com:80", "a:b:8080:example.com:80",
+		"/tmp/s:example.com:53/udp"} {
+		if _, err := parseLocalForward(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestParseReverseForward(t *testing.T) {
+	tests := []struct {
+		spec   string
+		remote string
+		local  string
+	}{
+		{"8080:localhost:3000", "localhost:8080", "localhost:3000"},
+		{"8080:[::1]:3000", "localhost:8080", "[::1]:3000"},
+		{"127.0.0.1:8080:db:5432", "127.0.0.1:8080", "db:5432"},
+		{"[::1]:8080:[fd00::1]:80", "[::1]:8080", "[fd00::1]:80"},
+	}
+	for _, test := range tests {
+		remote, local, err := parseReverseForward(test.spec)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.spec, err.Error())
+		} else if remote != test.remote || local != test.local {
+			t.Errorf("%s: expected %s and %s, got %s and %s", test.spec, test.remote, test.local, remote, local)
+		}
+	}
+
+	for _, spec := range []string{"", "8080", "8080:localhost", "8080::3000", "x:localhost:3000",
+		"8080:localhost:x", "8080:[::1:3000", "0.0.0.0:8080:localhost:3000", "*:8080:localhost:3000",
+		"a:b:8080:localhost:3000"} {
+		if _, _, err := parseReverseForward(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
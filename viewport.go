@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often, at most, the viewport is redrawn while the remote side writes output
+const viewportRenderDelay = 15 * time.Millisecond
+
+// viewport sits between the remote output and the local terminal. As long as the local terminal is
+// large enough, the remote output is written as it is. When the local terminal is smaller than the
+// remote one, the viewport renders only a part of the remote screen, which follows the cursor, or
+// can be panned with the pan key. The last line of the local terminal then shows a status line.
+type viewport struct {
+	mutex      sync.Mutex
+	out        io.Writer
+	screen     *screenModel
+	localCols  int
+	localRows  int
+	active     bool
+	offX       int
+	offY       int
+	follow     bool
+	panKey     byte
+	panKeyName string
+	panPending bool
+
+	// What is currently rendered on each line of the local terminal, so only changes are redrawn
+	renderedLines []string
+	renderTimer   *time.Timer
+}
+
+func newViewport(out io.Writer, panKey byte, panKeyName string) *viewport {
+	return &viewport{
+		out:        out,
+		follow:     true,
+		panKey:     panKey,
+		panKeyName: panKeyName,
+	}
+}
+
+// Write handles the output coming from the remote side
+func (vp *viewport) Write(data []byte) (int, error) {
+	vp.mutex.Lock()
+	defer vp.mutex.Unlock()
+
+	if vp.screen != nil {
+		vp.screen.Write(data)
+	}
+	if !vp.active {
+		return vp.out.Write(data)
+	}
+
+	if vp.renderTimer == nil {
+		vp.renderTimer = time.AfterFunc(viewportRenderDelay, func() {
+			vp.mutex.Lock()
+			defer vp.mutex.Unlock()
+			vp.renderTimer = nil
+			if vp.active {
+				vp.render()
+			}
+		})
+	}
+	return len(data), nil
+}
+
+// WriteRaw writes data to the local terminal, without rendering it. Used for the sequences which
+// don't draw anything, like the clipboard ones
+func (vp *viewport) WriteRaw(data []byte) (int, error) {
+	vp.mutex.Lock()
+	defer vp.mutex.Unlock()
+	return vp.out.Write(data)
+}
+
+func (vp *viewport) SetRemoteSize(cols, rows int) {
+	vp.mutex.Lock()
+	defer vp.mutex.Unlock()
+
+	if vp.screen == nil {
+		vp.screen = newScreenModel(cols, rows)
+	} else {
+		vp.screen.Resize(cols, rows)
+	}
+	vp.update()
+}
+
+func (vp *viewport) SetLocalSize(cols, rows int) {
+	vp.mutex.Lock()
+	defer vp.mutex.Unlock()
+
+	vp.localCols, vp.localRows = cols, rows
+	vp.update()
+}
+
+// Decides if the viewport is needed, and redraws everything after a size change
+func (vp *viewport) update() {
+	if vp.screen == nil || vp.localCols == 0 || vp.localRows < 2 {
+		return
+	}
+
+	remoteCols, remoteRows := vp.screen.Size()
+	wasActive := vp.active
+	vp.active = vp.localCols < remoteCols || vp.localRows < remoteRows
+	if !vp.active && !wasActive {
+		return
+	}
+
+	vp.out.Write([]byte("\033[0m\033[H\033[2J"))
+	vp.renderedLines = nil
+	if vp.active {
+		vp.render()
+	} else {
+		// Repaint the whole remote screen from our model, so we don't have to wait for the remote
+		// application to redraw itself. From now on, the remote output is written as it is.
+		vp.offX, vp.offY = 0, 0
+		vp.draw(remoteCols, remoteRows, false)
+	}
+}
+
+// Moves the viewport by the given number of cols and rows
+func (vp *viewport) pan(cols, rows int) {
+	vp.follow = false
+	vp.offX += cols
+	vp.offY += rows
+	vp.render()
+}
+
+func (vp *viewport) render() {
+	cols, rows := vp.localCols, vp.localRows-1
+	remoteCols, remoteRows := vp.screen.Size()
+
+	if vp.follow {
+		x, y, _ := vp.screen.Cursor()
+		// Horizontally, stay at the left margin as long as the cursor is visible from there, as lines
+		// are easier to read from their beginning
+		if x < cols {
+			vp.offX = 0
+		} else if x < vp.offX || x >= vp.offX+cols {
+			vp.offX = x - cols + 1
+		}
+		if y < vp.offY {
+			vp.offY = y
+		} else if y >= vp.offY+rows {
+			vp.offY = y - rows + 1
+		}
+	}
+
+	clamp := func(off, size, remoteSize int) int {
+		if off > remoteSize-size {
+			off = remoteSize - size
+		}
+		if off < 0 {
+			off = 0
+		}
+		return off
+	}
+	vp.offX = clamp(vp.offX, cols, remoteCols)
+	vp.offY = clamp(vp.offY, rows, remoteRows)
+
+	vp.draw(cols, rows, true)
+}
+
+// Draws the remote screen, from the current offset, on the local terminal. Only the lines which
+// changed since the last draw are written.
+func (vp *viewport) draw(cols, rows int, withStatus bool) {
+	var b strings.Builder
+	b.WriteString("\033[?25l")
+
+	if len(vp.renderedLines) != vp.localRows {
+		vp.renderedLines = make([]string, vp.localRows)
+	}
+	drawLine := func(y int, line string) {
+		if vp.renderedLines[y] != line {
+			vp.renderedLines[y] = line
+			fmt.Fprintf(&b, "\033[%d;1H%s", y+1, line)
+		}
+	}
+
+	for y := 0; y < rows && y < vp.localRows; y++ {
+		drawLine(y, vp.screen.RenderLine(vp.offY+y, vp.offX, cols))
+	}
+	if withStatus {
+		drawLine(vp.localRows-1, vp.statusLine())
+	}
+
+	x, y, visible := vp.screen.Cursor()
+	x, y = x-vp.offX, y-vp.offY
+	if visible && x >= 0 && x < cols && y >= 0 && y < rows {
+		fmt.Fprintf(&b, "\033[%d;%dH\033[?25h", y+1, x+1)
+	}
+	vp.out.Write([]byte(b.String()))
+}
+
+func (vp *viewport) statusLine() string {
+	remoteCols, remoteRows := vp.screen.Size()
+	follow := ""
+	if vp.follow {
+		follow = ", following"
+	}
+	status := fmt.Sprintf(" remote %dx%d, at col %d row %d%s | %s + arrows/hjkl/HJKL: pan, f: follow ",
+		remoteCols, remoteRows, vp.offX+1, vp.offY+1, follow, vp.panKeyName)
+
+	runes := []rune(status)
+	if len(runes) > vp.localCols {
+		runes = runes[:vp.localCols]
+	}
+	return "\033[0;7m" + string(runes) + strings.Repeat(" ", vp.localCols-len(runes)) + "\033[0m"
+}
+
+// FilterInput handles the keys used to control the viewport, and returns the rest of the input,
+// which should be sent to the remote side. Keys are interpreted only while the viewport is active,
+// and only after the pan key. Pressing the pan key twice sends it to the remote side.
+func (vp *viewport) FilterInput(data []byte) []byte {
+	vp.mutex.Lock()
+	defer vp.mutex.Unlock()
+
+	if !vp.active && !vp.panPending {
+		return data
+	}
+
+	out := data[:0:0]
+	for i := 0; i < len(data); i++ {
+		if vp.panPending {
+			vp.panPending = false
+			if !vp.active {
+				continue
+			}
+			consumed, forward := vp.handleKey(data[i:])
+			out = append(out, forward...)
+			i += consumed - 1
+			continue
+		}
+		if vp.active && data[i] == vp.panKey {
+			vp.panPending = true
+			continue
+		}
+		out = append(out, data[i])
+	}
+	return out
+}
+
+// Handles the key following the pan key. Returns how many bytes it consumed from the input, and what
+// should be forwarded to the remote side.
+func (vp *viewport) handleKey(keys []byte) (consumed int, forward []byte) {
+	halfCols, halfRows := vp.localCols/2, (vp.localRows-1)/2
+
+	// Arrow keys come as ESC [ A, or ESC O A, depending on the cursor keys mode
+	if len(keys) >= 3 && keys[0] == 0x1b && (keys[1] == '[' || keys[1] == 'O') {
+		switch keys[2] {
+		case 'A':
+			vp.pan(0, -1)
+		case 'B':
+			vp.pan(0, 1)
+		case 'C':
+			vp.pan(1, 0)
+		case 'D':
+			vp.pan(-1, 0)
+		}
+		return 3, nil
+	}
+
+	switch keys[0] {
+	case vp.panKey:
+		return 1, []byte{vp.panKey}
+	case 'h':
+		vp.pan(-1, 0)
+	case 'j':
+		vp.pan(0, 1)
+	case 'k':
+		vp.pan(0, -1)
+	case 'l':
+		vp.pan(1, 0)
+	case 'H':
+		vp.pan(-halfCols, 0)
+	case 'J':
+		vp.pan(0, halfRows)
+	case 'K':
+		vp.pan(0, -halfRows)
+	case 'L':
+		vp.pan(halfCols, 0)
+	case 'f':
+		vp.follow = true
+		vp.render()
+	}
+	return 1, nil
+}